@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type pairHealth string
+
+const (
+	healthUnknown  pairHealth = "unknown"
+	healthUp       pairHealth = "up"
+	healthDegraded pairHealth = "degraded"
+	healthDown     pairHealth = "down"
+)
+
+// minHealthResults is the number of recent pings needed before a pair can
+// be degraded, so a single lost ping after starting doesn't count.
+const minHealthResults = 5
+
+// healthThresholdSettings decide when a pair is degraded or down.
+type healthThresholdSettings struct {
+	downAfter     int
+	upAfter       int
+	degradedRatio float64
+}
+
+// healthThresholds is replaced by setupAlerts once the config is loaded.
+var healthThresholds = healthThresholdSettings{
+	downAfter:     3,
+	upAfter:       3,
+	degradedRatio: 0.9,
+}
+
+// healthChange is a change of the health of a pair.
+type healthChange struct {
+	from         pairHealth
+	to           pairHealth
+	reason       string
+	successRatio float64
+	at           time.Time
+}
+
+// alert is the notification sent to the webhooks, it is also the payload
+// of the json format.
+type alert struct {
+	Pair             string     `json:"pair"`
+	Source           string     `json:"source"`
+	SourceAlias      string     `json:"source_alias,omitempty"`
+	Destination      string     `json:"destination"`
+	DestinationAlias string     `json:"destination_alias,omitempty"`
+	QoS              byte       `json:"qos"`
+	State            pairHealth `json:"state"`
+	PreviousState    pairHealth `json:"previous_state"`
+	Reason           string     `json:"reason,omitempty"`
+	SuccessRatio     float64    `json:"success_ratio"`
+	Timestamp        time.Time  `json:"timestamp"`
+}
+
+// alerts sends the health changes of the pairs to the webhooks.
+var alerts = &alerter{pairs: make(map[string]*pairAlerts)}
+
+// alerter notifies the webhooks when the health of a pair changes. Only
+// one notification is sent per pair within the cooldown, a change during the
+// cooldown is sent when it ends unless the pair went back to the notified
+// state.
+type alerter struct {
+	mu       sync.Mutex
+	webhooks []*webhook
+	cooldown time.Duration
+	pairs    map[string]*pairAlerts
+}
+
+type pairAlerts struct {
+	notified   pairHealth
+	notifiedAt time.Time
+	pending    *alert
+}
+
+// setupAlerts configures the health thresholds and the webhooks.
+func setupAlerts(cfg *config) error {
+	if cfg.AlertDownAfter < 1 {
+		return fmt.Errorf("received alert down after %d but it has to be at least 1", cfg.AlertDownAfter)
+	}
+
+	if cfg.AlertUpAfter < 1 {
+		return fmt.Errorf("received alert up after %d but it has to be at least 1", cfg.AlertUpAfter)
+	}
+
+	if cfg.AlertDegradedRatio < 0 || cfg.AlertDegradedRatio > 1 {
+		return fmt.Errorf("received alert degraded ratio %g but it has to be between 0 and 1", cfg.AlertDegradedRatio)
+	}
+
+	if cfg.AlertCooldown < 0 {
+		return fmt.Errorf("received alert cooldown %d but it can't be negative", cfg.AlertCooldown)
+	}
+
+	if cfg.AlertRetries < 0 {
+		return fmt.Errorf("received %d alert retries but it can't be negative", cfg.AlertRetries)
+	}
+
+	webhooks := make([]*webhook, 0, len(cfg.AlertWebhooks))
+	for _, target := range cfg.AlertWebhooks {
+		w, err := newWebhook(target, cfg.AlertRetries)
+		if err != nil {
+			return err
+		}
+		webhooks = append(webhooks, w)
+	}
+
+	healthThresholds = healthThresholdSettings{
+		downAfter:     cfg.AlertDownAfter,
+		upAfter:       cfg.AlertUpAfter,
+		degradedRatio: cfg.AlertDegradedRatio,
+	}
+
+	alerts.mu.Lock()
+	defer alerts.mu.Unlock()
+
+	alerts.webhooks = webhooks
+	alerts.cooldown = time.Duration(cfg.AlertCooldown) * time.Second
+
+	return nil
+}
+
+// run delivers the notifications until the context is cancelled.
+func (a *alerter) run(ctx context.Context) {
+	a.mu.Lock()
+	webhooks := a.webhooks
+	a.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, w := range webhooks {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.run(ctx)
+		}()
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case now := <-ticker.C:
+			a.sendPending(now)
+		}
+	}
+}
+
+// notify is called when the health of a pair changes, it never blocks.
+func (a *alerter) notify(p *brokerPair, c healthChange) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.webhooks) == 0 {
+		return
+	}
+
+	key := alertKey(p)
+	pa, ok := a.pairs[key]
+	if !ok {
+		// A pair that starts up is not notified.
+		pa = &pairAlerts{notified: healthUp}
+		a.pairs[key] = pa
+	}
+
+	if c.to == pa.notified {
+		pa.pending = nil
+		return
+	}
+
+	al := newAlert(p, c)
+	if c.at.Sub(pa.notifiedAt) < a.cooldown {
+		pa.pending = &al
+		return
+	}
+
+	a.send(pa, al)
+}
+
+// remove forgets a pair that is no longer pinged, dropping its pending
+// notification.
+func (a *alerter) remove(p *brokerPair) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.pairs, alertKey(p))
+}
+
+func alertKey(p *brokerPair) string {
+	return fmt.Sprintf("%s|%s|%d", p.source, p.destination, p.qos)
+}
+
+func (a *alerter) sendPending(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, pa := range a.pairs {
+		if pa.pending != nil && now.Sub(pa.notifiedAt) >= a.cooldown {
+			al := *pa.pending
+			al.Timestamp = now
+			a.send(pa, al)
+		}
+	}
+}
+
+func (a *alerter) send(pa *pairAlerts, al alert) {
+	al.PreviousState = pa.notified
+	pa.notified = al.State
+	pa.notifiedAt = al.Timestamp
+	pa.pending = nil
+
+	for _, w := range a.webhooks {
+		w.enqueue(al)
+	}
+}
+
+func newAlert(p *brokerPair, c healthChange) alert {
+	labels := currentMetricLabels.Load()
+
+	return alert{
+		Pair:             fmt.Sprintf("%s->%s", p.source, p.destination),
+		Source:           p.source,
+		SourceAlias:      labels.alias(p.source),
+		Destination:      p.destination,
+		DestinationAlias: labels.alias(p.destination),
+		QoS:              p.qos,
+		State:            c.to,
+		Reason:           redact(c.reason),
+		SuccessRatio:     c.successRatio,
+		Timestamp:        c.at,
+	}
+}
+
+// title returns a short description of the alert, using the aliases of the
+// brokers when they have one.
+func (al *alert) title() string {
+	return fmt.Sprintf("%s -> %s (qos %d) is %s", brokerName(al.Source, al.SourceAlias), brokerName(al.Destination, al.DestinationAlias), al.QoS, al.State)
+}
+
+// text returns the details of the alert.
+func (al *alert) text() string {
+	details := []string{fmt.Sprintf("Previously %s, %.0f%% of the recent pings succeeded.", al.PreviousState, al.SuccessRatio*100)}
+	if al.Reason != "" {
+		details = append(details, fmt.Sprintf("Last failure: %s", al.Reason))
+	}
+
+	return strings.Join(details, " ")
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPairHealth(t *testing.T) {
+	current := healthThresholds
+	defer func() {
+		healthThresholds = current
+	}()
+	healthThresholds = healthThresholdSettings{downAfter: 2, upAfter: 2, degradedRatio: 0.8}
+
+	state := newPairState()
+	var changes []healthChange
+	state.onHealthChange = func(c healthChange) {
+		changes = append(changes, c)
+	}
+
+	cases := []struct {
+		testDescription string
+		record          func()
+		expectedHealth  pairHealth
+	}{
+		{
+			testDescription: "up after the first ping",
+			record:          func() { state.succeeded(time.Millisecond) },
+			expectedHealth:  healthUp,
+		},
+		{
+			testDescription: "a single lost ping is not down",
+			record:          func() { state.failed(1, "no ping received within 2s") },
+			expectedHealth:  healthUp,
+		},
+		{
+			testDescription: "degraded when too few pings succeeded",
+			record: func() {
+				state.succeeded(time.Millisecond)
+				state.succeeded(time.Millisecond)
+				state.succeeded(time.Millisecond)
+				state.failed(1, "no ping received within 2s")
+			},
+			expectedHealth: healthDegraded,
+		},
+		{
+			testDescription: "down after lost pings in a row",
+			record:          func() { state.failed(1, "no ping received within 2s") },
+			expectedHealth:  healthDown,
+		},
+		{
+			testDescription: "still down after a single received ping",
+			record:          func() { state.succeeded(time.Millisecond) },
+			expectedHealth:  healthDown,
+		},
+		{
+			testDescription: "degraded when recovering with a low success ratio",
+			record:          func() { state.succeeded(time.Millisecond) },
+			expectedHealth:  healthDegraded,
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+		c.record()
+		require.Equal(t, c.expectedHealth, state.health)
+	}
+
+	require.Len(t, changes, 4)
+	require.Equal(t, healthUnknown, changes[0].from)
+	require.Equal(t, healthDegraded, changes[1].to)
+	require.Equal(t, "no ping received within 2s", changes[1].reason)
+	require.Equal(t, healthDown, changes[2].to)
+	require.Equal(t, healthDown, changes[3].from)
+	require.InDelta(t, 6.0/9.0, changes[3].successRatio, 0.001)
+}
+
+func TestAlerter(t *testing.T) {
+	w, err := newWebhook("json+http://localhost:8080/alerts", 0)
+	require.NoError(t, err)
+
+	a := &alerter{
+		webhooks: []*webhook{w},
+		cooldown: time.Minute,
+		pairs:    make(map[string]*pairAlerts),
+	}
+	pair := &brokerPair{source: "tcp://broker1:1883", destination: "tcp://broker2:1883", qos: 1}
+	start := time.Unix(1662026400, 0)
+	change := func(from pairHealth, to pairHealth, after time.Duration) {
+		a.notify(pair, healthChange{from: from, to: to, at: start.Add(after)})
+	}
+	sent := func() []pairHealth {
+		var states []pairHealth
+		for {
+			select {
+			case al := <-w.queue:
+				states = append(states, al.State)
+			default:
+				return states
+			}
+		}
+	}
+
+	// The first health of a pair is not notified.
+	change(healthUnknown, healthUp, 0)
+	require.Empty(t, sent())
+
+	change(healthUp, healthDown, time.Second)
+	require.Equal(t, []pairHealth{healthDown}, sent())
+
+	// Flapping within the cooldown is not notified.
+	change(healthDown, healthUp, 2*time.Second)
+	change(healthUp, healthDown, 3*time.Second)
+	a.sendPending(start.Add(30 * time.Second))
+	require.Empty(t, sent())
+
+	// The last change within the cooldown is sent when it ends.
+	change(healthDown, healthDegraded, 40*time.Second)
+	change(healthDegraded, healthUp, 50*time.Second)
+	a.sendPending(start.Add(50 * time.Second))
+	require.Empty(t, sent())
+	a.sendPending(start.Add(61 * time.Second))
+	require.Equal(t, []pairHealth{healthUp}, sent())
+
+	// A removed pair is forgotten together with its pending change.
+	change(healthUp, healthDown, 70*time.Second)
+	a.remove(pair)
+	require.Empty(t, a.pairs)
+	a.sendPending(start.Add(5 * time.Minute))
+	require.Empty(t, sent())
+}
+
+func TestWebhookPayloads(t *testing.T) {
+	current := webhookRetryBackoff
+	webhookRetryBackoff = time.Millisecond
+	defer func() {
+		webhookRetryBackoff = current
+	}()
+
+	al := alert{
+		Pair:          "tcp://broker1:1883->tcp://broker2:1883",
+		Source:        "tcp://broker1:1883",
+		SourceAlias:   "node-1",
+		Destination:   "tcp://broker2:1883",
+		QoS:           1,
+		State:         healthDown,
+		PreviousState: healthUp,
+		Reason:        "no ping received within 2s",
+		SuccessRatio:  0.5,
+		Timestamp:     time.Unix(1662026400, 0).UTC(),
+	}
+
+	cases := []struct {
+		testDescription string
+		format          string
+		statuses        []int
+		expectedErr     string
+		expected        map[string]interface{}
+	}{
+		{
+			testDescription: "json",
+			format:          "json",
+			expected: map[string]interface{}{
+				"pair":           "tcp://broker1:1883->tcp://broker2:1883",
+				"source":         "tcp://broker1:1883",
+				"source_alias":   "node-1",
+				"destination":    "tcp://broker2:1883",
+				"qos":            float64(1),
+				"state":          "down",
+				"previous_state": "up",
+				"reason":         "no ping received within 2s",
+				"success_ratio":  0.5,
+				"timestamp":      "2022-09-01T10:00:00Z",
+			},
+		},
+		{
+			testDescription: "slack retried when unavailable",
+			format:          "slack",
+			statuses:        []int{http.StatusServiceUnavailable, http.StatusTooManyRequests},
+			expected: map[string]interface{}{
+				"text": ":red_circle: node-1 (tcp://broker1:1883) -> tcp://broker2:1883 (qos 1) is down",
+				"attachments": []interface{}{map[string]interface{}{
+					"color": "#e01e5a",
+					"text":  "Previously up, 50% of the recent pings succeeded. Last failure: no ping received within 2s",
+					"ts":    float64(1662026400),
+				}},
+			},
+		},
+		{
+			testDescription: "teams",
+			format:          "teams",
+			expected: map[string]interface{}{
+				"@type":      "MessageCard",
+				"@context":   "https://schema.org/extensions",
+				"themeColor": "e01e5a",
+				"summary":    "node-1 (tcp://broker1:1883) -> tcp://broker2:1883 (qos 1) is down",
+				"title":      "node-1 (tcp://broker1:1883) -> tcp://broker2:1883 (qos 1) is down",
+				"text":       "Previously up, 50% of the recent pings succeeded. Last failure: no ping received within 2s",
+				"sections": []interface{}{map[string]interface{}{
+					"facts": []interface{}{
+						map[string]interface{}{"name": "Source", "value": "tcp://broker1:1883"},
+						map[string]interface{}{"name": "Destination", "value": "tcp://broker2:1883"},
+						map[string]interface{}{"name": "QoS", "value": "1"},
+						map[string]interface{}{"name": "State", "value": "down"},
+						map[string]interface{}{"name": "Previous state", "value": "up"},
+						map[string]interface{}{"name": "Success ratio", "value": "50%"},
+						map[string]interface{}{"name": "Time", "value": "2022-09-01T10:00:00Z"},
+						map[string]interface{}{"name": "Last failure", "value": "no ping received within 2s"},
+					},
+				}},
+			},
+		},
+		{
+			testDescription: "client errors are not retried",
+			format:          "json",
+			statuses:        []int{http.StatusNotFound},
+			expectedErr:     "webhook returned status 404: ",
+		},
+		{
+			testDescription: "gives up after the retries",
+			format:          "json",
+			statuses:        []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			expectedErr:     "webhook returned status 502: ",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+		receiver, url := startTestReceiver(t, c.statuses...)
+		w, err := newWebhook(c.format+"+"+url, 2)
+		require.NoError(t, err)
+
+		err = w.deliver(context.Background(), al)
+		requests, bodies := receiver.received()
+		if c.expectedErr != "" {
+			require.EqualError(t, err, c.expectedErr)
+			require.Empty(t, requests)
+			continue
+		}
+		require.NoError(t, err)
+		require.Len(t, requests, 1)
+		require.Equal(t, "application/json", requests[0].Header.Get("Content-Type"))
+
+		var payload map[string]interface{}
+		require.NoError(t, json.Unmarshal(bodies[0], &payload))
+		require.Equal(t, c.expected, payload)
+	}
+}
+
+func TestSetupAlertsErrors(t *testing.T) {
+	valid := config{AlertDownAfter: 3, AlertUpAfter: 3, AlertDegradedRatio: 0.9, AlertCooldown: 300, AlertRetries: 3}
+	cases := []struct {
+		testDescription string
+		modify          func(cfg *config)
+		expectedErr     string
+	}{
+		{
+			testDescription: "down after zero",
+			modify:          func(cfg *config) { cfg.AlertDownAfter = 0 },
+			expectedErr:     "received alert down after 0 but it has to be at least 1",
+		},
+		{
+			testDescription: "up after zero",
+			modify:          func(cfg *config) { cfg.AlertUpAfter = 0 },
+			expectedErr:     "received alert up after 0 but it has to be at least 1",
+		},
+		{
+			testDescription: "degraded ratio above one",
+			modify:          func(cfg *config) { cfg.AlertDegradedRatio = 1.5 },
+			expectedErr:     "received alert degraded ratio 1.5 but it has to be between 0 and 1",
+		},
+		{
+			testDescription: "negative cooldown",
+			modify:          func(cfg *config) { cfg.AlertCooldown = -1 },
+			expectedErr:     "received alert cooldown -1 but it can't be negative",
+		},
+		{
+			testDescription: "negative retries",
+			modify:          func(cfg *config) { cfg.AlertRetries = -1 },
+			expectedErr:     "received -1 alert retries but it can't be negative",
+		},
+		{
+			testDescription: "unsupported format",
+			modify:          func(cfg *config) { cfg.AlertWebhooks = []string{"discord+https://discord.com/api/webhooks/1"} },
+			expectedErr:     "webhook \"discord+https://discord.com/api/webhooks/1\" has unsupported format \"discord\", only slack, teams and json are supported",
+		},
+		{
+			testDescription: "invalid url",
+			modify:          func(cfg *config) { cfg.AlertWebhooks = []string{"slack+hooks.slack.com"} },
+			expectedErr:     "webhook url \"[REDACTED]\" should be a url like http://host:port",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+		cfg := valid
+		c.modify(&cfg)
+		require.EqualError(t, setupAlerts(&cfg), c.expectedErr)
+	}
+}
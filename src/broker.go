@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// brokerSchemes contains the supported broker url schemes and if they use tls.
+var brokerSchemes = map[string]bool{
+	"tcp":   false,
+	"mqtt":  false,
+	"ws":    false,
+	"ssl":   true,
+	"tls":   true,
+	"mqtts": true,
+	"tcps":  true,
+	"wss":   true,
+}
+
+type brokerOptions struct {
+	protocolVersion string
+	tlsConfig       *tls.Config
+	credentials     *credentialOptions
+	// settings identifies the config the options were created from, to be
+	// able to tell if a broker has to be reconnected after a reload.
+	settings string
+}
+
+func newBrokerOptions(cfg *config, broker string) (brokerOptions, error) {
+	var opts brokerOptions
+
+	protocolVersion, err := parseProtocolVersion(cfg.ProtocolVersion)
+	if err != nil {
+		return brokerOptions{}, err
+	}
+	opts.protocolVersion = protocolVersion
+
+	tlsEnabled, tlsOpts := brokerTLSOptions(cfg, broker)
+	// A url with a plaintext scheme would be dialed without tls, sending the
+	// credentials in the clear while tls looks enabled.
+	if tlsEnabled && strings.Contains(broker, "://") && !brokerSecure(broker) {
+		return brokerOptions{}, fmt.Errorf("tls is enabled for broker %s but its url has a scheme without tls, use ssl, tls, mqtts, tcps or wss instead", redact(broker))
+	}
+	if tlsEnabled {
+		tlsCfg, err := newTLSConfig(tlsOpts, brokerHost(broker))
+		if err != nil {
+			return brokerOptions{}, fmt.Errorf("unable to configure tls for broker %s: %w", redact(broker), err)
+		}
+		opts.tlsConfig = tlsCfg
+	}
+
+	credOpts := brokerCredentialOptions(cfg, broker)
+	// The settings are hashed to keep the password out of the task keys.
+	opts.settings = fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s %t %+v %+v", protocolVersion, tlsEnabled, tlsOpts, credOpts))))
+	if credOpts.enabled() {
+		_, _, err := credOpts.credentials()
+		if err != nil {
+			return brokerOptions{}, fmt.Errorf("unable to configure credentials for broker %s: %w", redact(broker), err)
+		}
+		opts.credentials = &credOpts
+	}
+
+	return opts, nil
+}
+
+func newBrokerOptionsMap(cfg *config, brokers []string) (map[string]brokerOptions, error) {
+	opts := make(map[string]brokerOptions, len(brokers))
+	for _, broker := range brokers {
+		o, err := newBrokerOptions(cfg, broker)
+		if err != nil {
+			return nil, err
+		}
+		opts[broker] = o
+	}
+
+	return opts, nil
+}
+
+func brokerTLSOptions(cfg *config, broker string) (bool, tlsOptions) {
+	enabled := cfg.TLSEnabled || brokerSecure(broker)
+	opts := tlsOptions{
+		caFile:     cfg.TLSCAFile,
+		certFile:   cfg.TLSCertFile,
+		keyFile:    cfg.TLSKeyFile,
+		serverName: cfg.TLSServerName,
+		minVersion: cfg.TLSMinVersion,
+	}
+
+	override := func(overrides map[string]string, dest *string) {
+		v, ok := overrides[broker]
+		if !ok {
+			return
+		}
+		enabled = true
+		*dest = v
+	}
+
+	override(cfg.BrokerTLSCAFile, &opts.caFile)
+	override(cfg.BrokerTLSCertFile, &opts.certFile)
+	override(cfg.BrokerTLSKeyFile, &opts.keyFile)
+	override(cfg.BrokerTLSServerName, &opts.serverName)
+	override(cfg.BrokerTLSMinVersion, &opts.minVersion)
+
+	return enabled, opts
+}
+
+func brokerCredentialOptions(cfg *config, broker string) credentialOptions {
+	opts := credentialOptions{
+		username:     cfg.Username,
+		password:     cfg.Password,
+		passwordFile: cfg.PasswordFile,
+		tokenFile:    cfg.TokenFile,
+	}
+
+	if v, ok := cfg.BrokerUsername[broker]; ok {
+		opts.username = v
+	}
+
+	if v, ok := cfg.BrokerPasswordFile[broker]; ok {
+		opts.password = ""
+		opts.passwordFile = v
+		opts.tokenFile = ""
+	}
+
+	if v, ok := cfg.BrokerTokenFile[broker]; ok {
+		opts.password = ""
+		opts.passwordFile = ""
+		opts.tokenFile = v
+	}
+
+	return opts
+}
+
+// connectionOptions returns the options used to connect to the broker, the
+// callbacks are left for the caller to set.
+func (opts *brokerOptions) connectionOptions(broker string, clientID string) connectionOptions {
+	return connectionOptions{
+		brokerURL:       brokerURL(broker, *opts),
+		clientID:        clientID,
+		protocolVersion: opts.protocolVersion,
+		tlsConfig:       opts.tlsConfig,
+		credentials:     opts.credentials,
+		connectTimeout:  1 * time.Second,
+	}
+}
+
+// validateBroker makes sure the broker is either host:port or a url with a
+// supported scheme.
+func validateBroker(broker string) error {
+	if !strings.Contains(broker, "://") {
+		if broker == "" || strings.ContainsAny(broker, "/@") {
+			return fmt.Errorf("broker %q should be host:port or a url", redact(broker))
+		}
+		return nil
+	}
+
+	u, err := url.Parse(broker)
+	if err != nil {
+		return fmt.Errorf("unable to parse broker url %q", redact(broker))
+	}
+
+	if _, ok := brokerSchemes[strings.ToLower(u.Scheme)]; !ok {
+		return fmt.Errorf("broker url %q has unsupported scheme %q", redact(broker), u.Scheme)
+	}
+
+	if u.Host == "" {
+		return fmt.Errorf("broker url %q is missing host", redact(broker))
+	}
+
+	if u.User != nil {
+		return fmt.Errorf("broker url %q contains credentials, use the credential flags instead", redact(broker))
+	}
+
+	return nil
+}
+
+// brokerHost returns the host of the broker, without the port.
+func brokerHost(broker string) string {
+	if strings.Contains(broker, "://") {
+		u, err := url.Parse(broker)
+		if err != nil {
+			return ""
+		}
+		return u.Hostname()
+	}
+
+	host, _, err := net.SplitHostPort(broker)
+	if err != nil {
+		return broker
+	}
+
+	return host
+}
+
+// brokerSecure returns true if the broker url has a scheme that uses tls.
+func brokerSecure(broker string) bool {
+	if !strings.Contains(broker, "://") {
+		return false
+	}
+
+	u, err := url.Parse(broker)
+	if err != nil {
+		return false
+	}
+
+	return brokerSchemes[strings.ToLower(u.Scheme)]
+}
+
+// brokerURL returns the url the mqtt client should connect to, adding a
+// scheme if the broker is configured without one.
+func brokerURL(broker string, opts brokerOptions) string {
+	if strings.Contains(broker, "://") {
+		return broker
+	}
+
+	if opts.tlsConfig != nil {
+		return fmt.Sprintf("ssl://%s", broker)
+	}
+
+	return fmt.Sprintf("tcp://%s", broker)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerTLSOptions(t *testing.T) {
+	cfg := &config{
+		TLSCAFile:           "ca.pem",
+		TLSMinVersion:       "1.2",
+		BrokerTLSServerName: map[string]string{"b:8883": "b.example.com"},
+		BrokerTLSMinVersion: map[string]string{"b:8883": "1.3"},
+	}
+
+	enabled, opts := brokerTLSOptions(cfg, "a:1883")
+	require.False(t, enabled)
+	require.Equal(t, tlsOptions{caFile: "ca.pem", minVersion: "1.2"}, opts)
+
+	enabled, opts = brokerTLSOptions(cfg, "b:8883")
+	require.True(t, enabled)
+	require.Equal(t, tlsOptions{caFile: "ca.pem", serverName: "b.example.com", minVersion: "1.3"}, opts)
+
+	cfg.TLSEnabled = true
+	enabled, _ = brokerTLSOptions(cfg, "a:1883")
+	require.True(t, enabled)
+}
+
+func TestNewBrokerOptionsTLSScheme(t *testing.T) {
+	cases := []struct {
+		testDescription string
+		cfg             config
+		broker          string
+		expectedError   string
+	}{
+		{
+			testDescription: "tls enabled for host and port",
+			cfg:             config{TLSEnabled: true},
+			broker:          "a:8883",
+		},
+		{
+			testDescription: "tls enabled with tls scheme",
+			cfg:             config{TLSEnabled: true},
+			broker:          "ssl://a:8883",
+		},
+		{
+			testDescription: "tls enabled with tcp scheme",
+			cfg:             config{TLSEnabled: true},
+			broker:          "tcp://a:1883",
+			expectedError:   "tls is enabled for broker tcp://a:1883 but its url has a scheme without tls, use ssl, tls, mqtts, tcps or wss instead",
+		},
+		{
+			testDescription: "per broker tls with websocket scheme",
+			cfg:             config{BrokerTLSServerName: map[string]string{"ws://a:8080/mqtt": "a.example.com"}},
+			broker:          "ws://a:8080/mqtt",
+			expectedError:   "tls is enabled for broker ws://a:8080/mqtt but its url has a scheme without tls, use ssl, tls, mqtts, tcps or wss instead",
+		},
+		{
+			testDescription: "per broker tls with mqtt scheme",
+			cfg:             config{BrokerTLSCAFile: map[string]string{"mqtt://a:1883": "ca.pem"}},
+			broker:          "mqtt://a:1883",
+			expectedError:   "tls is enabled for broker mqtt://a:1883 but its url has a scheme without tls, use ssl, tls, mqtts, tcps or wss instead",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+		c.cfg.ProtocolVersion = "3.1.1"
+		c.cfg.TLSMinVersion = "1.2"
+		_, err := newBrokerOptions(&c.cfg, c.broker)
+		testError(t, err, c.expectedError)
+	}
+}
+
+func TestValidateBroker(t *testing.T) {
+	cases := []struct {
+		input         string
+		expectedError string
+	}{
+		{input: "a:1883"},
+		{input: "tcp://a:1883"},
+		{input: "ssl://a:8883"},
+		{input: "tcps://a:8883"},
+		{input: "ws://a:8080/mqtt"},
+		{input: "wss://a/mqtt"},
+		{input: "", expectedError: "broker \"\" should be host:port or a url"},
+		{input: "a:1883/mqtt", expectedError: "broker \"a:1883/mqtt\" should be host:port or a url"},
+		{input: "ftp://a:21", expectedError: "broker url \"ftp://a:21\" has unsupported scheme \"ftp\""},
+		{input: "ws:///mqtt", expectedError: "broker url \"ws:///mqtt\" is missing host"},
+		{input: "tcp://user:pass@a:1883", expectedError: "broker url \"tcp://[REDACTED]@a:1883\" contains credentials, use the credential flags instead"},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %q", i, c.input)
+		err := validateBroker(c.input)
+		testError(t, err, c.expectedError)
+	}
+}
+
+func TestBrokerHost(t *testing.T) {
+	require.Equal(t, "broker1", brokerHost("broker1:8883"))
+	require.Equal(t, "10.0.0.1", brokerHost("ssl://10.0.0.1:8883"))
+	require.Equal(t, "::1", brokerHost("wss://[::1]:443/mqtt"))
+	require.Equal(t, "broker1", brokerHost("broker1"))
+}
+
+func TestBrokerURL(t *testing.T) {
+	require.Equal(t, "tcp://a:1883", brokerURL("a:1883", brokerOptions{}))
+	require.Equal(t, "ssl://a:8883", brokerURL("a:8883", brokerOptions{tlsConfig: &tls.Config{MinVersion: tls.VersionTLS12}}))
+	require.Equal(t, "tls://a:8883", brokerURL("tls://a:8883", brokerOptions{}))
+	require.Equal(t, "wss://a:443/mqtt", brokerURL("wss://a:443/mqtt", brokerOptions{}))
+
+	require.True(t, brokerSecure("wss://a:443/mqtt"))
+	require.True(t, brokerSecure("ssl://a:8883"))
+	require.True(t, brokerSecure("tcps://a:8883"))
+	require.False(t, brokerSecure("ws://a:8080/mqtt"))
+	require.False(t, brokerSecure("ssl:8883"))
+}
+
+func TestBrokerCredentialOptions(t *testing.T) {
+	cfg := &config{
+		Username:           "foo",
+		Password:           "bar",
+		BrokerUsername:     map[string]string{"b:1883": "baz"},
+		BrokerPasswordFile: map[string]string{"b:1883": "/password"},
+		BrokerTokenFile:    map[string]string{"c:1883": "/token"},
+	}
+
+	require.Equal(t, credentialOptions{username: "foo", password: "bar"}, brokerCredentialOptions(cfg, "a:1883"))
+	require.Equal(t, credentialOptions{username: "baz", passwordFile: "/password"}, brokerCredentialOptions(cfg, "b:1883"))
+	require.Equal(t, credentialOptions{username: "foo", tokenFile: "/token"}, brokerCredentialOptions(cfg, "c:1883"))
+}
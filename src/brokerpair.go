@@ -15,13 +15,27 @@ type brokerPair struct {
 	clientID          string
 	subscriptionTopic string
 	publishTopic      string
+	qos               byte
 }
 
-func generateBrokerPairs(list []string, clientIdPrefix string) ([]brokerPair, error) {
+func generateBrokerPairs(list []string, clientIdPrefix string, qosLevels []byte) ([]brokerPair, error) {
 	if len(list) < 2 {
 		return nil, fmt.Errorf("received %d item(s) in list but at least 2 are required", len(list))
 	}
 
+	for _, broker := range list {
+		err := validateBroker(broker)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, qos := range qosLevels {
+		if qos > 2 {
+			return nil, fmt.Errorf("received qos %d but only 0, 1 and 2 are supported", qos)
+		}
+	}
+
 	var pairs []brokerPair
 	others := func(self string, all []string) []string {
 		others := []string{}
@@ -35,34 +49,51 @@ func generateBrokerPairs(list []string, clientIdPrefix string) ([]brokerPair, er
 
 	for _, source := range list {
 		for _, destination := range others(source, list) {
-			base64Source := base64.RawURLEncoding.EncodeToString([]byte(source))
-			base64Destination := base64.RawURLEncoding.EncodeToString([]byte(destination))
-
-			randomString, err := generateRandomString(8)
-			if err != nil {
-				return nil, err
+			for _, qos := range qosLevels {
+				pair, err := newBrokerPair(source, destination, clientIdPrefix, qos)
+				if err != nil {
+					return nil, err
+				}
+				pairs = append(pairs, pair)
 			}
-			clientID := fmt.Sprintf("%s-%s", clientIdPrefix, randomString)
-
-			subscriptionTopic := fmt.Sprintf("mqtt_ping/%s/%s", base64Source, base64Destination)
-			publishTopic := fmt.Sprintf("mqtt_ping/%s/%s", base64Destination, base64Source)
-
-			pair := brokerPair{
-				source:            source,
-				destination:       destination,
-				base64Source:      base64Source,
-				base64Destination: base64Destination,
-				clientID:          clientID,
-				subscriptionTopic: subscriptionTopic,
-				publishTopic:      publishTopic,
-			}
-			pairs = append(pairs, pair)
 		}
 	}
 
 	return pairs, nil
 }
 
+func newBrokerPair(source string, destination string, clientIdPrefix string, qos byte) (brokerPair, error) {
+	base64Source := base64.RawURLEncoding.EncodeToString([]byte(source))
+	base64Destination := base64.RawURLEncoding.EncodeToString([]byte(destination))
+
+	randomString, err := generateRandomString(8)
+	if err != nil {
+		return brokerPair{}, err
+	}
+	clientID := fmt.Sprintf("%s-%s", clientIdPrefix, randomString)
+
+	subscriptionTopic := fmt.Sprintf("mqtt_ping/%s/%s", base64Source, base64Destination)
+	publishTopic := fmt.Sprintf("mqtt_ping/%s/%s", base64Destination, base64Source)
+
+	// The qos 0 topics are kept without suffix to stay compatible with
+	// existing broker acls.
+	if qos > 0 {
+		subscriptionTopic = fmt.Sprintf("%s/qos%d", subscriptionTopic, qos)
+		publishTopic = fmt.Sprintf("%s/qos%d", publishTopic, qos)
+	}
+
+	return brokerPair{
+		source:            source,
+		destination:       destination,
+		base64Source:      base64Source,
+		base64Destination: base64Destination,
+		clientID:          clientID,
+		subscriptionTopic: subscriptionTopic,
+		publishTopic:      publishTopic,
+		qos:               qos,
+	}, nil
+}
+
 func generateRandomString(n int) (string, error) {
 	const letters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
 	ret := make([]byte, n)
@@ -1,6 +1,10 @@
 package main
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
 
 func TestGenerateBrokerPairs(t *testing.T) {
 	cases := []struct {
@@ -32,6 +36,25 @@ func TestGenerateBrokerPairs(t *testing.T) {
 				},
 			},
 		},
+		{
+			testDescription: "mixed transports",
+			input:           []string{"tcp://a:1883", "wss://b:443/mqtt"},
+			output: []brokerPair{
+				{
+					source:      "tcp://a:1883",
+					destination: "wss://b:443/mqtt",
+				},
+				{
+					source:      "wss://b:443/mqtt",
+					destination: "tcp://a:1883",
+				},
+			},
+		},
+		{
+			testDescription: "unsupported scheme",
+			input:           []string{"tcp://a:1883", "http://b:80"},
+			expectedError:   "broker url \"http://b:80\" has unsupported scheme \"http\"",
+		},
 		{
 			testDescription: "three strings",
 			input:           []string{"a", "b", "c"},
@@ -120,7 +143,7 @@ func TestGenerateBrokerPairs(t *testing.T) {
 
 	for i, c := range cases {
 		t.Logf("Test #%d: %s", i, c.testDescription)
-		result, err := generateBrokerPairs(c.input, "mqtt-pinger")
+		result, err := generateBrokerPairs(c.input, "mqtt-pinger", []byte{0})
 		testError(t, err, c.expectedError)
 
 		if len(c.output) != len(result) {
@@ -128,12 +151,33 @@ func TestGenerateBrokerPairs(t *testing.T) {
 		}
 		for i := range result {
 			if c.output[i].source != result[i].source || c.output[i].destination != result[i].destination {
-				t.Fatalf("\ngot:\t%s\nwant:\t%s\n", result, c.output)
+				t.Fatalf("\ngot:\t%v\nwant:\t%v\n", result, c.output)
 			}
 		}
 	}
 }
 
+func TestGenerateBrokerPairsQoS(t *testing.T) {
+	pairs, err := generateBrokerPairs([]string{"a", "b"}, "mqtt-pinger", []byte{0, 1, 2})
+	require.NoError(t, err)
+	require.Len(t, pairs, 6)
+
+	clientIDs := make(map[string]bool)
+	for i, pair := range pairs {
+		require.Equal(t, byte(i%3), pair.qos)
+		clientIDs[pair.clientID] = true
+	}
+	require.Len(t, clientIDs, 6)
+
+	require.Equal(t, "mqtt_ping/YQ/Yg", pairs[0].subscriptionTopic)
+	require.Equal(t, "mqtt_ping/Yg/YQ", pairs[0].publishTopic)
+	require.Equal(t, "mqtt_ping/YQ/Yg/qos1", pairs[1].subscriptionTopic)
+	require.Equal(t, "mqtt_ping/Yg/YQ/qos2", pairs[2].publishTopic)
+
+	_, err = generateBrokerPairs([]string{"a", "b"}, "mqtt-pinger", []byte{3})
+	testError(t, err, "received qos 3 but only 0, 1 and 2 are supported")
+}
+
 func testError(t *testing.T, err error, expected string) {
 	t.Helper()
 
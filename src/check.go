@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// checkPollInterval is the interval in which a ping client in check mode
+// looks for the remaining pings after sending all of them.
+const checkPollInterval = 50 * time.Millisecond
+
+// checkGroup is shared by the ping clients of a check. It holds back the
+// pings until every client has subscribed or failed, as the clients use clean
+// sessions and a ping sent before the receiving client has subscribed would
+// be lost. A client receives the pings sent by the client of the reverse pair,
+// so every client stays subscribed until all clients have received their
+// pings, or none is sending anymore and the last ping of the check was sent
+// longer than the loss timeout ago.
+type checkGroup struct {
+	lossTimeout time.Duration
+	pending     sync.WaitGroup
+	started     chan struct{}
+
+	mu         sync.Mutex
+	sending    int
+	receiving  int
+	lastSentAt time.Time
+}
+
+func newCheckGroup(clients int, lossTimeout time.Duration) *checkGroup {
+	g := &checkGroup{
+		lossTimeout: lossTimeout,
+		started:     make(chan struct{}),
+		sending:     clients,
+		receiving:   clients,
+	}
+	g.pending.Add(clients)
+	go func() {
+		g.pending.Wait()
+		close(g.started)
+	}()
+
+	return g
+}
+
+func (g *checkGroup) sent(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if now.After(g.lastSentAt) {
+		g.lastSentAt = now
+	}
+}
+
+func (g *checkGroup) sentAll() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.sending--
+}
+
+func (g *checkGroup) receivedAll() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.receiving--
+}
+
+// finished reports whether all clients have received their pings, or have
+// sent them and the last one longer than the loss timeout ago.
+func (g *checkGroup) finished(now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.receiving <= 0 || (g.sending <= 0 && now.Sub(g.lastSentAt) >= g.lossTimeout)
+}
+
+// pairCheck counts the pings of a ping client in check mode. Only pings
+// sent by the check are counted, not those of a pinger running against the
+// same brokers.
+type pairCheck struct {
+	pings        int
+	streamPrefix string
+	group        *checkGroup
+	readyOnce    sync.Once
+
+	mu        sync.Mutex
+	sentPings int
+	latencies []time.Duration
+	stopped   bool
+}
+
+func newPairCheck(pings int, clientIDPrefix string, group *checkGroup) *pairCheck {
+	return &pairCheck{
+		pings:        pings,
+		streamPrefix: clientIDPrefix + "-",
+		group:        group,
+	}
+}
+
+// ready marks the client as subscribed or failed, it is only counted once.
+func (c *pairCheck) ready() {
+	c.readyOnce.Do(c.group.pending.Done)
+}
+
+// waitForPairs blocks until all clients of the check are ready.
+func (c *pairCheck) waitForPairs(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-c.group.started:
+	}
+}
+
+func (c *pairCheck) sent(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped {
+		return
+	}
+
+	c.sentPings++
+	c.group.sent(now)
+	if c.sentPings == c.pings {
+		c.group.sentAll()
+	}
+}
+
+func (c *pairCheck) sentAll() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.sentPings >= c.pings
+}
+
+func (c *pairCheck) received(stream string, latency time.Duration) {
+	if !strings.HasPrefix(stream, c.streamPrefix) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped {
+		return
+	}
+
+	c.latencies = append(c.latencies, latency)
+	if len(c.latencies) == c.pings {
+		c.group.receivedAll()
+	}
+}
+
+// stop marks the client as stopped, so the other clients don't wait for its
+// pings or for it to receive theirs.
+func (c *pairCheck) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped {
+		return
+	}
+	c.stopped = true
+
+	if c.sentPings < c.pings {
+		c.group.sentAll()
+	}
+	if len(c.latencies) < c.pings {
+		c.group.receivedAll()
+	}
+}
+
+// finished reports whether the pings of all clients of the check have been
+// received or lost.
+func (c *pairCheck) finished(now time.Time) bool {
+	return c.group.finished(now)
+}
+
+// checkSettings are the number of pings and the thresholds of the check.
+type checkSettings struct {
+	pings           int
+	pingInterval    time.Duration
+	timeout         time.Duration
+	minSuccessRatio float64
+	maxLatency      time.Duration
+}
+
+func newCheckSettings(cfg *config) (checkSettings, error) {
+	if cfg.CheckPings < 1 {
+		return checkSettings{}, fmt.Errorf("received %d check pings but at least 1 is required", cfg.CheckPings)
+	}
+
+	if cfg.PingInterval < 1 {
+		return checkSettings{}, fmt.Errorf("received ping interval %d but it has to be at least 1", cfg.PingInterval)
+	}
+
+	if cfg.CheckTimeout < 0 {
+		return checkSettings{}, fmt.Errorf("received check timeout %d but it can't be negative", cfg.CheckTimeout)
+	}
+
+	if cfg.CheckMinSuccessRatio < 0 || cfg.CheckMinSuccessRatio > 1 {
+		return checkSettings{}, fmt.Errorf("received check min success ratio %g but it has to be between 0 and 1", cfg.CheckMinSuccessRatio)
+	}
+
+	if cfg.CheckMaxLatency < 0 {
+		return checkSettings{}, fmt.Errorf("received check max latency %g but it can't be negative", cfg.CheckMaxLatency)
+	}
+
+	s := checkSettings{
+		pings:           cfg.CheckPings,
+		pingInterval:    time.Duration(cfg.PingInterval) * time.Second,
+		timeout:         time.Duration(cfg.CheckTimeout) * time.Second,
+		minSuccessRatio: cfg.CheckMinSuccessRatio,
+		maxLatency:      time.Duration(cfg.CheckMaxLatency * float64(time.Second)),
+	}
+
+	// By default there is time to send all pings and wait for the last one,
+	// with some time left to connect.
+	if s.timeout == 0 {
+		s.timeout = time.Duration(s.pings+2)*s.pingInterval + 30*time.Second
+	}
+
+	return s, nil
+}
+
+// checkResult is the outcome of the check of a pair.
+type checkResult struct {
+	pair             brokerPair
+	sourceAlias      string
+	destinationAlias string
+	pings            int
+	sent             int
+	received         int
+	latencies        []time.Duration
+	duration         time.Duration
+	failures         []string
+}
+
+func (r *checkResult) passed() bool {
+	return len(r.failures) == 0
+}
+
+func (r *checkResult) lost() int {
+	return r.pings - r.received
+}
+
+func (r *checkResult) successRatio() float64 {
+	return float64(r.received) / float64(r.pings)
+}
+
+// latency returns the minimum, average and maximum latency of the received
+// pings.
+func (r *checkResult) latency() (time.Duration, time.Duration, time.Duration) {
+	if len(r.latencies) == 0 {
+		return 0, 0, 0
+	}
+
+	min, max, sum := r.latencies[0], r.latencies[0], time.Duration(0)
+	for _, l := range r.latencies {
+		if l < min {
+			min = l
+		}
+		if l > max {
+			max = l
+		}
+		sum += l
+	}
+
+	return min, sum / time.Duration(len(r.latencies)), max
+}
+
+// checkRun is the outcome of the check of all pairs.
+type checkRun struct {
+	settings  checkSettings
+	startedAt time.Time
+	duration  time.Duration
+	results   []checkResult
+}
+
+func (c *checkRun) passed() bool {
+	for i := range c.results {
+		if !c.results[i].passed() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *checkResult) name() string {
+	return fmt.Sprintf("%s -> %s (qos %d)", brokerName(r.pair.source, r.sourceAlias), brokerName(r.pair.destination, r.destinationAlias), r.pair.qos)
+}
+
+// check sends the pings of the check between all pairs, prints the summary
+// to out, writes the reports and reports whether all pairs passed.
+func check(mainCtx context.Context, cfg config, out io.Writer) (bool, error) {
+	ctx, stop := signal.NotifyContext(mainCtx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	run, err := runCheck(ctx, cfg)
+	if err != nil {
+		return false, err
+	}
+
+	err = printCheckSummary(out, run.results)
+	if err != nil {
+		return false, err
+	}
+
+	err = writeCheckReports(&cfg, run)
+	if err != nil {
+		return false, err
+	}
+
+	return run.passed(), nil
+}
+
+// runCheck pings between all pairs until the pings of the check have been
+// received or lost, or the timeout is reached. The brokers are discovered
+// once, the probes are not run.
+func runCheck(ctx context.Context, cfg config) (*checkRun, error) {
+	settings, err := newCheckSettings(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	discoverers, err := newDiscoverers(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	discovered := make(map[string][]discoveredBroker)
+	for _, d := range discoverers {
+		brokers, err := d.discover(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("discovery %s failed: %w", d.name(), err)
+		}
+		discovered[d.name()] = brokers
+	}
+	cfg.Brokers = mergeBrokers(cfg.Brokers, discovered)
+	cfg.brokerLabels = mergeBrokerLabels(cfg.brokerLabels, discovered)
+
+	labels, err := newMetricLabels(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	currentMetricLabels.Store(labels)
+
+	// The check uses its own client ids, so it doesn't take over the
+	// sessions of a pinger running against the same brokers.
+	clientIDPrefix := cfg.ClientIDPrefix + "-check"
+	pairs, err := generateBrokerPairs(cfg.Brokers, clientIDPrefix, cfg.qosLevels())
+	if err != nil {
+		return nil, err
+	}
+
+	brokerOpts, err := newBrokerOptionsMap(&cfg, cfg.Brokers)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info().Int("pairs", len(pairs)).Int("pings", settings.pings).Dur("timeout", settings.timeout).Msg("check started")
+
+	checkCtx, cancel := context.WithTimeout(ctx, settings.timeout)
+	defer cancel()
+
+	start := time.Now()
+	results := make([]checkResult, len(pairs))
+	group := newCheckGroup(len(pairs), 2*settings.pingInterval)
+	var wg sync.WaitGroup
+	for i := range pairs {
+		i := i
+		check := newPairCheck(settings.pings, clientIDPrefix, group)
+		client := newCheckPingClient(&pairs[i], settings.pingInterval, brokerOpts[pairs[i].source], check)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := client.Run(checkCtx)
+			check.ready()
+			check.stop()
+			if err != nil && checkCtx.Err() != nil {
+				err = nil
+			}
+			results[i] = newCheckResult(client, err, time.Since(start), settings, labels)
+		}()
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("check was interrupted: %w", ctx.Err())
+	}
+
+	return &checkRun{
+		settings:  settings,
+		startedAt: start,
+		duration:  time.Since(start),
+		results:   results,
+	}, nil
+}
+
+func newCheckResult(client *PingClient, err error, duration time.Duration, settings checkSettings, labels *metricLabels) checkResult {
+	client.check.mu.Lock()
+	r := checkResult{
+		pair:             client.pair,
+		sourceAlias:      labels.alias(client.pair.source),
+		destinationAlias: labels.alias(client.pair.destination),
+		pings:            settings.pings,
+		sent:             client.check.sentPings,
+		received:         len(client.check.latencies),
+		latencies:        append([]time.Duration(nil), client.check.latencies...),
+		duration:         duration,
+	}
+	client.check.mu.Unlock()
+
+	status := client.state.status(client.pair)
+	if err != nil {
+		r.failures = append(r.failures, fmt.Sprintf("ping client failed: %s", redact(err.Error())))
+	}
+
+	if r.sent < r.pings {
+		failure := fmt.Sprintf("sent %d of %d pings within the timeout", r.sent, r.pings)
+		if status.FailureReason != "" {
+			failure = fmt.Sprintf("%s, last failure: %s", failure, status.FailureReason)
+		}
+		r.failures = append(r.failures, failure)
+	}
+
+	if r.successRatio() < settings.minSuccessRatio {
+		r.failures = append(r.failures, fmt.Sprintf("received %d of %d pings, below the min success ratio %g", r.received, r.pings, settings.minSuccessRatio))
+	}
+
+	if _, _, max := r.latency(); settings.maxLatency > 0 && max > settings.maxLatency {
+		r.failures = append(r.failures, fmt.Sprintf("max latency %s is above %s", formatLatency(max), settings.maxLatency))
+	}
+
+	return r
+}
+
+// checkDirections explains the counts of a pair. The client of a pair is
+// connected to the source and receives the pings the client of the reverse
+// pair published on the destination.
+const checkDirections = "SENT counts the pings from the source to the destination, RECEIVED, LOST and the latency the pings from the destination to the source"
+
+// printCheckSummary writes a table with the result of every pair, followed by
+// the failures.
+func printCheckSummary(out io.Writer, results []checkResult) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tDESTINATION\tQOS\tSENT\tRECEIVED\tLOST\tMIN\tAVG\tMAX\tRESULT")
+
+	passed := 0
+	for i := range results {
+		r := &results[i]
+		min, avg, max := r.latency()
+		result := "FAIL"
+		if r.passed() {
+			result = "ok"
+			passed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s\t%s\n",
+			brokerName(r.pair.source, r.sourceAlias), brokerName(r.pair.destination, r.destinationAlias), r.pair.qos,
+			r.sent, r.received, r.lost(), formatLatency(min), formatLatency(avg), formatLatency(max), result)
+	}
+
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "\n%s\n", checkDirections)
+	fmt.Fprintf(out, "%d of %d pairs passed\n", passed, len(results))
+	for i := range results {
+		for _, failure := range results[i].failures {
+			fmt.Fprintf(out, "%s: %s\n", results[i].name(), failure)
+		}
+	}
+
+	return nil
+}
+
+func formatLatency(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+
+	return d.Round(10 * time.Microsecond).String()
+}
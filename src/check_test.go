@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	broker := startTestBroker(t, nil)
+	brokers := []string{broker.tcp, fmt.Sprintf("ws://%s/mqtt", broker.ws)}
+
+	cases := []struct {
+		testDescription  string
+		args             []string
+		expectedPassed   bool
+		expectedSummary  string
+		expectedFailures []string
+	}{
+		{
+			testDescription: "all pairs pass",
+			args:            []string{"--brokers", brokers[0], brokers[1], "--qos", "1"},
+			expectedPassed:  true,
+			expectedSummary: "2 of 2 pairs passed",
+		},
+		{
+			testDescription: "latency above the max latency",
+			args:            []string{"--brokers", brokers[0], brokers[1], "--check-max-latency", "0.000000001"},
+			expectedPassed:  false,
+			expectedSummary: "0 of 2 pairs passed",
+			expectedFailures: []string{
+				fmt.Sprintf("%s -> %s (qos 0): max latency", brokers[0], brokers[1]),
+				fmt.Sprintf("%s -> %s (qos 0): max latency", brokers[1], brokers[0]),
+			},
+		},
+		{
+			testDescription: "unreachable broker",
+			args:            []string{"--brokers", brokers[0], "127.0.0.1:1", "--check-timeout", "5"},
+			expectedPassed:  false,
+			expectedSummary: "0 of 2 pairs passed",
+			expectedFailures: []string{
+				fmt.Sprintf("%s -> 127.0.0.1:1 (qos 0): received 0 of 2 pings, below the min success ratio 1", brokers[0]),
+				fmt.Sprintf("127.0.0.1:1 -> %s (qos 0): ping client failed:", brokers[0]),
+			},
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+		cfg, err := loadConfig(append([]string{"--check", "--check-pings", "2", "--ping-interval", "1", "--client-id-prefix", fmt.Sprintf("check-%d", i)}, c.args...))
+		require.NoError(t, err)
+
+		var out bytes.Buffer
+		passed, err := check(context.Background(), cfg, &out)
+		require.NoError(t, err)
+		require.Equal(t, c.expectedPassed, passed, out.String())
+		require.Contains(t, out.String(), c.expectedSummary)
+		for _, failure := range c.expectedFailures {
+			require.Contains(t, out.String(), failure)
+		}
+	}
+}
+
+func TestPrintCheckSummary(t *testing.T) {
+	results := []checkResult{
+		{
+			pair:        brokerPair{source: "broker1:1883", destination: "broker2:1883", qos: 0},
+			sourceAlias: "node-1",
+			pings:       3,
+			sent:        3,
+			received:    3,
+			latencies:   []time.Duration{time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond},
+		},
+		{
+			pair:     brokerPair{source: "broker2:1883", destination: "broker1:1883", qos: 0},
+			pings:    3,
+			sent:     1,
+			failures: []string{"sent 1 of 3 pings within the timeout", "received 0 of 3 pings, below the min success ratio 1"},
+		},
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, printCheckSummary(&out, results))
+
+	expected := []string{
+		"SOURCE                 DESTINATION   QOS  SENT  RECEIVED  LOST  MIN  AVG  MAX  RESULT",
+		"node-1 (broker1:1883)  broker2:1883  0    3     3         0     1ms  2ms  3ms  ok",
+		"broker2:1883           broker1:1883  0    1     0         3     -    -    -    FAIL",
+		"",
+		checkDirections,
+		"1 of 2 pairs passed",
+		"broker2:1883 -> broker1:1883 (qos 0): sent 1 of 3 pings within the timeout",
+		"broker2:1883 -> broker1:1883 (qos 0): received 0 of 3 pings, below the min success ratio 1",
+	}
+	require.Equal(t, strings.Join(expected, "\n")+"\n", out.String())
+}
+
+func TestNewCheckSettings(t *testing.T) {
+	valid := config{CheckPings: 10, PingInterval: 1, CheckMinSuccessRatio: 1}
+
+	settings, err := newCheckSettings(&valid)
+	require.NoError(t, err)
+	require.Equal(t, 42*time.Second, settings.timeout)
+
+	cases := []struct {
+		testDescription string
+		modify          func(cfg *config)
+		expectedErr     string
+	}{
+		{
+			testDescription: "no pings",
+			modify:          func(cfg *config) { cfg.CheckPings = 0 },
+			expectedErr:     "received 0 check pings but at least 1 is required",
+		},
+		{
+			testDescription: "negative timeout",
+			modify:          func(cfg *config) { cfg.CheckTimeout = -1 },
+			expectedErr:     "received check timeout -1 but it can't be negative",
+		},
+		{
+			testDescription: "min success ratio above one",
+			modify:          func(cfg *config) { cfg.CheckMinSuccessRatio = 2 },
+			expectedErr:     "received check min success ratio 2 but it has to be between 0 and 1",
+		},
+		{
+			testDescription: "negative max latency",
+			modify:          func(cfg *config) { cfg.CheckMaxLatency = -0.5 },
+			expectedErr:     "received check max latency -0.5 but it can't be negative",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+		cfg := valid
+		c.modify(&cfg)
+		_, err := newCheckSettings(&cfg)
+		require.EqualError(t, err, c.expectedErr)
+	}
+}
+
+func TestCheckPingClientCleanSession(t *testing.T) {
+	p := brokerPair{source: "broker1:1883", destination: "broker2:1883", clientID: "check"}
+
+	client := NewPingClient(&p, time.Second, brokerOptions{})
+	require.False(t, client.conn.(*mqtt3Connection).opts.cleanSession)
+
+	client = newCheckPingClient(&p, time.Second, brokerOptions{}, newPairCheck(1, "check", newCheckGroup(1, time.Second)))
+	require.True(t, client.conn.(*mqtt3Connection).opts.cleanSession)
+}
+
+func TestCheckGroupFinished(t *testing.T) {
+	now := time.Now()
+	group := newCheckGroup(2, time.Second)
+	forward := newPairCheck(1, "check", group)
+	reverse := newPairCheck(1, "check", group)
+
+	forward.sent(now)
+	reverse.received("check-1", time.Millisecond)
+	require.False(t, forward.finished(now.Add(time.Hour)), "the reverse pair is still sending")
+
+	reverse.sent(now.Add(2 * time.Second))
+	require.False(t, forward.finished(now.Add(2*time.Second)), "the last ping was just sent")
+	require.True(t, forward.finished(now.Add(3*time.Second)))
+
+	group = newCheckGroup(2, time.Second)
+	forward = newPairCheck(1, "check", group)
+	reverse = newPairCheck(1, "check", group)
+	forward.received("check-1", time.Millisecond)
+	require.False(t, forward.finished(now))
+
+	reverse.stop()
+	require.True(t, forward.finished(now), "all running pairs received their pings")
+}
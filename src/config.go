@@ -1,22 +1,157 @@
 package main
 
-import "github.com/alexflint/go-arg"
+import (
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/alexflint/go-arg"
+)
 
 type config struct {
+	ConfigFile string `arg:"--config,env:CONFIG_FILE" help:"yaml or json file with brokers and settings, flags and env variables take precedence"`
+
 	Brokers        []string `arg:"--brokers,env:BROKERS" help:"the brokers to send pings between"`
 	ClientIDPrefix string   `arg:"--client-id-prefix,env:CLIENT_ID_PREFIX" default:"mqtt-pinger" help:"the client id prefix when connecting to mqtt"`
 	MetricsAddress string   `arg:"--metrics-address,env:METRICS_ADDRESS" default:"0.0.0.0" help:"the address to use for the metrics http listener"`
 	MetricsPort    int      `arg:"--metrics-port,env:METRICS_PORT" default:"8081" help:"the metrics port to use for the http listener"`
 	PingInterval   int      `arg:"--ping-interval,env:PING_INTERVAL" default:"10" help:"the interval sleeping after publishing ping messages"`
+	ReadyRatio     float64  `arg:"--ready-ratio,env:READY_RATIO" default:"1" help:"the ratio of ping clients that have to be connected and subscribed for /readyz to succeed"`
+
+	LogLevel         string `arg:"--log-level,env:LOG_LEVEL" default:"info" help:"the minimum level of the logged messages (debug, info, warn or error)"`
+	LogFormat        string `arg:"--log-format,env:LOG_FORMAT" default:"logfmt" help:"the format of the logs (logfmt or json)"`
+	LogDedupInterval int    `arg:"--log-dedup-interval,env:LOG_DEDUP_INTERVAL" default:"60" help:"the interval in seconds in which a repeated error of a pair is only logged once, 0 logs every error"`
+
+	OTLPEndpoint     string  `arg:"--otlp-endpoint,env:OTLP_ENDPOINT" help:"the otlp http endpoint to export ping traces to, like http://collector:4318, tracing is disabled if not set"`
+	TraceSampleRatio float64 `arg:"--trace-sample-ratio,env:TRACE_SAMPLE_RATIO" default:"1" help:"the ratio of pings that are traced"`
+
+	PushgatewayURL string `arg:"--pushgateway-url,env:PUSHGATEWAY_URL" help:"the pushgateway to push the metrics to, like http://pushgateway:9091"`
+	RemoteWriteURL string `arg:"--remote-write-url,env:REMOTE_WRITE_URL" help:"the prometheus remote write endpoint to send the metrics to, like http://prometheus:9090/api/v1/write"`
+	PushInterval   int    `arg:"--push-interval,env:PUSH_INTERVAL" default:"15" help:"the interval in seconds between pushing the metrics"`
+	PushJob        string `arg:"--push-job,env:PUSH_JOB" default:"mqtt-pinger" help:"the job label of the pushed metrics"`
+	PushInstance   string `arg:"--push-instance,env:PUSH_INSTANCE" help:"the instance label of the pushed metrics [default: the hostname]"`
+	PushRetries    int    `arg:"--push-retries,env:PUSH_RETRIES" default:"3" help:"the number of times a failed push is retried before waiting for the next interval"`
+	PushBufferSize int    `arg:"--push-buffer-size,env:PUSH_BUFFER_SIZE" default:"240" help:"the number of gathered metrics kept while the remote write endpoint is unavailable, the oldest are dropped first"`
+
+	StatsDAddress         string `arg:"--statsd-address,env:STATSD_ADDRESS" help:"the statsd server to send the metrics to over udp, like statsd:8125, the labels are sent as dogstatsd tags"`
+	StatsDPrefix          string `arg:"--statsd-prefix,env:STATSD_PREFIX" help:"the prefix of the statsd metric names"`
+	InfluxDBURL           string `arg:"--influxdb-url,env:INFLUXDB_URL" help:"the influxdb write endpoint to send the metrics to in line protocol, like http://influxdb:8086/api/v2/write?org=org&bucket=mqtt"`
+	InfluxDBToken         string `arg:"--influxdb-token,env:INFLUXDB_TOKEN" help:"the token used to write to influxdb, prefer the env variable to keep it out of the process args"`
+	InfluxDBFlushInterval int    `arg:"--influxdb-flush-interval,env:INFLUXDB_FLUSH_INTERVAL" default:"10" help:"the interval in seconds between writing the buffered metrics to influxdb"`
+
+	AlertWebhooks      []string `arg:"--alert-webhooks,env:ALERT_WEBHOOKS" help:"webhooks notified when the health of a pair changes, like slack+https://hooks.slack.com/..., teams+https://... or json+https://..."`
+	AlertDownAfter     int      `arg:"--alert-down-after,env:ALERT_DOWN_AFTER" default:"3" help:"the number of pings in a row that have to fail for a pair to be down"`
+	AlertUpAfter       int      `arg:"--alert-up-after,env:ALERT_UP_AFTER" default:"3" help:"the number of pings in a row that have to succeed for a down pair to recover"`
+	AlertDegradedRatio float64  `arg:"--alert-degraded-ratio,env:ALERT_DEGRADED_RATIO" default:"0.9" help:"the success ratio of the recent pings below which a pair is degraded"`
+	AlertCooldown      int      `arg:"--alert-cooldown,env:ALERT_COOLDOWN" default:"300" help:"the minimum time in seconds between notifications about a pair, changes within it are combined"`
+	AlertRetries       int      `arg:"--alert-retries,env:ALERT_RETRIES" default:"3" help:"the number of times a failed notification is retried"`
+
+	Check                bool    `arg:"--check,env:CHECK" default:"false" help:"send a fixed number of pings between all pairs, print a summary and exit, with exit code 2 if a pair failed the check"`
+	CheckPings           int     `arg:"--check-pings,env:CHECK_PINGS" default:"10" help:"the number of pings sent between every pair in check mode"`
+	CheckTimeout         int     `arg:"--check-timeout,env:CHECK_TIMEOUT" help:"the time in seconds after which the check is stopped, pings that weren't received by then are lost [default: the time to send the pings plus 30s]"`
+	CheckMinSuccessRatio float64 `arg:"--check-min-success-ratio,env:CHECK_MIN_SUCCESS_RATIO" default:"1" help:"the ratio of the pings that have to be received for a pair to pass the check"`
+	CheckMaxLatency      float64 `arg:"--check-max-latency,env:CHECK_MAX_LATENCY" help:"the maximum latency in seconds of the received pings for a pair to pass the check, not checked if 0"`
+	CheckJUnitReport     string  `arg:"--check-junit-report,env:CHECK_JUNIT_REPORT" help:"the file to write a junit xml report of the check to, with every pair as a test case"`
+	CheckJSONReport      string  `arg:"--check-json-report,env:CHECK_JSON_REPORT" help:"the file to write a json report of the check to"`
+
+	DNSDiscovery         []string `arg:"--dns-discovery,env:DNS_DISCOVERY" help:"dns names to discover brokers from, either dns+host:port for A/AAAA records or dnssrv+name for SRV records, optionally with a scheme and path like dns+ws://host:port/mqtt"`
+	DNSDiscoveryInterval int      `arg:"--dns-discovery-interval,env:DNS_DISCOVERY_INTERVAL" default:"30" help:"the interval in seconds between dns lookups"`
+
+	FileDiscovery         []string `arg:"--file-discovery,env:FILE_DISCOVERY" help:"yaml or json files to discover brokers from, in the prometheus file_sd format with the brokers as targets, globs like brokers/*.yaml are supported"`
+	FileDiscoveryInterval int      `arg:"--file-discovery-interval,env:FILE_DISCOVERY_INTERVAL" default:"5" help:"the interval in seconds between reading the discovery files"`
+
+	ProtocolVersion string  `arg:"--protocol-version,env:PROTOCOL_VERSION" default:"3.1.1" help:"the mqtt protocol version to use (3.1, 3.1.1 or 5)"`
+	QoS             []uint8 `arg:"--qos,env:QOS" help:"the qos levels to ping with, all levels are probed in parallel for every pair [default: 0]"`
+
+	RetainedProbe         bool `arg:"--retained-probe,env:RETAINED_PROBE" default:"false" help:"verify that retained messages published on the source are delivered to new subscribers on the destination"`
+	RetainedProbeInterval int  `arg:"--retained-probe-interval,env:RETAINED_PROBE_INTERVAL" default:"60" help:"the interval in seconds between retained message probes"`
+	RetainedProbeTimeout  int  `arg:"--retained-probe-timeout,env:RETAINED_PROBE_TIMEOUT" default:"10" help:"the time in seconds to wait for the latest retained message on the destination"`
+
+	WillProbe         bool `arg:"--will-probe,env:WILL_PROBE" default:"false" help:"verify that will messages of clients dropping the connection to the source are delivered to subscribers on all other brokers"`
+	WillProbeInterval int  `arg:"--will-probe-interval,env:WILL_PROBE_INTERVAL" default:"60" help:"the interval in seconds between will message probes"`
+	WillProbeTimeout  int  `arg:"--will-probe-timeout,env:WILL_PROBE_TIMEOUT" default:"10" help:"the time in seconds to wait for the will message on the destinations"`
+
+	SessionProbe             bool `arg:"--session-probe,env:SESSION_PROBE" default:"false" help:"verify that messages published while a client with a persistent session is offline are delivered exactly once when it reconnects"`
+	SessionProbeInterval     int  `arg:"--session-probe-interval,env:SESSION_PROBE_INTERVAL" default:"60" help:"the interval in seconds between persistent session probes"`
+	SessionProbeTimeout      int  `arg:"--session-probe-timeout,env:SESSION_PROBE_TIMEOUT" default:"10" help:"the time in seconds to wait for the queued messages after reconnecting"`
+	SessionProbeMessages     int  `arg:"--session-probe-messages,env:SESSION_PROBE_MESSAGES" default:"10" help:"the number of messages published while the client is offline"`
+	SessionProbeSwitchBroker bool `arg:"--session-probe-switch-broker,env:SESSION_PROBE_SWITCH_BROKER" default:"false" help:"create the session on the source broker and reconnect to the destination broker, instead of using the destination broker for both"`
+
+	TLSEnabled    bool   `arg:"--tls-enabled,env:TLS_ENABLED" default:"false" help:"connect to all brokers using tls"`
+	TLSCAFile     string `arg:"--tls-ca-file,env:TLS_CA_FILE" help:"the ca bundle used to verify the brokers, defaults to the system roots"`
+	TLSCertFile   string `arg:"--tls-cert-file,env:TLS_CERT_FILE" help:"the client certificate to use for mutual tls"`
+	TLSKeyFile    string `arg:"--tls-key-file,env:TLS_KEY_FILE" help:"the client key to use for mutual tls"`
+	TLSServerName string `arg:"--tls-server-name,env:TLS_SERVER_NAME" help:"override the server name used to verify the brokers"`
+	TLSMinVersion string `arg:"--tls-min-version,env:TLS_MIN_VERSION" default:"1.2" help:"the minimum tls version (1.0, 1.1, 1.2 or 1.3)"`
+
+	Username     string `arg:"--username,env:MQTT_USERNAME" help:"the username used when connecting to the brokers"`
+	Password     string `arg:"--password,env:MQTT_PASSWORD" help:"the password used when connecting to the brokers, prefer the env variable or --password-file to keep it out of the process args"`
+	PasswordFile string `arg:"--password-file,env:MQTT_PASSWORD_FILE" help:"file containing the password used when connecting to the brokers"`
+	TokenFile    string `arg:"--token-file,env:MQTT_TOKEN_FILE" help:"file containing a token sent as password when connecting to the brokers, read again on every connect"`
+
+	BrokerUsername     map[string]string `arg:"--broker-username,env:BROKER_USERNAME" help:"per broker override of the username (broker=username)"`
+	BrokerPasswordFile map[string]string `arg:"--broker-password-file,env:BROKER_PASSWORD_FILE" help:"per broker override of the password file (broker=path)"`
+	BrokerTokenFile    map[string]string `arg:"--broker-token-file,env:BROKER_TOKEN_FILE" help:"per broker override of the token file (broker=path)"`
+
+	BrokerTLSCAFile     map[string]string `arg:"--broker-tls-ca-file,env:BROKER_TLS_CA_FILE" help:"per broker override of the ca bundle (broker=path), enables tls for the broker"`
+	BrokerTLSCertFile   map[string]string `arg:"--broker-tls-cert-file,env:BROKER_TLS_CERT_FILE" help:"per broker override of the client certificate (broker=path), enables tls for the broker"`
+	BrokerTLSKeyFile    map[string]string `arg:"--broker-tls-key-file,env:BROKER_TLS_KEY_FILE" help:"per broker override of the client key (broker=path), enables tls for the broker"`
+	BrokerTLSServerName map[string]string `arg:"--broker-tls-server-name,env:BROKER_TLS_SERVER_NAME" help:"per broker override of the server name (broker=name), enables tls for the broker"`
+	BrokerTLSMinVersion map[string]string `arg:"--broker-tls-min-version,env:BROKER_TLS_MIN_VERSION" help:"per broker override of the minimum tls version (broker=version), enables tls for the broker"`
+
+	ExternalLabels map[string]string `arg:"--external-labels,env:EXTERNAL_LABELS" help:"labels added to all metrics (name=value)"`
+
+	// brokerAliases and brokerLabels can only be set in the config file.
+	brokerAliases map[string]string
+	brokerLabels  map[string]map[string]string
 }
 
 func loadConfig(args []string) (config, error) {
+	cfg, err := parseArgs(args, config{})
+	if err != nil {
+		return config{}, err
+	}
+
+	if cfg.ConfigFile == "" {
+		return cfg, nil
+	}
+
+	file, err := readConfigFile(cfg.ConfigFile)
+	if err != nil {
+		return config{}, err
+	}
+
+	// The args are parsed again using the settings from the file as
+	// defaults, which makes flags and env variables take precedence.
+	defaults, zeros := file.defaults()
+	cfg, err = parseArgs(args, defaults)
+	if err != nil {
+		return config{}, err
+	}
+
+	for _, field := range zeros {
+		if !argSet(args, field) {
+			setZero(&cfg, field)
+		}
+	}
+
+	err = file.merge(&cfg)
+	if err != nil {
+		return config{}, err
+	}
+
+	return cfg, nil
+}
+
+// parseArgs parses the args and env variables, non-zero values in defaults
+// replace the default values of the flags.
+func parseArgs(args []string, defaults config) (config, error) {
 	argCfg := arg.Config{
 		Program:   "mqtt-pinger",
 		IgnoreEnv: false,
 	}
 
-	var cfg config
+	cfg := defaults
 	parser, err := arg.NewParser(argCfg, &cfg)
 	if err != nil {
 		return config{}, err
@@ -29,3 +164,76 @@ func loadConfig(args []string) (config, error) {
 
 	return cfg, nil
 }
+
+// argSet returns true if the config field is set by a flag in args or by its
+// env variable.
+func argSet(args []string, field string) bool {
+	f, ok := reflect.TypeOf(config{}).FieldByName(field)
+	if !ok {
+		return false
+	}
+
+	for _, opt := range strings.Split(f.Tag.Get("arg"), ",") {
+		switch {
+		case strings.HasPrefix(opt, "env:"):
+			if _, ok := os.LookupEnv(strings.TrimPrefix(opt, "env:")); ok {
+				return true
+			}
+		case strings.HasPrefix(opt, "-"):
+			for _, a := range args {
+				if a == "--" {
+					break
+				}
+				if a == opt || strings.HasPrefix(a, opt+"=") {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// flagName returns the long flag of the config field without the dashes.
+func flagName(field string) string {
+	f, _ := reflect.TypeOf(config{}).FieldByName(field)
+	for _, opt := range strings.Split(f.Tag.Get("arg"), ",") {
+		if strings.HasPrefix(opt, "--") {
+			return strings.TrimPrefix(opt, "--")
+		}
+	}
+
+	return field
+}
+
+// setZero sets the config field to its zero value.
+func setZero(cfg *config, field string) {
+	v := reflect.ValueOf(cfg).Elem().FieldByName(field)
+	v.Set(reflect.Zero(v.Type()))
+}
+
+// qosLevels returns the configured qos levels without duplicates, defaulting
+// to qos 0.
+func (cfg *config) qosLevels() []byte {
+	if len(cfg.QoS) == 0 {
+		return []byte{0}
+	}
+
+	seen := make(map[byte]bool)
+	var levels []byte
+	for _, qos := range cfg.QoS {
+		if seen[qos] {
+			continue
+		}
+		seen[qos] = true
+		levels = append(levels, qos)
+	}
+
+	return levels
+}
+
+// discoveryEnabled returns true if brokers are discovered in addition to the
+// configured brokers.
+func (cfg *config) discoveryEnabled() bool {
+	return len(cfg.DNSDiscovery) > 0 || len(cfg.FileDiscovery) > 0
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the format of the config file. Both yaml and json are
+// supported, as json is valid yaml.
+type fileConfig struct {
+	Brokers       []fileBroker      `yaml:"brokers"`
+	DNSDiscovery  fileDNSDiscovery  `yaml:"dns_discovery"`
+	FileDiscovery fileFileDiscovery `yaml:"file_discovery"`
+
+	ClientIDPrefix string   `yaml:"client_id_prefix"`
+	MetricsAddress string   `yaml:"metrics_address"`
+	MetricsPort    *int     `yaml:"metrics_port"`
+	PingInterval   *int     `yaml:"ping_interval"`
+	ReadyRatio     *float64 `yaml:"ready_ratio"`
+
+	ExternalLabels map[string]string `yaml:"external_labels"`
+
+	Log             fileLog     `yaml:"log"`
+	Tracing         fileTracing `yaml:"tracing"`
+	Push            filePush    `yaml:"push"`
+	Sinks           fileSinks   `yaml:"sinks"`
+	Alerts          fileAlerts  `yaml:"alerts"`
+	ProtocolVersion string      `yaml:"protocol_version"`
+	QoS             []uint8     `yaml:"qos"`
+
+	TLS fileTLS `yaml:"tls"`
+
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+	TokenFile    string `yaml:"token_file"`
+
+	RetainedProbe fileProbe `yaml:"retained_probe"`
+	WillProbe     fileProbe `yaml:"will_probe"`
+	SessionProbe  fileProbe `yaml:"session_probe"`
+}
+
+type fileBroker struct {
+	Address string `yaml:"address"`
+	// Transport is the scheme used to connect, the address is used as is
+	// when it is not set.
+	Transport string            `yaml:"transport"`
+	Path      string            `yaml:"path"`
+	Alias     string            `yaml:"alias"`
+	Labels    map[string]string `yaml:"labels"`
+
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"password_file"`
+	TokenFile    string `yaml:"token_file"`
+
+	TLS fileTLS `yaml:"tls"`
+}
+
+type fileDNSDiscovery struct {
+	Targets  []string `yaml:"targets"`
+	Interval *int     `yaml:"interval"`
+}
+
+type fileFileDiscovery struct {
+	Files    []string `yaml:"files"`
+	Interval *int     `yaml:"interval"`
+}
+
+type fileLog struct {
+	Level         string `yaml:"level"`
+	Format        string `yaml:"format"`
+	DedupInterval *int   `yaml:"dedup_interval"`
+}
+
+type fileTracing struct {
+	OTLPEndpoint string   `yaml:"otlp_endpoint"`
+	SampleRatio  *float64 `yaml:"sample_ratio"`
+}
+
+type filePush struct {
+	PushgatewayURL string `yaml:"pushgateway_url"`
+	RemoteWriteURL string `yaml:"remote_write_url"`
+	Interval       *int   `yaml:"interval"`
+	Job            string `yaml:"job"`
+	Instance       string `yaml:"instance"`
+	Retries        *int   `yaml:"retries"`
+	BufferSize     *int   `yaml:"buffer_size"`
+}
+
+type fileSinks struct {
+	StatsD   fileStatsD   `yaml:"statsd"`
+	InfluxDB fileInfluxDB `yaml:"influxdb"`
+}
+
+type fileStatsD struct {
+	Address string `yaml:"address"`
+	Prefix  string `yaml:"prefix"`
+}
+
+type fileInfluxDB struct {
+	URL           string `yaml:"url"`
+	Token         string `yaml:"token"`
+	FlushInterval *int   `yaml:"flush_interval"`
+}
+
+type fileAlerts struct {
+	Webhooks      []fileWebhook `yaml:"webhooks"`
+	DownAfter     *int          `yaml:"down_after"`
+	UpAfter       *int          `yaml:"up_after"`
+	DegradedRatio *float64      `yaml:"degraded_ratio"`
+	Cooldown      *int          `yaml:"cooldown"`
+	Retries       *int          `yaml:"retries"`
+}
+
+type fileWebhook struct {
+	URL string `yaml:"url"`
+	// Format is slack, teams or json, json is used when it is not set.
+	Format string `yaml:"format"`
+}
+
+type fileTLS struct {
+	Enabled    bool   `yaml:"enabled"`
+	CAFile     string `yaml:"ca_file"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	ServerName string `yaml:"server_name"`
+	MinVersion string `yaml:"min_version"`
+}
+
+type fileProbe struct {
+	Enabled      bool `yaml:"enabled"`
+	Interval     *int `yaml:"interval"`
+	Timeout      *int `yaml:"timeout"`
+	Messages     *int `yaml:"messages"`
+	SwitchBroker bool `yaml:"switch_broker"`
+}
+
+func readConfigFile(path string) (fileConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fileConfig{}, fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	var file fileConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&file)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fileConfig{}, fmt.Errorf("unable to parse config file %s: %w", path, err)
+	}
+
+	return file, nil
+}
+
+// defaults returns a config with the scalar settings from the file, which is
+// used as the defaults when parsing the flags and env variables. go-arg only
+// uses non-zero defaults, so the config fields the file sets to zero are
+// returned separately to be applied after parsing.
+func (file *fileConfig) defaults() (config, []string) {
+	cfg := config{
+		ClientIDPrefix: file.ClientIDPrefix,
+		MetricsAddress: file.MetricsAddress,
+
+		LogLevel:  file.Log.Level,
+		LogFormat: file.Log.Format,
+
+		OTLPEndpoint:    file.Tracing.OTLPEndpoint,
+		ProtocolVersion: file.ProtocolVersion,
+
+		PushgatewayURL: file.Push.PushgatewayURL,
+		RemoteWriteURL: file.Push.RemoteWriteURL,
+		PushJob:        file.Push.Job,
+		PushInstance:   file.Push.Instance,
+
+		StatsDAddress: file.Sinks.StatsD.Address,
+		StatsDPrefix:  file.Sinks.StatsD.Prefix,
+		InfluxDBURL:   file.Sinks.InfluxDB.URL,
+		InfluxDBToken: file.Sinks.InfluxDB.Token,
+
+		RetainedProbe:            file.RetainedProbe.Enabled,
+		WillProbe:                file.WillProbe.Enabled,
+		SessionProbe:             file.SessionProbe.Enabled,
+		SessionProbeSwitchBroker: file.SessionProbe.SwitchBroker,
+
+		TLSEnabled:    file.TLS.Enabled,
+		TLSCAFile:     file.TLS.CAFile,
+		TLSCertFile:   file.TLS.CertFile,
+		TLSKeyFile:    file.TLS.KeyFile,
+		TLSServerName: file.TLS.ServerName,
+		TLSMinVersion: file.TLS.MinVersion,
+
+		Username:     file.Username,
+		Password:     file.Password,
+		PasswordFile: file.PasswordFile,
+		TokenFile:    file.TokenFile,
+	}
+
+	var zeros []string
+	setNumber(&cfg.MetricsPort, file.MetricsPort, "MetricsPort", &zeros)
+	setNumber(&cfg.PingInterval, file.PingInterval, "PingInterval", &zeros)
+	setNumber(&cfg.ReadyRatio, file.ReadyRatio, "ReadyRatio", &zeros)
+	setNumber(&cfg.LogDedupInterval, file.Log.DedupInterval, "LogDedupInterval", &zeros)
+	setNumber(&cfg.TraceSampleRatio, file.Tracing.SampleRatio, "TraceSampleRatio", &zeros)
+
+	setNumber(&cfg.PushInterval, file.Push.Interval, "PushInterval", &zeros)
+	setNumber(&cfg.PushRetries, file.Push.Retries, "PushRetries", &zeros)
+	setNumber(&cfg.PushBufferSize, file.Push.BufferSize, "PushBufferSize", &zeros)
+	setNumber(&cfg.InfluxDBFlushInterval, file.Sinks.InfluxDB.FlushInterval, "InfluxDBFlushInterval", &zeros)
+
+	setNumber(&cfg.AlertDownAfter, file.Alerts.DownAfter, "AlertDownAfter", &zeros)
+	setNumber(&cfg.AlertUpAfter, file.Alerts.UpAfter, "AlertUpAfter", &zeros)
+	setNumber(&cfg.AlertDegradedRatio, file.Alerts.DegradedRatio, "AlertDegradedRatio", &zeros)
+	setNumber(&cfg.AlertCooldown, file.Alerts.Cooldown, "AlertCooldown", &zeros)
+	setNumber(&cfg.AlertRetries, file.Alerts.Retries, "AlertRetries", &zeros)
+
+	setNumber(&cfg.DNSDiscoveryInterval, file.DNSDiscovery.Interval, "DNSDiscoveryInterval", &zeros)
+	setNumber(&cfg.FileDiscoveryInterval, file.FileDiscovery.Interval, "FileDiscoveryInterval", &zeros)
+
+	setNumber(&cfg.RetainedProbeInterval, file.RetainedProbe.Interval, "RetainedProbeInterval", &zeros)
+	setNumber(&cfg.RetainedProbeTimeout, file.RetainedProbe.Timeout, "RetainedProbeTimeout", &zeros)
+	setNumber(&cfg.WillProbeInterval, file.WillProbe.Interval, "WillProbeInterval", &zeros)
+	setNumber(&cfg.WillProbeTimeout, file.WillProbe.Timeout, "WillProbeTimeout", &zeros)
+	setNumber(&cfg.SessionProbeInterval, file.SessionProbe.Interval, "SessionProbeInterval", &zeros)
+	setNumber(&cfg.SessionProbeTimeout, file.SessionProbe.Timeout, "SessionProbeTimeout", &zeros)
+	setNumber(&cfg.SessionProbeMessages, file.SessionProbe.Messages, "SessionProbeMessages", &zeros)
+
+	return cfg, zeros
+}
+
+// setNumber sets dst to the value from the file if it is set, a zero is added
+// to zeros by the name of the config field instead.
+func setNumber[T int | float64](dst *T, value *T, field string, zeros *[]string) {
+	if value == nil {
+		return
+	}
+
+	if *value == 0 {
+		*zeros = append(*zeros, field)
+		return
+	}
+
+	*dst = *value
+}
+
+// merge adds the brokers, qos levels and per broker settings from the file to
+// the config. Lists set by flags or env variables are kept as is and per
+// broker flags take precedence over the file.
+func (file *fileConfig) merge(cfg *config) error {
+	brokers := make([]string, 0, len(file.Brokers))
+	aliases := make(map[string]string)
+	for _, b := range file.Brokers {
+		broker, err := b.broker()
+		if err != nil {
+			return err
+		}
+
+		if b.TLS.Enabled && !brokerSecure(broker) {
+			return fmt.Errorf("broker %s enables tls, set the transport to tls or wss instead", redact(broker))
+		}
+
+		if b.Alias != "" {
+			if other, ok := aliases[b.Alias]; ok {
+				return fmt.Errorf("alias %q is used by both broker %s and %s", b.Alias, redact(other), redact(broker))
+			}
+			aliases[b.Alias] = broker
+
+			if cfg.brokerAliases == nil {
+				cfg.brokerAliases = make(map[string]string)
+			}
+			cfg.brokerAliases[broker] = b.Alias
+		}
+
+		if len(b.Labels) > 0 {
+			if cfg.brokerLabels == nil {
+				cfg.brokerLabels = make(map[string]map[string]string)
+			}
+			cfg.brokerLabels[broker] = b.Labels
+		}
+
+		brokers = append(brokers, broker)
+		cfg.BrokerUsername = mergeBrokerSetting(cfg.BrokerUsername, broker, b.Username)
+		cfg.BrokerPasswordFile = mergeBrokerSetting(cfg.BrokerPasswordFile, broker, b.PasswordFile)
+		cfg.BrokerTokenFile = mergeBrokerSetting(cfg.BrokerTokenFile, broker, b.TokenFile)
+		cfg.BrokerTLSCAFile = mergeBrokerSetting(cfg.BrokerTLSCAFile, broker, b.TLS.CAFile)
+		cfg.BrokerTLSCertFile = mergeBrokerSetting(cfg.BrokerTLSCertFile, broker, b.TLS.CertFile)
+		cfg.BrokerTLSKeyFile = mergeBrokerSetting(cfg.BrokerTLSKeyFile, broker, b.TLS.KeyFile)
+		cfg.BrokerTLSServerName = mergeBrokerSetting(cfg.BrokerTLSServerName, broker, b.TLS.ServerName)
+		cfg.BrokerTLSMinVersion = mergeBrokerSetting(cfg.BrokerTLSMinVersion, broker, b.TLS.MinVersion)
+	}
+
+	if len(cfg.Brokers) == 0 {
+		cfg.Brokers = brokers
+	}
+
+	if len(cfg.QoS) == 0 {
+		cfg.QoS = file.QoS
+	}
+
+	if len(cfg.DNSDiscovery) == 0 {
+		cfg.DNSDiscovery = file.DNSDiscovery.Targets
+	}
+
+	if len(cfg.FileDiscovery) == 0 {
+		cfg.FileDiscovery = file.FileDiscovery.Files
+	}
+
+	if len(cfg.ExternalLabels) == 0 {
+		cfg.ExternalLabels = file.ExternalLabels
+	}
+
+	if len(cfg.AlertWebhooks) == 0 {
+		for _, w := range file.Alerts.Webhooks {
+			if w.URL == "" {
+				return fmt.Errorf("webhook in config file is missing url")
+			}
+
+			target := w.URL
+			if w.Format != "" {
+				target = fmt.Sprintf("%s+%s", w.Format, w.URL)
+			}
+			cfg.AlertWebhooks = append(cfg.AlertWebhooks, target)
+		}
+	}
+
+	return nil
+}
+
+// broker returns the broker the same way as it would be configured with the
+// brokers flag.
+func (b *fileBroker) broker() (string, error) {
+	if b.Address == "" {
+		return "", fmt.Errorf("broker in config file is missing address")
+	}
+
+	if b.Transport == "" {
+		if b.Path != "" {
+			return "", fmt.Errorf("broker %s has a path but no transport", redact(b.Address))
+		}
+		return b.Address, validateBroker(b.Address)
+	}
+
+	if strings.Contains(b.Address, "://") {
+		return "", fmt.Errorf("broker %s has both a url as address and a transport", redact(b.Address))
+	}
+
+	transport := strings.ToLower(b.Transport)
+	if _, ok := brokerSchemes[transport]; !ok {
+		return "", fmt.Errorf("broker %s has unsupported transport %q", redact(b.Address), b.Transport)
+	}
+
+	if b.Path != "" && transport != "ws" && transport != "wss" {
+		return "", fmt.Errorf("broker %s has a path but only websocket transports use one", redact(b.Address))
+	}
+
+	path := b.Path
+	if path != "" && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	broker := fmt.Sprintf("%s://%s%s", transport, b.Address, path)
+
+	return broker, validateBroker(broker)
+}
+
+func mergeBrokerSetting(settings map[string]string, broker string, value string) map[string]string {
+	if value == "" {
+		return settings
+	}
+
+	if _, ok := settings[broker]; ok {
+		return settings
+	}
+
+	if settings == nil {
+		settings = make(map[string]string)
+	}
+	settings[broker] = value
+
+	return settings
+}
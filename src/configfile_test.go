@@ -0,0 +1,228 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testConfigFile = `
+ping_interval: 5
+protocol_version: "5"
+qos: [0, 1]
+username: pinger
+external_labels:
+  cluster: prod
+tls:
+  min_version: "1.3"
+session_probe:
+  enabled: true
+  messages: 20
+alerts:
+  webhooks:
+    - url: https://hooks.slack.com/services/T0/B0/x
+      format: slack
+    - url: https://alerts.example.com/mqtt
+  down_after: 5
+brokers:
+  - address: broker1:1883
+    alias: node-1
+    labels:
+      zone: a
+  - address: broker2:8883
+    transport: tls
+    alias: node-2
+    username: other
+    tls:
+      server_name: broker2.example.com
+  - address: broker3:443
+    transport: wss
+    path: mqtt
+    token_file: /var/run/token
+`
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	yamlFile := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(yamlFile, []byte(testConfigFile), 0o600))
+
+	jsonFile := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(jsonFile, []byte(`{"ping_interval": 7, "brokers": [{"address": "broker1:1883"}, {"address": "ws://broker2:8080/mqtt"}]}`), 0o600))
+
+	zeroFile := filepath.Join(dir, "zero.yaml")
+	require.NoError(t, os.WriteFile(zeroFile, []byte("log:\n  dedup_interval: 0\npush:\n  retries: 0\nalerts:\n  cooldown: 0\n  retries: 0\n  degraded_ratio: 0\n"), 0o600))
+
+	cases := []struct {
+		testDescription string
+		args            []string
+		verify          func(t *testing.T, cfg config)
+	}{
+		{
+			testDescription: "yaml file",
+			args:            []string{"--config", yamlFile},
+			verify: func(t *testing.T, cfg config) {
+				t.Helper()
+				require.Equal(t, []string{"broker1:1883", "tls://broker2:8883", "wss://broker3:443/mqtt"}, cfg.Brokers)
+				require.Equal(t, 5, cfg.PingInterval)
+				require.Equal(t, "5", cfg.ProtocolVersion)
+				require.Equal(t, []byte{0, 1}, cfg.qosLevels())
+				require.Equal(t, "pinger", cfg.Username)
+				require.Equal(t, "1.3", cfg.TLSMinVersion)
+				require.True(t, cfg.SessionProbe)
+				require.Equal(t, 20, cfg.SessionProbeMessages)
+				require.Equal(t, 60, cfg.SessionProbeInterval)
+				require.Equal(t, "mqtt-pinger", cfg.ClientIDPrefix)
+				require.Equal(t, map[string]string{"tls://broker2:8883": "other"}, cfg.BrokerUsername)
+				require.Equal(t, map[string]string{"tls://broker2:8883": "broker2.example.com"}, cfg.BrokerTLSServerName)
+				require.Equal(t, map[string]string{"wss://broker3:443/mqtt": "/var/run/token"}, cfg.BrokerTokenFile)
+				require.Equal(t, map[string]string{"broker1:1883": "node-1", "tls://broker2:8883": "node-2"}, cfg.brokerAliases)
+				require.Equal(t, map[string]map[string]string{"broker1:1883": {"zone": "a"}}, cfg.brokerLabels)
+				require.Equal(t, map[string]string{"cluster": "prod"}, cfg.ExternalLabels)
+				require.Equal(t, []string{"slack+https://hooks.slack.com/services/T0/B0/x", "https://alerts.example.com/mqtt"}, cfg.AlertWebhooks)
+				require.Equal(t, 5, cfg.AlertDownAfter)
+				require.Equal(t, 3, cfg.AlertUpAfter)
+				require.Equal(t, 0.9, cfg.AlertDegradedRatio)
+			},
+		},
+		{
+			testDescription: "json file",
+			args:            []string{"--config", jsonFile},
+			verify: func(t *testing.T, cfg config) {
+				t.Helper()
+				require.Equal(t, []string{"broker1:1883", "ws://broker2:8080/mqtt"}, cfg.Brokers)
+				require.Equal(t, 7, cfg.PingInterval)
+				require.Equal(t, "3.1.1", cfg.ProtocolVersion)
+			},
+		},
+		{
+			testDescription: "flags take precedence over the file",
+			args:            []string{"--config", yamlFile, "--ping-interval", "1", "--qos", "2", "--brokers", "a:1883", "b:1883", "--broker-username", "tls://broker2:8883=flag"},
+			verify: func(t *testing.T, cfg config) {
+				t.Helper()
+				require.Equal(t, []string{"a:1883", "b:1883"}, cfg.Brokers)
+				require.Equal(t, 1, cfg.PingInterval)
+				require.Equal(t, []byte{2}, cfg.qosLevels())
+				require.Equal(t, "flag", cfg.BrokerUsername["tls://broker2:8883"])
+				require.Equal(t, "5", cfg.ProtocolVersion)
+			},
+		},
+		{
+			testDescription: "explicit zeros in the file",
+			args:            []string{"--config", zeroFile},
+			verify: func(t *testing.T, cfg config) {
+				t.Helper()
+				require.Equal(t, 0, cfg.LogDedupInterval)
+				require.Equal(t, 0, cfg.PushRetries)
+				require.Equal(t, 0, cfg.AlertCooldown)
+				require.Equal(t, 0, cfg.AlertRetries)
+				require.Equal(t, 0.0, cfg.AlertDegradedRatio)
+				require.Equal(t, 15, cfg.PushInterval)
+				require.Equal(t, 3, cfg.AlertUpAfter)
+			},
+		},
+		{
+			testDescription: "flags take precedence over explicit zeros",
+			args:            []string{"--config", zeroFile, "--log-dedup-interval", "30", "--alert-retries=2"},
+			verify: func(t *testing.T, cfg config) {
+				t.Helper()
+				require.Equal(t, 30, cfg.LogDedupInterval)
+				require.Equal(t, 2, cfg.AlertRetries)
+				require.Equal(t, 0, cfg.AlertCooldown)
+			},
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+		cfg, err := loadConfig(c.args)
+		require.NoError(t, err)
+		c.verify(t, cfg)
+	}
+}
+
+func TestLoadConfigFileEnv(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(testConfigFile), 0o600))
+
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("PING_INTERVAL", "3")
+
+	cfg, err := loadConfig([]string{})
+	require.NoError(t, err)
+	require.Equal(t, 3, cfg.PingInterval)
+	require.Len(t, cfg.Brokers, 3)
+
+	zeroFile := filepath.Join(t.TempDir(), "zero.yaml")
+	require.NoError(t, os.WriteFile(zeroFile, []byte("push:\n  retries: 0\n  buffer_size: 0\n"), 0o600))
+
+	t.Setenv("CONFIG_FILE", zeroFile)
+	t.Setenv("PUSH_RETRIES", "5")
+
+	cfg, err = loadConfig([]string{})
+	require.NoError(t, err)
+	require.Equal(t, 5, cfg.PushRetries)
+	require.Equal(t, 0, cfg.PushBufferSize)
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	cases := []struct {
+		testDescription string
+		content         string
+		expectedErr     string
+	}{
+		{
+			testDescription: "unknown field",
+			content:         "ping_intervall: 5",
+			expectedErr:     "unable to parse config file",
+		},
+		{
+			testDescription: "missing address",
+			content:         "brokers: [{transport: tcp}]",
+			expectedErr:     "broker in config file is missing address",
+		},
+		{
+			testDescription: "unsupported transport",
+			content:         "brokers: [{address: broker1:1883, transport: quic}]",
+			expectedErr:     "broker broker1:1883 has unsupported transport \"quic\"",
+		},
+		{
+			testDescription: "url and transport",
+			content:         "brokers: [{address: \"tcp://broker1:1883\", transport: tcp}]",
+			expectedErr:     "broker tcp://broker1:1883 has both a url as address and a transport",
+		},
+		{
+			testDescription: "path without websocket",
+			content:         "brokers: [{address: broker1:1883, transport: tcp, path: /mqtt}]",
+			expectedErr:     "broker broker1:1883 has a path but only websocket transports use one",
+		},
+		{
+			testDescription: "tls enabled on plain transport",
+			content:         "brokers: [{address: broker1:1883, tls: {enabled: true}}]",
+			expectedErr:     "broker broker1:1883 enables tls, set the transport to tls or wss instead",
+		},
+		{
+			testDescription: "duplicate alias",
+			content:         "brokers: [{address: broker1:1883, alias: node}, {address: broker2:1883, alias: node}]",
+			expectedErr:     "alias \"node\" is used by both broker broker1:1883 and broker2:1883",
+		},
+		{
+			testDescription: "webhook without url",
+			content:         "alerts: {webhooks: [{format: slack}]}",
+			expectedErr:     "webhook in config file is missing url",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+		file := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(file, []byte(c.content), 0o600))
+
+		_, err := loadConfig([]string{"--config", file})
+		require.ErrorContains(t, err, c.expectedErr)
+	}
+
+	_, err := loadConfig([]string{"--config", filepath.Join(t.TempDir(), "missing.yaml")})
+	require.ErrorContains(t, err, "unable to read config file")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+const requestTimeout = 10 * time.Second
+
+const (
+	protocolVersion31  = "3.1"
+	protocolVersion311 = "3.1.1"
+	protocolVersion5   = "5"
+)
+
+// messageHandler is called for every message received on a subscription.
+type messageHandler func(payload []byte)
+
+// mqttConnection is a connection to a single broker, independent of the mqtt
+// protocol version being used.
+type mqttConnection interface {
+	// connect makes the first connection attempt and keeps the connection up
+	// until disconnect is called.
+	connect(ctx context.Context) error
+	subscribe(ctx context.Context, topic string, qos byte, handler messageHandler) error
+	unsubscribe(ctx context.Context, topic string) error
+	publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error
+	// drop closes the network connection without sending a disconnect
+	// packet, which makes the broker publish the will message. The
+	// connection is reestablished as after any other connection loss.
+	drop()
+	disconnect()
+}
+
+// willMessage is published by the broker when the connection is lost without
+// a disconnect packet.
+type willMessage struct {
+	topic   string
+	qos     byte
+	retain  bool
+	payload []byte
+}
+
+type connectionOptions struct {
+	brokerURL       string
+	clientID        string
+	protocolVersion string
+	tlsConfig       *tls.Config
+	credentials     *credentialOptions
+	cleanSession    bool
+	connectTimeout  time.Duration
+	will            *willMessage
+	// sessionExpiry is how long the broker keeps a persistent session after
+	// the connection is closed, only used by mqtt 5.
+	sessionExpiry time.Duration
+	// routes are message handlers registered before connecting, receiving
+	// messages for subscriptions kept in a persistent session.
+	routes map[string]messageHandler
+	// onConnect is called every time the connection is established,
+	// including reconnects.
+	onConnect func()
+	// onReasonCode is called for every reason code received from the broker.
+	onReasonCode func(rc reasonCode)
+	// onError is called for errors that happen outside of a request, like
+	// failed reconnects.
+	onError func(err error)
+}
+
+func parseProtocolVersion(version string) (string, error) {
+	switch version {
+	case "", protocolVersion311, "4":
+		return protocolVersion311, nil
+	case protocolVersion31, "3":
+		return protocolVersion31, nil
+	case protocolVersion5, "5.0":
+		return protocolVersion5, nil
+	default:
+		return "", fmt.Errorf("unsupported protocol version %q", version)
+	}
+}
+
+func newConnection(opts connectionOptions) mqttConnection {
+	if opts.onConnect == nil {
+		opts.onConnect = func() {}
+	}
+	if opts.onReasonCode == nil {
+		opts.onReasonCode = func(reasonCode) {}
+	}
+	if opts.onError == nil {
+		opts.onError = func(error) {}
+	}
+
+	if opts.protocolVersion == protocolVersion5 {
+		return newMQTT5Connection(opts)
+	}
+
+	return newMQTT3Connection(opts)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/phayes/freeport"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection(t *testing.T) {
+	broker := startTestBroker(t, &auth.Ledger{
+		Auth: auth.AuthRules{{Allow: true}},
+		ACL:  auth.ACLRules{{Filters: auth.Filters{"denied/#": auth.Deny}}},
+	})
+
+	cases := []struct {
+		protocolVersion     string
+		brokerURL           string
+		expectedReasonCodes []string
+		expectedDeniedCode  string
+	}{
+		{
+			protocolVersion:     protocolVersion311,
+			brokerURL:           fmt.Sprintf("tcp://%s", broker.tcp),
+			expectedReasonCodes: []string{"connack 0x00 (connection accepted)", "suback 0x02 (granted qos 2)"},
+			expectedDeniedCode:  "suback 0x80 (failure)",
+		},
+		{
+			protocolVersion:     protocolVersion311,
+			brokerURL:           fmt.Sprintf("ws://%s/mqtt", broker.ws),
+			expectedReasonCodes: []string{"connack 0x00 (connection accepted)", "suback 0x02 (granted qos 2)"},
+			expectedDeniedCode:  "suback 0x80 (failure)",
+		},
+		{
+			protocolVersion:     protocolVersion5,
+			brokerURL:           fmt.Sprintf("tcp://%s", broker.tcp),
+			expectedReasonCodes: []string{"connack 0x00 (success)", "suback 0x02 (granted qos 2)", "puback 0x00 (success)", "pubcomp 0x00 (success)"},
+			expectedDeniedCode:  "suback 0x87 (not authorized)",
+		},
+		{
+			protocolVersion:     protocolVersion5,
+			brokerURL:           fmt.Sprintf("ws://%s/mqtt", broker.ws),
+			expectedReasonCodes: []string{"connack 0x00 (success)", "suback 0x02 (granted qos 2)", "puback 0x00 (success)", "pubcomp 0x00 (success)"},
+			expectedDeniedCode:  "suback 0x87 (not authorized)",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s %s", i, c.protocolVersion, c.brokerURL)
+
+		var mu sync.Mutex
+		var reasonCodes []string
+		connectedCh := make(chan struct{}, 1)
+		conn := newConnection(connectionOptions{
+			brokerURL:       c.brokerURL,
+			clientID:        fmt.Sprintf("test-%d", i),
+			protocolVersion: c.protocolVersion,
+			cleanSession:    true,
+			connectTimeout:  time.Second,
+			onConnect: func() {
+				connectedCh <- struct{}{}
+			},
+			onReasonCode: func(rc reasonCode) {
+				mu.Lock()
+				reasonCodes = append(reasonCodes, rc.String())
+				mu.Unlock()
+			},
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		require.NoError(t, conn.connect(ctx))
+		<-connectedCh
+
+		msgCh := make(chan string, 3)
+		require.NoError(t, conn.subscribe(ctx, "test/topic", 2, func(payload []byte) {
+			msgCh <- string(payload)
+		}))
+
+		for qos := byte(0); qos <= 2; qos++ {
+			require.NoError(t, conn.publish(ctx, "test/topic", qos, false, []byte(fmt.Sprintf("qos%d", qos))))
+			require.Equal(t, fmt.Sprintf("qos%d", qos), <-msgCh)
+		}
+
+		err := conn.subscribe(ctx, "denied/topic", 0, func(payload []byte) {})
+		require.EqualError(t, err, fmt.Sprintf("subscription not allowed: %s", c.expectedDeniedCode))
+
+		require.NoError(t, conn.unsubscribe(ctx, "test/topic"))
+		conn.disconnect()
+		cancel()
+
+		mu.Lock()
+		require.Equal(t, append(c.expectedReasonCodes, c.expectedDeniedCode), reasonCodes)
+		mu.Unlock()
+	}
+}
+
+func TestParseProtocolVersion(t *testing.T) {
+	cases := []struct {
+		input         string
+		output        string
+		expectedError string
+	}{
+		{input: "", output: protocolVersion311},
+		{input: "3.1.1", output: protocolVersion311},
+		{input: "3.1", output: protocolVersion31},
+		{input: "5", output: protocolVersion5},
+		{input: "6", expectedError: "unsupported protocol version \"6\""},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %q", i, c.input)
+		result, err := parseProtocolVersion(c.input)
+		testError(t, err, c.expectedError)
+		require.Equal(t, c.output, result)
+	}
+}
+
+type testBroker struct {
+	tcp string
+	ws  string
+}
+
+func startTestBroker(t *testing.T, ledger *auth.Ledger) testBroker {
+	t.Helper()
+
+	ports, err := freeport.GetFreePorts(2)
+	require.NoError(t, err)
+	broker := testBroker{
+		tcp: net.JoinHostPort("127.0.0.1", fmt.Sprintf("%d", ports[0])),
+		ws:  net.JoinHostPort("127.0.0.1", fmt.Sprintf("%d", ports[1])),
+	}
+
+	logger := zerolog.Nop()
+	server := mochi.New(&mochi.Options{
+		Logger: &logger,
+	})
+
+	if ledger == nil {
+		require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	} else {
+		require.NoError(t, server.AddHook(new(auth.Hook), &auth.Options{Ledger: ledger}))
+	}
+
+	require.NoError(t, server.AddListener(listeners.NewTCP("tcp", broker.tcp, nil)))
+	require.NoError(t, server.AddListener(listeners.NewWebsocket("ws", broker.ws, nil)))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() {
+		server.Close()
+	})
+
+	// Check that the websocket listener is started
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		conn, err := net.Dial("tcp", broker.ws)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return broker
+}
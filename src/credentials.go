@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+type credentialOptions struct {
+	username     string
+	password     string
+	passwordFile string
+	tokenFile    string
+}
+
+func (opts *credentialOptions) enabled() bool {
+	return opts.username != "" || opts.password != "" || opts.passwordFile != "" || opts.tokenFile != ""
+}
+
+// credentials returns the username and password to use when connecting. The
+// password and token files are read on every call so that rotated secrets are
+// used when reconnecting.
+func (opts *credentialOptions) credentials() (string, string, error) {
+	sources := 0
+	for _, s := range []string{opts.password, opts.passwordFile, opts.tokenFile} {
+		if s != "" {
+			sources++
+		}
+	}
+
+	if sources > 1 {
+		return "", "", fmt.Errorf("only one of password, password file and token file can be configured")
+	}
+
+	password := opts.password
+	secretKey := "password"
+	switch {
+	case opts.passwordFile != "":
+		secretKey = "password file " + opts.passwordFile
+		b, err := os.ReadFile(opts.passwordFile)
+		if err != nil {
+			return "", "", fmt.Errorf("unable to read password file: %w", err)
+		}
+		password = strings.TrimSpace(string(b))
+	case opts.tokenFile != "":
+		secretKey = "token file " + opts.tokenFile
+		b, err := os.ReadFile(opts.tokenFile)
+		if err != nil {
+			return "", "", fmt.Errorf("unable to read token file: %w", err)
+		}
+		password = strings.TrimSpace(string(b))
+	}
+
+	registerSecret(secretKey, password)
+
+	return opts.username, password, nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// dashboardHTML renders the status api as a source and destination matrix,
+// which is refreshed every few seconds.
+//
+//go:embed web/dashboard.html
+var dashboardHTML []byte
+
+func dashboardHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(dashboardHTML)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDashboardHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	dashboardHandler(rec, httptest.NewRequest(http.MethodGet, "/dashboard", nil))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	// The status is fetched relative to the dashboard, so that it works
+	// behind a proxy serving it under a path prefix.
+	require.Contains(t, rec.Body.String(), `fetch("api/v1/status"`)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// discoveredBroker is a broker found by discovery, with the labels from the
+// discovery source.
+type discoveredBroker struct {
+	broker string
+	labels map[string]string
+}
+
+// discoveryUpdate contains the brokers found by a discovery source.
+type discoveryUpdate struct {
+	source  string
+	brokers []discoveredBroker
+}
+
+// discoverer looks up the current brokers of a discovery source.
+type discoverer interface {
+	// name identifies the discovery source in logs and updates.
+	name() string
+	// discover returns the brokers sorted by broker.
+	discover(ctx context.Context) ([]discoveredBroker, error)
+}
+
+// scheduledDiscoverer is a discoverer together with the interval between
+// its lookups.
+type scheduledDiscoverer struct {
+	discoverer
+	interval time.Duration
+}
+
+func newDiscoverers(cfg *config) ([]scheduledDiscoverer, error) {
+	var discoverers []scheduledDiscoverer
+	for _, target := range cfg.DNSDiscovery {
+		d, err := newDNSDiscovery(target, net.DefaultResolver)
+		if err != nil {
+			return nil, err
+		}
+		discoverers = append(discoverers, scheduledDiscoverer{d, time.Duration(cfg.DNSDiscoveryInterval) * time.Second})
+	}
+
+	for _, pattern := range cfg.FileDiscovery {
+		d, err := newFileDiscovery(pattern)
+		if err != nil {
+			return nil, err
+		}
+		discoverers = append(discoverers, scheduledDiscoverer{d, time.Duration(cfg.FileDiscoveryInterval) * time.Second})
+	}
+
+	return discoverers, nil
+}
+
+// runDiscovery looks up the brokers every interval and sends an update when
+// they change. The brokers from the last successful lookup are kept when a
+// lookup fails.
+func runDiscovery(ctx context.Context, d discoverer, interval time.Duration, updateCh chan<- discoveryUpdate) {
+	var current []discoveredBroker
+	first := true
+	for {
+		brokers, err := d.discover(ctx)
+		if err != nil && ctx.Err() == nil {
+			logger.Error().Err(err).Str("discovery", d.name()).Msg("discovery failed")
+		}
+
+		if err == nil && (first || !reflect.DeepEqual(current, brokers)) {
+			first = false
+			current = brokers
+			select {
+			case updateCh <- discoveryUpdate{source: d.name(), brokers: brokers}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// mergeBrokers returns the brokers without duplicates, keeping the static
+// brokers first in their configured order followed by the sorted discovered
+// brokers.
+func mergeBrokers(static []string, discovered map[string][]discoveredBroker) []string {
+	seen := make(map[string]bool)
+	var brokers []string
+	for _, broker := range static {
+		if seen[broker] {
+			continue
+		}
+		seen[broker] = true
+		brokers = append(brokers, broker)
+	}
+
+	var found []string
+	for _, list := range discovered {
+		for _, d := range list {
+			if seen[d.broker] {
+				continue
+			}
+			seen[d.broker] = true
+			found = append(found, d.broker)
+		}
+	}
+	sort.Strings(found)
+
+	return append(brokers, found...)
+}
+
+// mergeBrokerLabels returns the labels of the static brokers together with the
+// labels of the discovered brokers, the static labels take precedence.
+func mergeBrokerLabels(static map[string]map[string]string, discovered map[string][]discoveredBroker) map[string]map[string]string {
+	labels := make(map[string]map[string]string, len(static))
+	for broker, l := range static {
+		labels[broker] = l
+	}
+
+	for _, list := range discovered {
+		for _, d := range list {
+			if _, ok := static[d.broker]; ok || len(d.labels) == 0 {
+				continue
+			}
+			labels[d.broker] = d.labels
+		}
+	}
+
+	return labels
+}
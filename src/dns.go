@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	dnsPrefix    = "dns+"
+	dnsSRVPrefix = "dnssrv+"
+)
+
+// dnsResolver is implemented by net.Resolver.
+type dnsResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service string, proto string, name string) (string, []*net.SRV, error)
+}
+
+// dnsDiscovery finds brokers using A/AAAA records, which are combined with
+// the configured port, or SRV records, which contain both host and port.
+type dnsDiscovery struct {
+	target   string
+	srv      bool
+	scheme   string
+	host     string
+	port     string
+	path     string
+	resolver dnsResolver
+}
+
+// newDNSDiscovery parses a discovery target like dns+broker:1883 or
+// dnssrv+_mqtt._tcp.broker, optionally with a scheme and path like
+// dns+wss://broker:443/mqtt.
+func newDNSDiscovery(target string, resolver dnsResolver) (*dnsDiscovery, error) {
+	d := &dnsDiscovery{
+		target:   target,
+		resolver: resolver,
+	}
+
+	var name string
+	switch {
+	case strings.HasPrefix(target, dnsSRVPrefix):
+		d.srv = true
+		name = strings.TrimPrefix(target, dnsSRVPrefix)
+	case strings.HasPrefix(target, dnsPrefix):
+		name = strings.TrimPrefix(target, dnsPrefix)
+	default:
+		return nil, fmt.Errorf("dns discovery target %q should start with %q or %q", target, dnsPrefix, dnsSRVPrefix)
+	}
+
+	if strings.Contains(name, "://") {
+		u, err := url.Parse(name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse dns discovery target %q", target)
+		}
+		if _, ok := brokerSchemes[strings.ToLower(u.Scheme)]; !ok {
+			return nil, fmt.Errorf("dns discovery target %q has unsupported scheme %q", target, u.Scheme)
+		}
+		if u.User != nil {
+			return nil, fmt.Errorf("dns discovery target %q contains credentials, use the credential flags instead", redact(target))
+		}
+		d.scheme = strings.ToLower(u.Scheme)
+		d.path = u.Path
+		name = u.Host
+	}
+
+	if d.srv {
+		if name == "" || strings.Contains(name, ":") {
+			return nil, fmt.Errorf("dns srv discovery target %q should be a name without port", target)
+		}
+		d.host = name
+		return d, nil
+	}
+
+	host, port, err := net.SplitHostPort(name)
+	if err != nil || host == "" || port == "" {
+		return nil, fmt.Errorf("dns discovery target %q should be host:port", target)
+	}
+	d.host = host
+	d.port = port
+
+	return d, nil
+}
+
+func (d *dnsDiscovery) name() string {
+	return d.target
+}
+
+func (d *dnsDiscovery) discover(ctx context.Context) ([]discoveredBroker, error) {
+	var hostPorts []string
+	if d.srv {
+		_, records, err := d.resolver.LookupSRV(ctx, "", "", d.host)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			hostPorts = append(hostPorts, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+		}
+	} else {
+		addrs, err := d.resolver.LookupIPAddr(ctx, d.host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			hostPorts = append(hostPorts, net.JoinHostPort(addr.String(), d.port))
+		}
+	}
+
+	seen := make(map[string]bool)
+	brokers := make([]discoveredBroker, 0, len(hostPorts))
+	for _, hostPort := range hostPorts {
+		broker := hostPort
+		if d.scheme != "" {
+			broker = fmt.Sprintf("%s://%s%s", d.scheme, hostPort, d.path)
+		}
+		if seen[broker] {
+			continue
+		}
+		seen[broker] = true
+		brokers = append(brokers, discoveredBroker{broker: broker})
+	}
+	sort.Slice(brokers, func(i, j int) bool {
+		return brokers[i].broker < brokers[j].broker
+	})
+
+	return brokers, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileTargetGroup is a group of brokers in the prometheus file_sd format,
+// the labels are added to all brokers in the group.
+type fileTargetGroup struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+// fileDiscovery finds brokers in yaml or json files matching a pattern. The
+// files are read on every lookup, which picks up both changed files and files
+// matching the pattern being added or removed.
+type fileDiscovery struct {
+	pattern string
+}
+
+func newFileDiscovery(pattern string) (*fileDiscovery, error) {
+	_, err := filepath.Match(pattern, "")
+	if err != nil {
+		return nil, fmt.Errorf("file discovery pattern %q is invalid: %w", pattern, err)
+	}
+
+	return &fileDiscovery{pattern: pattern}, nil
+}
+
+func (d *fileDiscovery) name() string {
+	return d.pattern
+}
+
+func (d *fileDiscovery) discover(_ context.Context) ([]discoveredBroker, error) {
+	files, err := filepath.Glob(d.pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	// Brokers in multiple groups get the labels of all groups, the later
+	// groups take precedence.
+	labels := make(map[string]map[string]string)
+	for _, file := range files {
+		groups, err := readTargetGroups(file)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, group := range groups {
+			for _, broker := range group.Targets {
+				if _, ok := labels[broker]; !ok {
+					labels[broker] = make(map[string]string)
+				}
+				for name, value := range group.Labels {
+					labels[broker][name] = value
+				}
+			}
+		}
+	}
+
+	brokers := make([]discoveredBroker, 0, len(labels))
+	for broker, l := range labels {
+		if len(l) == 0 {
+			l = nil
+		}
+		brokers = append(brokers, discoveredBroker{broker: broker, labels: l})
+	}
+	sort.Slice(brokers, func(i, j int) bool {
+		return brokers[i].broker < brokers[j].broker
+	})
+
+	return brokers, nil
+}
+
+func readTargetGroups(file string) ([]fileTargetGroup, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read discovery file: %w", err)
+	}
+
+	var groups []fileTargetGroup
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&groups)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unable to parse discovery file %s: %w", file, err)
+	}
+
+	for _, group := range groups {
+		for _, broker := range group.Targets {
+			err := validateBroker(broker)
+			if err != nil {
+				return nil, fmt.Errorf("discovery file %s: %w", file, err)
+			}
+		}
+
+		for name := range group.Labels {
+			err := validateLabelName(name)
+			if err != nil {
+				return nil, fmt.Errorf("discovery file %s has %w", file, err)
+			}
+		}
+	}
+
+	return groups, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// pingClients contains the running ping clients, which are checked by the
+// health, readiness and status endpoints.
+var pingClients = newPingClientRegistry()
+
+// pingClientRegistry contains the latest ping client of every pair, a
+// restarted client replaces the failed one.
+type pingClientRegistry struct {
+	mu      sync.Mutex
+	clients map[brokerPair]*PingClient
+}
+
+func newPingClientRegistry() *pingClientRegistry {
+	return &pingClientRegistry{
+		clients: make(map[brokerPair]*PingClient),
+	}
+}
+
+func (r *pingClientRegistry) add(client *PingClient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.clients[client.pair] = client
+}
+
+// remove removes the client unless it has already been replaced.
+func (r *pingClientRegistry) remove(client *PingClient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.clients[client.pair] == client {
+		delete(r.clients, client.pair)
+	}
+}
+
+func (r *pingClientRegistry) removePair(p *brokerPair) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.clients, *p)
+}
+
+func (r *pingClientRegistry) list() []*PingClient {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clients := make([]*PingClient, 0, len(r.clients))
+	for _, client := range r.clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		a, b := clients[i].pair, clients[j].pair
+		if a.source != b.source {
+			return a.source < b.source
+		}
+		if a.destination != b.destination {
+			return a.destination < b.destination
+		}
+		return a.qos < b.qos
+	})
+
+	return clients
+}
+
+type pairStatus struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	QoS         byte   `json:"qos"`
+	Reason      string `json:"reason"`
+}
+
+type healthResponse struct {
+	Status  string       `json:"status"`
+	Stalled []pairStatus `json:"stalled,omitempty"`
+}
+
+type readyResponse struct {
+	Status        string       `json:"status"`
+	Ready         int          `json:"ready"`
+	Total         int          `json:"total"`
+	RequiredRatio float64      `json:"required_ratio"`
+	NotReady      []pairStatus `json:"not_ready,omitempty"`
+}
+
+// healthHandler fails when the ping loop of a client has stalled, which
+// doesn't happen when a broker is unavailable as publishing times out.
+func (r *pingClientRegistry) healthHandler(w http.ResponseWriter, _ *http.Request) {
+	res := healthResponse{Status: "ok"}
+	now := time.Now()
+	for _, client := range r.list() {
+		stalledFor, stalled := client.stalled(now)
+		if stalled {
+			res.Stalled = append(res.Stalled, client.status(fmt.Sprintf("ping loop stalled for %s", stalledFor.Round(time.Second))))
+		}
+	}
+
+	code := http.StatusOK
+	if len(res.Stalled) > 0 {
+		res.Status = "stalled"
+		code = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, code, res)
+}
+
+// readyHandler succeeds when at least the ratio of the ping clients are
+// connected and subscribed.
+func (r *pingClientRegistry) readyHandler(ratio float64) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		res := readyResponse{RequiredRatio: ratio}
+		for _, client := range r.list() {
+			res.Total++
+			if client.isReady() {
+				res.Ready++
+				continue
+			}
+			res.NotReady = append(res.NotReady, client.status("not connected and subscribed"))
+		}
+
+		code := http.StatusOK
+		res.Status = "ok"
+		required := int(math.Ceil(ratio * float64(res.Total)))
+		if res.Total == 0 || res.Ready < required {
+			res.Status = "not ready"
+			code = http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, code, res)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
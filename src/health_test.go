@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadyHandler(t *testing.T) {
+	registry := newPingClientRegistry()
+	var clients []*PingClient
+	for _, destination := range []string{"broker2:1883", "broker3:1883", "broker4:1883", "broker1:1883"} {
+		p := brokerPair{source: "broker0:1883", destination: destination, clientID: "ready-" + destination}
+		client := NewPingClient(&p, time.Second, brokerOptions{})
+		registry.add(client)
+		clients = append(clients, client)
+	}
+	close(clients[0].readyCh)
+	close(clients[1].readyCh)
+	close(clients[2].readyCh)
+
+	cases := []struct {
+		testDescription  string
+		ratio            float64
+		expectedCode     int
+		expectedStatus   string
+		expectedNotReady []pairStatus
+	}{
+		{
+			testDescription: "all clients required",
+			ratio:           1,
+			expectedCode:    http.StatusServiceUnavailable,
+			expectedStatus:  "not ready",
+			expectedNotReady: []pairStatus{
+				{Source: "broker0:1883", Destination: "broker1:1883", Reason: "not connected and subscribed"},
+			},
+		},
+		{
+			testDescription: "three quarters required",
+			ratio:           0.75,
+			expectedCode:    http.StatusOK,
+			expectedStatus:  "ok",
+			expectedNotReady: []pairStatus{
+				{Source: "broker0:1883", Destination: "broker1:1883", Reason: "not connected and subscribed"},
+			},
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+		rec := httptest.NewRecorder()
+		registry.readyHandler(c.ratio)(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		require.Equal(t, c.expectedCode, rec.Code)
+		require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+		var res readyResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		require.Equal(t, c.expectedStatus, res.Status)
+		require.Equal(t, 3, res.Ready)
+		require.Equal(t, 4, res.Total)
+		require.Equal(t, c.ratio, res.RequiredRatio)
+		require.Equal(t, c.expectedNotReady, res.NotReady)
+	}
+
+	rec := httptest.NewRecorder()
+	newPingClientRegistry().readyHandler(1)(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestHealthHandler(t *testing.T) {
+	registry := newPingClientRegistry()
+	p := brokerPair{source: "broker1:1883", destination: "broker2:1883", clientID: "health", qos: 1}
+	client := NewPingClient(&p, time.Second, brokerOptions{})
+	registry.add(client)
+
+	check := func(expectedCode int) healthResponse {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		registry.healthHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		require.Equal(t, expectedCode, rec.Code)
+
+		var res healthResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		return res
+	}
+
+	// The ping loop isn't started until the client is connected.
+	require.Equal(t, healthResponse{Status: "ok"}, check(http.StatusOK))
+
+	client.loopedAt.Store(time.Now().UnixNano())
+	require.Equal(t, healthResponse{Status: "ok"}, check(http.StatusOK))
+
+	client.loopedAt.Store(time.Now().Add(-time.Minute).UnixNano())
+	require.Equal(t, healthResponse{
+		Status: "stalled",
+		Stalled: []pairStatus{
+			{Source: "broker1:1883", Destination: "broker2:1883", QoS: 1, Reason: "ping loop stalled for 1m0s"},
+		},
+	}, check(http.StatusServiceUnavailable))
+
+	registry.remove(client)
+	require.Equal(t, healthResponse{Status: "ok"}, check(http.StatusOK))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// influxDBBufferSize is the maximum number of lines kept while influxdb is
+// unavailable, the oldest are dropped first.
+const influxDBBufferSize = 10000
+
+// influxDBSink writes the measurements in the influxdb line protocol, the
+// lines are buffered and written every flush interval.
+type influxDBSink struct {
+	url      string
+	token    string
+	interval time.Duration
+	client   *http.Client
+	log      *dedupLogger
+
+	mu    sync.Mutex
+	lines []string
+}
+
+func newInfluxDBSink(url string, token string, interval time.Duration) (*influxDBSink, error) {
+	err := validateHTTPURL("influxdb", url)
+	if err != nil {
+		return nil, err
+	}
+
+	registerSecret("influxdb token", token)
+
+	return &influxDBSink{
+		url:      url,
+		token:    token,
+		interval: interval,
+		client:   &http.Client{Timeout: requestTimeout},
+		log:      newDedupLogger(logger.With().Str("sink", "influxdb").Logger()),
+	}, nil
+}
+
+func (s *influxDBSink) name() string {
+	return "influxdb"
+}
+
+func (s *influxDBSink) record(m sinkMeasurement) {
+	line := influxDBLine(m)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lines = append(s.lines, line)
+	if dropped := len(s.lines) - influxDBBufferSize; dropped > 0 {
+		s.lines = append([]string(nil), s.lines[dropped:]...)
+	}
+}
+
+// run writes the buffered lines every interval, and once more when the
+// context is cancelled.
+func (s *influxDBSink) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+			defer cancel()
+			s.flush(flushCtx)
+			return
+		case <-ticker.C:
+			s.flush(ctx)
+		}
+	}
+}
+
+// flush writes the buffered lines, keeping them when the write fails so they
+// are written with the next flush.
+func (s *influxDBSink) flush(ctx context.Context) {
+	s.mu.Lock()
+	lines := s.lines
+	s.lines = nil
+	s.mu.Unlock()
+
+	if len(lines) == 0 {
+		return
+	}
+
+	err := s.write(ctx, lines)
+	if err == nil {
+		return
+	}
+
+	var permanent permanentError
+	if errors.As(err, &permanent) {
+		s.log.logError(err, "metrics rejected by influxdb")
+		return
+	}
+	s.log.logError(err, "unable to write metrics to influxdb")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lines = append(lines, s.lines...)
+	if dropped := len(s.lines) - influxDBBufferSize; dropped > 0 {
+		s.lines = append([]string(nil), s.lines[dropped:]...)
+	}
+}
+
+func (s *influxDBSink) write(ctx context.Context, lines []string) error {
+	body := strings.Join(lines, "\n") + "\n"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, strings.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 == 2 {
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	err = fmt.Errorf("influxdb returned status %d: %s", res.StatusCode, bytes.TrimSpace(msg))
+	// Client errors other than rate limiting won't succeed when retried.
+	if res.StatusCode/100 == 4 && res.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+
+	return err
+}
+
+// influxDBLine returns the measurement as a line with the metric name as
+// measurement, the labels as tags and the value as the value field, with a
+// timestamp in nanoseconds.
+func influxDBLine(m sinkMeasurement) string {
+	var b strings.Builder
+	b.WriteString(influxDBEscape(m.name, ", "))
+	for _, tag := range m.tags {
+		if tag.value == "" {
+			continue
+		}
+		b.WriteByte(',')
+		b.WriteString(influxDBEscape(tag.name, ",= "))
+		b.WriteByte('=')
+		b.WriteString(influxDBEscape(tag.value, ",= "))
+	}
+	b.WriteString(" value=")
+	b.WriteString(strconv.FormatFloat(m.value, 'f', -1, 64))
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(m.at.UnixNano(), 10))
+
+	return b.String()
+}
+
+// influxDBEscape escapes the characters with a special meaning in the part of
+// the line. Backslashes are escaped first, so that a trailing backslash can't
+// escape the character following the part.
+func influxDBEscape(s string, special string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	for _, c := range special {
+		s = strings.ReplaceAll(s, string(c), `\`+string(c))
+	}
+
+	return s
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// brokerLabelNames are the labels of the metrics containing a broker, which
+// get the alias of the broker as value and its labels with the label name as
+// prefix.
+var brokerLabelNames = []string{"source", "destination"}
+
+// metricsGatherer gathers all the metrics of the pinger with the broker and
+// external labels added.
+var metricsGatherer prometheus.Gatherer = labelGatherer{gatherer: prometheus.DefaultGatherer}
+
+// currentMetricLabels are the labels added to the metrics, replaced when the
+// brokers or config change.
+var currentMetricLabels atomic.Pointer[metricLabels]
+
+type metricLabels struct {
+	aliases  map[string]string
+	brokers  map[string]map[string]string
+	external map[string]string
+}
+
+// newMetricLabels returns the labels to add to the metrics for the config.
+func newMetricLabels(cfg *config) (*metricLabels, error) {
+	for name := range cfg.ExternalLabels {
+		err := validateLabelName(name)
+		if err != nil {
+			return nil, fmt.Errorf("external labels have %w", err)
+		}
+	}
+
+	for broker, labels := range cfg.brokerLabels {
+		for name := range labels {
+			err := validateLabelName(name)
+			if err != nil {
+				return nil, fmt.Errorf("broker %s has %w", redact(broker), err)
+			}
+		}
+	}
+
+	return &metricLabels{
+		aliases:  cfg.brokerAliases,
+		brokers:  cfg.brokerLabels,
+		external: cfg.ExternalLabels,
+	}, nil
+}
+
+// alias returns the alias of the broker, if any.
+func (l *metricLabels) alias(broker string) string {
+	if l == nil {
+		return ""
+	}
+
+	return l.aliases[broker]
+}
+
+// brokerName returns the broker with its alias, if it has one, for messages
+// read by people.
+func brokerName(broker string, alias string) string {
+	if alias == "" {
+		return broker
+	}
+
+	return fmt.Sprintf("%s (%s)", alias, broker)
+}
+
+// validateLabelName checks that the label of a broker or external label is a
+// valid prometheus label name. The name alias is reserved for the alias of
+// the broker.
+func validateLabelName(name string) error {
+	if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+		return fmt.Errorf("invalid label name %q", name)
+	}
+
+	if name == "alias" {
+		return fmt.Errorf("invalid label name %q, it is reserved for the alias of the broker", name)
+	}
+
+	return nil
+}
+
+// apply adds the labels to the metrics. Labels that are already set on a
+// metric are kept, so the broker labels take precedence over the external
+// labels.
+func (l *metricLabels) apply(families []*dto.MetricFamily) {
+	if l == nil {
+		return
+	}
+
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			l.applyMetric(metric)
+		}
+
+		// The metrics are sorted again by their labels, the same way as the
+		// registry does.
+		sort.Slice(family.Metric, func(i, j int) bool {
+			return labelsLess(family.Metric[i].Label, family.Metric[j].Label)
+		})
+	}
+}
+
+func (l *metricLabels) applyMetric(metric *dto.Metric) {
+	names := make(map[string]bool, len(metric.Label))
+	for _, pair := range metric.Label {
+		names[pair.GetName()] = true
+	}
+
+	add := func(name string, value string) {
+		if value == "" || names[name] {
+			return
+		}
+		names[name] = true
+		metric.Label = append(metric.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+
+	for _, prefix := range brokerLabelNames {
+		pair, ok := labelPair(metric, prefix)
+		if !ok {
+			continue
+		}
+
+		broker := pair.GetValue()
+		for name, value := range l.brokers[broker] {
+			add(prefix+"_"+name, value)
+		}
+
+		// The alias replaces the address, so the series of a broker don't
+		// change with its address.
+		if alias := l.aliases[broker]; alias != "" {
+			pair.Value = proto.String(alias)
+		}
+	}
+
+	for name, value := range l.external {
+		add(name, value)
+	}
+
+	sort.Slice(metric.Label, func(i, j int) bool {
+		return metric.Label[i].GetName() < metric.Label[j].GetName()
+	})
+}
+
+// labelsLess orders metrics with less labels first and then by the label
+// values, as the metrics of a family can have different labels.
+func labelsLess(a []*dto.LabelPair, b []*dto.LabelPair) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+
+	for i := range a {
+		if a[i].GetValue() != b[i].GetValue() {
+			return a[i].GetValue() < b[i].GetValue()
+		}
+	}
+
+	return false
+}
+
+func labelPair(metric *dto.Metric, name string) (*dto.LabelPair, bool) {
+	for _, pair := range metric.Label {
+		if pair.GetName() == name {
+			return pair, true
+		}
+	}
+
+	return nil, false
+}
+
+// labelGatherer adds the current metric labels to the gathered metrics.
+type labelGatherer struct {
+	gatherer prometheus.Gatherer
+}
+
+func (g labelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	// The families are created on every gather, so they can be changed, and
+	// they may be partial when an error is returned.
+	families, err := g.gatherer.Gather()
+	currentMetricLabels.Load().apply(families)
+
+	return families, err
+}
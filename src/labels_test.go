@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabelGatherer(t *testing.T) {
+	current := currentMetricLabels.Load()
+	defer currentMetricLabels.Store(current)
+
+	registry := prometheus.NewRegistry()
+	pings := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "test_total_ping",
+		Help: "Test ping counter",
+	}, pairLabels)
+	registry.MustRegister(pings)
+	pings.WithLabelValues("broker1:1883", "broker2:1883", "0").Inc()
+	pings.WithLabelValues("broker2:1883", "broker3:1883", "0").Inc()
+
+	info := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "test_info",
+		Help:        "Test gauge without brokers",
+		ConstLabels: prometheus.Labels{"cluster": "own"},
+	})
+	registry.MustRegister(info)
+	info.Set(1)
+
+	labels, err := newMetricLabels(&config{
+		ExternalLabels: map[string]string{"cluster": "prod", "region": "eu"},
+		brokerAliases:  map[string]string{"broker1:1883": "node-1", "broker2:1883": "node-2"},
+		brokerLabels:   map[string]map[string]string{"broker1:1883": {"zone": "a"}, "broker3:1883": {"zone": "c"}},
+	})
+	require.NoError(t, err)
+
+	gatherer := labelGatherer{gatherer: registry}
+	expected := `
+# HELP test_info Test gauge without brokers
+# TYPE test_info gauge
+test_info{cluster="own"} 1
+# HELP test_total_ping Test ping counter
+# TYPE test_total_ping counter
+test_total_ping{destination="broker2:1883",qos="0",source="broker1:1883"} 1
+test_total_ping{destination="broker3:1883",qos="0",source="broker2:1883"} 1
+`
+	currentMetricLabels.Store(nil)
+	require.NoError(t, testutil.GatherAndCompare(gatherer, strings.NewReader(expected)))
+
+	expected = `
+# HELP test_info Test gauge without brokers
+# TYPE test_info gauge
+test_info{cluster="own",region="eu"} 1
+# HELP test_total_ping Test ping counter
+# TYPE test_total_ping counter
+test_total_ping{cluster="prod",destination="node-2",qos="0",region="eu",source="node-1",source_zone="a"} 1
+test_total_ping{cluster="prod",destination="broker3:1883",destination_zone="c",qos="0",region="eu",source="node-2"} 1
+`
+	currentMetricLabels.Store(labels)
+	require.NoError(t, testutil.GatherAndCompare(gatherer, strings.NewReader(expected)))
+}
+
+func TestNewMetricLabelsErrors(t *testing.T) {
+	cases := []struct {
+		testDescription string
+		cfg             config
+		expectedErr     string
+	}{
+		{
+			testDescription: "invalid external label",
+			cfg:             config{ExternalLabels: map[string]string{"k8s-cluster": "prod"}},
+			expectedErr:     "external labels have invalid label name \"k8s-cluster\"",
+		},
+		{
+			testDescription: "reserved external label",
+			cfg:             config{ExternalLabels: map[string]string{"__name__": "prod"}},
+			expectedErr:     "external labels have invalid label name \"__name__\"",
+		},
+		{
+			testDescription: "alias as broker label",
+			cfg:             config{brokerLabels: map[string]map[string]string{"broker1:1883": {"alias": "node-1"}}},
+			expectedErr:     "broker broker1:1883 has invalid label name \"alias\", it is reserved for the alias of the broker",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+		_, err := newMetricLabels(&c.cfg)
+		require.EqualError(t, err, c.expectedErr)
+	}
+}
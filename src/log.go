@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	logFormatJSON   = "json"
+	logFormatLogfmt = "logfmt"
+)
+
+var (
+	// logger is replaced by setupLogger once the config is loaded.
+	logger = newLogger(os.Stderr, logFormatLogfmt, zerolog.InfoLevel)
+
+	// logDedupInterval is the interval in which repeated errors of a pair
+	// are only logged once.
+	logDedupInterval = time.Minute
+)
+
+func init() {
+	zerolog.TimeFieldFormat = time.RFC3339Nano
+}
+
+// setupLogger configures the logger from the config.
+func setupLogger(cfg *config) error {
+	level, err := zerolog.ParseLevel(strings.ToLower(cfg.LogLevel))
+	if err != nil || level == zerolog.NoLevel {
+		return fmt.Errorf("received log level %q but only debug, info, warn and error are supported", cfg.LogLevel)
+	}
+
+	format := strings.ToLower(cfg.LogFormat)
+	if format != logFormatJSON && format != logFormatLogfmt {
+		return fmt.Errorf("received log format %q but only json and logfmt are supported", cfg.LogFormat)
+	}
+
+	if cfg.LogDedupInterval < 0 {
+		return fmt.Errorf("received log dedup interval %d but it can't be negative", cfg.LogDedupInterval)
+	}
+
+	logger = newLogger(os.Stderr, format, level)
+	logDedupInterval = time.Duration(cfg.LogDedupInterval) * time.Second
+
+	return nil
+}
+
+func newLogger(w io.Writer, format string, level zerolog.Level) zerolog.Logger {
+	if format == logFormatLogfmt {
+		w = logfmtWriter{w: w}
+	}
+	w = redactWriter{w: w}
+
+	return zerolog.New(w).Level(level).With().Timestamp().Logger()
+}
+
+// redactWriter removes the secrets from the json log events, before they are
+// converted to another format.
+type redactWriter struct {
+	w io.Writer
+}
+
+func (rw redactWriter) Write(p []byte) (int, error) {
+	_, err := io.WriteString(rw.w, redact(string(p)))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// logfmtWriter writes the json log events of zerolog as logfmt, starting
+// with the time, level and message. Events that can't be converted are
+// written as is.
+type logfmtWriter struct {
+	w io.Writer
+}
+
+func (lw logfmtWriter) Write(p []byte) (int, error) {
+	line, err := logfmtLine(p)
+	if err != nil {
+		line = string(p)
+	}
+
+	_, err = io.WriteString(lw.w, line)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func logfmtLine(p []byte) (string, error) {
+	type field struct {
+		key   string
+		value string
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(p))
+	decoder.UseNumber()
+	_, err := decoder.Token()
+	if err != nil {
+		return "", err
+	}
+
+	first := make(map[string]string)
+	var rest []field
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", err
+		}
+		key, _ := token.(string)
+
+		var raw json.RawMessage
+		err = decoder.Decode(&raw)
+		if err != nil {
+			return "", err
+		}
+
+		value := string(raw)
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			value = logfmtValue(s)
+		}
+
+		switch key {
+		case zerolog.TimestampFieldName, zerolog.LevelFieldName, zerolog.MessageFieldName:
+			first[key] = value
+		default:
+			rest = append(rest, field{key, value})
+		}
+	}
+
+	var fields []field
+	for _, key := range []string{zerolog.TimestampFieldName, zerolog.LevelFieldName, zerolog.MessageFieldName} {
+		if value, ok := first[key]; ok {
+			fields = append(fields, field{key, value})
+		}
+	}
+
+	var b strings.Builder
+	for i, f := range append(fields, rest...) {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(f.key)
+		b.WriteByte('=')
+		b.WriteString(f.value)
+	}
+	b.WriteByte('\n')
+
+	return b.String(), nil
+}
+
+// logfmtValue quotes the value when it contains spaces, quotes or equal
+// signs.
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \"=\t\r\n\\") {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
+
+// newPairLogger returns a logger with the fields identifying the pair.
+func newPairLogger(p *brokerPair) *dedupLogger {
+	return newDedupLogger(logger.With().
+		Str("source", p.source).
+		Str("destination", p.destination).
+		Str("client_id", p.clientID).
+		Str("pair", fmt.Sprintf("%s->%s", p.source, p.destination)).
+		Uint8("qos", p.qos).
+		Logger())
+}
+
+// newSourceLogger returns a logger with the fields identifying a source,
+// used by probes covering all the pairs of the source.
+func newSourceLogger(source string, clientID string) *dedupLogger {
+	return newDedupLogger(logger.With().
+		Str("source", source).
+		Str("client_id", clientID).
+		Logger())
+}
+
+// dedupLogger logs errors that are repeated within the dedup interval only
+// once, the number of suppressed errors is added to the next logged error.
+type dedupLogger struct {
+	zerolog.Logger
+	mu       sync.Mutex
+	repeated map[string]*repeatedError
+}
+
+type repeatedError struct {
+	loggedAt   time.Time
+	suppressed int
+}
+
+func newDedupLogger(l zerolog.Logger) *dedupLogger {
+	return &dedupLogger{
+		Logger:   l,
+		repeated: make(map[string]*repeatedError),
+	}
+}
+
+// logError logs the error unless the same message and error were logged
+// within the dedup interval. Errors that stopped repeating are logged with
+// the number of times they were suppressed once they expire.
+func (l *dedupLogger) logError(err error, msg string) {
+	key := msg
+	if err != nil {
+		key = fmt.Sprintf("%s: %v", msg, err)
+	}
+
+	suppressed, ok, expired := l.allow(key, time.Now())
+	for _, e := range expired {
+		l.Error().Str("repeated", e.key).Int("suppressed", e.suppressed).Msg("repeated error stopped")
+	}
+
+	if !ok {
+		return
+	}
+
+	event := l.Error().Err(err)
+	if suppressed > 0 {
+		event = event.Int("suppressed", suppressed)
+	}
+	event.Msg(msg)
+}
+
+// expiredError is a repeated error that wasn't logged within the dedup
+// interval, with the number of times it was suppressed since it was logged.
+type expiredError struct {
+	key        string
+	suppressed int
+}
+
+// allow reports whether the error with the key is logged and how often it
+// was suppressed before. The other errors that weren't logged within the
+// dedup interval are forgotten, so that errors containing changing details
+// don't keep growing the map, and those that were suppressed are returned.
+func (l *dedupLogger) allow(key string, now time.Time) (int, bool, []expiredError) {
+	if logDedupInterval <= 0 {
+		return 0, true, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var expired []expiredError
+	for k, r := range l.repeated {
+		if k == key || now.Sub(r.loggedAt) < logDedupInterval {
+			continue
+		}
+		if r.suppressed > 0 {
+			expired = append(expired, expiredError{key: k, suppressed: r.suppressed})
+		}
+		delete(l.repeated, k)
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].key < expired[j].key
+	})
+
+	r, ok := l.repeated[key]
+	if !ok {
+		l.repeated[key] = &repeatedError{loggedAt: now}
+		return 0, true, expired
+	}
+
+	if now.Sub(r.loggedAt) < logDedupInterval {
+		r.suppressed++
+		return 0, false, expired
+	}
+
+	suppressed := r.suppressed
+	r.loggedAt = now
+	r.suppressed = 0
+
+	return suppressed, true, expired
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -14,21 +15,67 @@ import (
 
 func main() {
 	cfg, err := loadConfig(os.Args[1:])
+	if err == nil {
+		err = setupLogger(&cfg)
+	}
+	var shutdownTracing func(context.Context) error
+	if err == nil {
+		shutdownTracing, err = setupTracing(&cfg)
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "config generation returned an error: %v\n", err)
+		logger.Error().Err(err).Msg("config generation returned an error")
 		os.Exit(1)
 	}
 
 	ctx := context.Background()
-	err = run(ctx, cfg)
+	passed := true
+	if cfg.Check {
+		passed, err = check(ctx, cfg, os.Stdout)
+	} else {
+		err = run(ctx, cfg, func() (config, error) {
+			return loadConfig(os.Args[1:])
+		})
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	tracingErr := shutdownTracing(shutdownCtx)
+	if tracingErr != nil {
+		logger.Error().Err(tracingErr).Msg("unable to flush traces")
+	}
+
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "application returned an error: %v\n", err)
+		logger.Error().Err(err).Msg("application returned an error")
 		os.Exit(1)
 	}
+
+	if !passed {
+		logger.Error().Msg("check failed")
+		os.Exit(2)
+	}
 }
 
-func run(mainCtx context.Context, cfg config) error {
-	pairs, err := generateBrokerPairs(cfg.Brokers, cfg.ClientIDPrefix)
+func run(mainCtx context.Context, cfg config, reload func() (config, error)) error {
+	if cfg.ReadyRatio <= 0 || cfg.ReadyRatio > 1 {
+		return fmt.Errorf("received ready ratio %g but it has to be above 0 and at most 1", cfg.ReadyRatio)
+	}
+
+	discoverers, err := newDiscoverers(&cfg)
+	if err != nil {
+		return err
+	}
+
+	pushers, err := newPushers(&cfg)
+	if err != nil {
+		return err
+	}
+
+	metricSinks, err := newSinks(&cfg)
+	if err != nil {
+		return err
+	}
+
+	err = setupAlerts(&cfg)
 	if err != nil {
 		return err
 	}
@@ -36,32 +83,77 @@ func run(mainCtx context.Context, cfg config) error {
 	ctx, cancel := context.WithCancel(mainCtx)
 	defer cancel()
 
-	metrics := NewMetricsServer(cfg.MetricsAddress, cfg.MetricsPort)
+	var sinksWG sync.WaitGroup
+	sinks.set(metricSinks)
+	for _, sink := range metricSinks {
+		sink := sink
+		sinksWG.Add(1)
+		go func() {
+			defer sinksWG.Done()
+			sink.run(ctx)
+		}()
+	}
+
+	alertsDone := make(chan struct{})
+	go func() {
+		defer close(alertsDone)
+		alerts.run(ctx)
+	}()
+
+	runner := newTaskRunner(ctx)
+	updater := newTaskUpdater(runner, cfg)
+	err = updater.update()
+	if err != nil {
+		return err
+	}
+
+	metrics := NewMetricsServer(cfg.MetricsAddress, cfg.MetricsPort, cfg.ReadyRatio)
 	go func() {
 		err := metrics.Start()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "unable to start metrics server: %v\n", err)
+			logger.Error().Err(err).Msg("unable to start metrics server")
 			cancel()
 		}
 	}()
 
-	g, gCtx := errgroup.WithContext(ctx)
-	for i := range pairs {
-		pinger := NewPingClient(&pairs[i], time.Duration(cfg.PingInterval)*time.Second)
-		g.Go(func() error {
-			return pinger.Run(gCtx)
-		})
+	var pushersWG sync.WaitGroup
+	for _, p := range pushers {
+		p := p
+		pushersWG.Add(1)
+		go func() {
+			defer pushersWG.Done()
+			p.run(ctx)
+		}()
+	}
+
+	discoveryCh := make(chan discoveryUpdate)
+	for _, d := range discoverers {
+		go runDiscovery(ctx, d.discoverer, d.interval, discoveryCh)
 	}
 
 	stopChan := make(chan os.Signal, 2)
 	signal.Notify(stopChan, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGPIPE)
 
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	defer signal.Stop(reloadChan)
+
+	configChangedCh := watchConfigFile(ctx, cfg.ConfigFile, configReloadInterval)
+
 	var doneMsg string
-	select {
-	case sig := <-stopChan:
-		doneMsg = fmt.Sprintf("os.Signal (%s)", sig)
-	case <-gCtx.Done():
-		doneMsg = "context"
+	for doneMsg == "" {
+		select {
+		case sig := <-stopChan:
+			doneMsg = fmt.Sprintf("os.Signal (%s)", sig)
+		case <-runner.Done():
+			doneMsg = "context"
+		case sig := <-reloadChan:
+			updater.reload(reload, fmt.Sprintf("os.Signal (%s)", sig))
+		case <-configChangedCh:
+			updater.reload(reload, "config file change")
+		case update := <-discoveryCh:
+			updater.discover(update)
+		}
 	}
 
 	shutdownCh := make(chan struct{})
@@ -69,7 +161,7 @@ func run(mainCtx context.Context, cfg config) error {
 	go func() {
 		select {
 		case <-stopChan:
-			fmt.Fprint(os.Stderr, "forcefully stopped the application\n")
+			logger.Error().Msg("forcefully stopped the application")
 			os.Exit(1)
 		case <-shutdownCh:
 			return
@@ -77,15 +169,18 @@ func run(mainCtx context.Context, cfg config) error {
 	}()
 
 	cancel()
-	fmt.Printf("server shutdown initiated by: %s\n", doneMsg)
+	logger.Info().Str("reason", doneMsg).Msg("server shutdown initiated")
 
-	var result error
-	err = g.Wait()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "unable to gracefully shutdown mqtt client: %v\n", err)
-		result = multierror.Append(result, err)
+	runner.Wait()
+
+	// The metrics are pushed one last time once the tasks have stopped.
+	pushersWG.Wait()
+	for _, p := range pushers {
+		p.shutdown()
 	}
 
+	var result error
+
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer shutdownCancel()
 	shutdownErrG, shutdownErrGCtx := errgroup.WithContext(shutdownCtx)
@@ -95,9 +190,13 @@ func run(mainCtx context.Context, cfg config) error {
 
 	err = shutdownErrG.Wait()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "unable to gracefully shutdown metrics server: %v\n", err)
+		logger.Error().Err(err).Msg("unable to gracefully shutdown metrics server")
 		result = multierror.Append(result, err)
 	}
 
+	// The sinks send the remaining measurements before stopping.
+	sinksWG.Wait()
+	<-alertsDone
+
 	return result
 }
@@ -6,9 +6,9 @@ import (
 	"fmt"
 	"net"
 	"net/http"
-	"os"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -17,11 +17,19 @@ type MetricsServer struct {
 	httpServer *http.Server
 }
 
-// NewMetricsServer returns a metrics server
-func NewMetricsServer(addr string, port int) *MetricsServer {
+// NewMetricsServer returns a metrics server, which also serves the health,
+// readiness and status of the ping clients and the dashboard
+func NewMetricsServer(addr string, port int, readyRatio float64) *MetricsServer {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", pingClients.healthHandler)
+	mux.HandleFunc("/readyz", pingClients.readyHandler(readyRatio))
+	mux.HandleFunc("/api/v1/status", pingClients.statusHandler)
+	mux.HandleFunc("/dashboard", dashboardHandler)
+	mux.Handle("/", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(metricsGatherer, promhttp.HandlerOpts{})))
+
 	srv := &http.Server{
 		Addr:              net.JoinHostPort(addr, fmt.Sprintf("%d", port)),
-		Handler:           promhttp.Handler(),
+		Handler:           mux,
 		ReadHeaderTimeout: 10 * time.Second,
 	}
 
@@ -31,11 +39,11 @@ func NewMetricsServer(addr string, port int) *MetricsServer {
 }
 
 func (server *MetricsServer) Start() error {
-	fmt.Printf("metrics server starting: %s\n", server.httpServer.Addr)
+	logger.Info().Str("address", server.httpServer.Addr).Msg("metrics server starting")
 
 	err := server.httpServer.ListenAndServe()
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
-		fmt.Fprintf(os.Stderr, "metrics server failed to start or stop gracefully: %v\n", err)
+		logger.Error().Err(err).Msg("metrics server failed to start or stop gracefully")
 		return err
 	}
 	return nil
@@ -44,7 +52,7 @@ func (server *MetricsServer) Start() error {
 func (server *MetricsServer) Stop(ctx context.Context) error {
 	err := server.httpServer.Shutdown(ctx)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "metrics server failed to stop gracefully: %v\n", err)
+		logger.Error().Err(err).Msg("metrics server failed to stop gracefully")
 		return err
 	}
 
@@ -2,73 +2,211 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	pahomqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var pairLabels = []string{"source", "destination", "qos"}
+
 var (
-	metricsTotalReceivedPing = promauto.NewCounterVec(prometheus.CounterOpts{
+	metricsTotalReceivedPing = newCounterVec(prometheus.CounterOpts{
 		Name: "mqtt_total_received_ping",
 		Help: "Total number of successful ping",
-	}, []string{"source", "destination"})
+	}, pairLabels)
 
-	metricsTotalFailedPing = promauto.NewCounterVec(prometheus.CounterOpts{
+	metricsTotalFailedPing = newCounterVec(prometheus.CounterOpts{
 		Name: "mqtt_total_failed_ping",
 		Help: "Total number of failed ping",
-	}, []string{"source", "destination"})
+	}, pairLabels)
+
+	metricsTotalLostPing = newCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_total_lost_ping",
+		Help: "Total number of ping that never arrived",
+	}, pairLabels)
+
+	metricsTotalDuplicatedPing = newCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_total_duplicated_ping",
+		Help: "Total number of ping received more than once",
+	}, pairLabels)
+
+	metricsTotalOutOfOrderPing = newCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_total_out_of_order_ping",
+		Help: "Total number of ping received after a ping with a higher sequence number",
+	}, pairLabels)
+
+	metricsTotalLatePing = newCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_total_late_ping",
+		Help: "Total number of ping received after already being counted as lost",
+	}, pairLabels)
+
+	metricsTotalReasonCodes = newCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_total_reason_codes",
+		Help: "Total number of reason codes received from the broker",
+	}, []string{"source", "destination", "qos", "packet", "reason_code"})
+
+	metricsPingLatency = newHistogramVec(prometheus.HistogramOpts{
+		Name:    "mqtt_ping_latency_seconds",
+		Help:    "Time from publishing a ping until it was received",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, pairLabels)
+
+	metricsPingAckLatency = newHistogramVec(prometheus.HistogramOpts{
+		Name:    "mqtt_ping_ack_latency_seconds",
+		Help:    "Time from publishing a qos 1 or 2 ping until the puback or pubcomp was received",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, pairLabels)
+
+	metricsLastPingLatency = newGaugeVec(prometheus.GaugeOpts{
+		Name: "mqtt_ping_last_latency_seconds",
+		Help: "Latency of the last received ping",
+	}, pairLabels)
 )
 
+type metricVec interface {
+	DeletePartialMatch(labels prometheus.Labels) int
+}
+
+// deletePingMetrics removes the metrics of a pair that is no longer pinged.
+func deletePingMetrics(p *brokerPair) {
+	labels := prometheus.Labels{"source": p.source, "destination": p.destination, "qos": strconv.Itoa(int(p.qos))}
+	for _, vec := range []metricVec{metricsTotalReceivedPing, metricsTotalFailedPing, metricsTotalLostPing, metricsTotalDuplicatedPing, metricsTotalOutOfOrderPing, metricsTotalLatePing, metricsTotalReasonCodes, metricsPingLatency, metricsPingAckLatency, metricsLastPingLatency} {
+		vec.DeletePartialMatch(labels)
+	}
+}
+
+// deleteProbeMetrics removes the probe metrics of a pair that is no longer
+// probed.
+func deleteProbeMetrics(p *brokerPair, vecs ...metricVec) {
+	labels := prometheus.Labels{"source": p.source, "destination": p.destination}
+	for _, vec := range vecs {
+		vec.DeletePartialMatch(labels)
+	}
+}
+
 type PingClient struct {
-	mqttClient   pahomqtt.Client
+	conn         mqttConnection
 	pair         brokerPair
 	pingInterval time.Duration
 	subCh        chan struct{}
+	stoppedCh    chan struct{}
 	interruptCh  chan struct{}
 	interruptErr error
 	interruptMu  sync.Mutex
 	readyCh      chan struct{}
+	loopedAt     atomic.Int64
+	state        *pairState
+	stream       string
+	sequence     uint64
+	tracker      *sequenceTracker
+	log          *dedupLogger
+	// check is set in check mode, the client then stops once the pings of
+	// the check have been received or lost.
+	check *pairCheck
+}
+
+func NewPingClient(p *brokerPair, pingInterval time.Duration, opts brokerOptions) *PingClient {
+	return newPingClient(p, pingInterval, opts, newPingPairState(p), nil)
 }
 
-func NewPingClient(p *brokerPair, pingInterval time.Duration) *PingClient {
+// newPingPairState returns the state of a pair, which notifies the alerts
+// when the health of the pair changes. A restarted ping client keeps the state
+// of the pair, so failed connects can take the pair down.
+func newPingPairState(p *brokerPair) *pairState {
+	pair := *p
+	state := newPairState()
+	state.onHealthChange = func(c healthChange) {
+		alerts.notify(&pair, c)
+	}
+
+	return state
+}
+
+// newCheckPingClient returns a ping client for check mode. It uses a clean
+// session, so the check doesn't leave sessions and queued pings on the
+// brokers.
+func newCheckPingClient(p *brokerPair, pingInterval time.Duration, opts brokerOptions, check *pairCheck) *PingClient {
+	return newPingClient(p, pingInterval, opts, newPingPairState(p), check)
+}
+
+func newPingClient(p *brokerPair, pingInterval time.Duration, opts brokerOptions, state *pairState, check *pairCheck) *PingClient {
 	client := &PingClient{
 		pair:         *p,
 		pingInterval: pingInterval,
 		subCh:        make(chan struct{}),
+		stoppedCh:    make(chan struct{}),
 		interruptCh:  make(chan struct{}),
 		readyCh:      make(chan struct{}),
+		state:        state,
+		stream:       fmt.Sprintf("%s-%d", p.clientID, time.Now().UnixNano()),
+		tracker:      newSequenceTracker(pingInterval, pingInterval*2),
+		log:          newPairLogger(p),
+		check:        check,
 	}
 
-	connOpts := pahomqtt.NewClientOptions().SetClientID(p.clientID).SetCleanSession(false).SetKeepAlive(0).SetConnectTimeout(1 * time.Second).AddBroker(p.source)
-	connOpts.OnConnect = client.onConnectHandler
-
-	mqttClient := pahomqtt.NewClient(connOpts)
-	client.mqttClient = mqttClient
-
-	metricsTotalReceivedPing.WithLabelValues(client.pair.source, client.pair.destination).Add(0)
-	metricsTotalFailedPing.WithLabelValues(client.pair.source, client.pair.destination).Add(0)
+	connOpts := opts.connectionOptions(p.source, p.clientID)
+	connOpts.cleanSession = check != nil
+	connOpts.onConnect = client.onConnectHandler
+	connOpts.onReasonCode = client.observeReasonCode
+	connOpts.onError = client.connectionError
+	client.conn = newConnection(connOpts)
+
+	metricsTotalReceivedPing.WithLabelValues(client.labelValues()...).Add(0)
+	metricsTotalFailedPing.WithLabelValues(client.labelValues()...).Add(0)
+	metricsTotalLostPing.WithLabelValues(client.labelValues()...).Add(0)
+	metricsTotalDuplicatedPing.WithLabelValues(client.labelValues()...).Add(0)
+	metricsTotalOutOfOrderPing.WithLabelValues(client.labelValues()...).Add(0)
+	metricsTotalLatePing.WithLabelValues(client.labelValues()...).Add(0)
+	metricsPingLatency.WithLabelValues(client.labelValues()...)
+	if client.pair.qos > 0 {
+		metricsPingAckLatency.WithLabelValues(client.labelValues()...)
+	}
 
 	return client
 }
 
-func (client *PingClient) Run(ctx context.Context) error {
-	token := client.mqttClient.Connect()
-	defer client.disconnect(5 * time.Second)
+func (client *PingClient) Run(ctx context.Context) (err error) {
+	pingClients.add(client)
+	// A failed client stays registered until it is restarted or the pair is
+	// removed, so the pair is reported as not ready in the meantime. Clients
+	// in check mode are not restarted.
+	defer func() {
+		if err == nil || ctx.Err() != nil || client.check != nil {
+			pingClients.remove(client)
+		}
+	}()
 
-	<-token.Done()
-	if token.Error() != nil {
-		return token.Error()
+	err = client.conn.connect(ctx)
+	defer client.disconnect(5 * time.Second)
+	// The message handler stops handing pings to the loop before the
+	// client is disconnected.
+	defer close(client.stoppedCh)
+
+	if err != nil {
+		client.state.disconnected(err.Error())
+		client.state.failed(1, fmt.Sprintf("connect failed: %v", err))
+		return err
 	}
 
 	client.ready(ctx)
+	if client.check != nil {
+		client.check.ready()
+		client.check.waitForPairs(ctx)
+	}
 
 	client.ping(ctx, client.pingInterval)
 
+	if client.check != nil && client.check.finished(time.Now()) {
+		return nil
+	}
+
 	select {
 	case <-client.interruptCh:
 		return client.interruptErr
@@ -77,30 +215,94 @@ func (client *PingClient) Run(ctx context.Context) error {
 	}
 }
 
-func (client *PingClient) publish() {
-	pubToken := client.mqttClient.Publish(client.pair.publishTopic, byte(0), false, "ping")
+func (client *PingClient) publish(ctx context.Context) {
+	client.sequence++
+	if client.check != nil {
+		client.check.sent(time.Now())
+	}
+
+	payload, err := newPingPayload(client.stream, client.sequence)
+	if err != nil {
+		client.log.logError(err, "unable to generate ping")
+		return
+	}
+
+	// The span lasts until the puback or pubcomp is received for qos 1 and
+	// 2, the receiving side continues the trace from the payload. Both spans
+	// start at the timestamp of the payload.
+	ctx, span := tracer().Start(ctx, "ping publish", trace.WithSpanKind(trace.SpanKindProducer), trace.WithTimestamp(payload.sentAt()), spanAttributes(&client.pair, client.pair.publishTopic, payload.Sequence))
+	defer span.End()
+	payload.injectTrace(ctx)
+
+	b, err := payload.encode()
+	if err != nil {
+		client.log.logError(err, "unable to encode ping")
+		return
+	}
+
+	// The publish is bounded so that the ping loop keeps running while the
+	// broker is unavailable.
+	publishCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	publishedAt := time.Now()
+	err = client.conn.publish(publishCtx, client.pair.publishTopic, client.pair.qos, false, b)
+	if err != nil {
+		client.log.logError(err, "ping failed")
+		client.state.failed(0, fmt.Sprintf("publish failed: %v", err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "publish failed")
+		return
+	}
 
-	<-pubToken.Done()
-	if pubToken.Error() != nil {
-		fmt.Fprintf(os.Stderr, "ERROR: Ping from source %s to destination %s failed: %v\n", client.pair.source, client.pair.destination, pubToken.Error())
+	if client.pair.qos > 0 {
+		span.AddEvent("acknowledged")
+		metricsPingAckLatency.observe(time.Since(publishedAt).Seconds(), client.labelValues()...)
 	}
 }
 
 func (client *PingClient) incrementReceivedPing() {
-	metricsTotalReceivedPing.WithLabelValues(client.pair.source, client.pair.destination).Inc()
+	metricsTotalReceivedPing.inc(client.labelValues()...)
 }
 
 func (client *PingClient) incrementFailedPing() {
-	metricsTotalFailedPing.WithLabelValues(client.pair.source, client.pair.destination).Inc()
+	metricsTotalFailedPing.inc(client.labelValues()...)
+}
+
+func (client *PingClient) observeSequence(result sequenceResult) {
+	switch result {
+	case sequenceInOrder:
+	case sequenceOutOfOrder:
+		metricsTotalOutOfOrderPing.inc(client.labelValues()...)
+	case sequenceDuplicate:
+		metricsTotalDuplicatedPing.inc(client.labelValues()...)
+	case sequenceLate:
+		metricsTotalLatePing.inc(client.labelValues()...)
+	}
+}
+
+func (client *PingClient) expireSequences() {
+	lost := client.tracker.expire(time.Now())
+	metricsTotalLostPing.add(float64(lost), client.labelValues()...)
+	if lost > 0 {
+		client.state.failed(lost, fmt.Sprintf("%d ping(s) lost", lost))
+	}
+}
+
+func (client *PingClient) observeLatency(latency time.Duration) {
+	metricsPingLatency.observe(latency.Seconds(), client.labelValues()...)
+	metricsLastPingLatency.set(latency.Seconds(), client.labelValues()...)
 }
 
 func (client *PingClient) ping(ctx context.Context, pingInterval time.Duration) {
 	tickerInterval := pingInterval * 2
 	ticker := time.NewTicker(tickerInterval)
 
-	fmt.Printf("pinger started (interval: %s): %s -> %s\n", pingInterval.String(), client.pair.source, client.pair.destination)
+	client.log.Info().Str("interval", pingInterval.String()).Msg("pinger started")
 
 	for {
+		client.loopedAt.Store(time.Now().UnixNano())
+
 		select {
 		case <-client.interruptCh:
 			return
@@ -108,23 +310,58 @@ func (client *PingClient) ping(ctx context.Context, pingInterval time.Duration)
 			return
 		case <-ticker.C:
 			client.incrementFailedPing()
+			client.state.failed(1, fmt.Sprintf("no ping received within %s", tickerInterval))
 		case <-client.subCh:
 			client.incrementReceivedPing()
 			ticker.Reset(tickerInterval)
 		default:
-			client.publish()
+			if client.check != nil && client.check.sentAll() {
+				if client.check.finished(time.Now()) {
+					return
+				}
+				time.Sleep(checkPollInterval)
+				continue
+			}
+
+			client.publish(ctx)
+			client.expireSequences()
 			time.Sleep(pingInterval)
 		}
 	}
 }
 
-func (client *PingClient) messageHandler(c pahomqtt.Client, m pahomqtt.Message) {
-	if string(m.Payload()) != "ping" {
-		fmt.Fprintf(os.Stderr, "expected to receive 'ping' as payload but got: %s\n", string(m.Payload()))
+func (client *PingClient) messageHandler(b []byte) {
+	receivedAt := time.Now()
+
+	payload, err := decodePingPayload(b)
+	if err != nil {
+		client.log.Warn().Err(err).Str("payload", string(b)).Msg("expected to receive a ping payload")
+		return
+	}
+
+	result := client.tracker.observe(payload.Stream, payload.Sequence, receivedAt)
+	client.observeSequence(result)
+	if result == sequenceDuplicate {
 		return
 	}
 
-	client.subCh <- struct{}{}
+	_, span := tracer().Start(payload.extractTrace(context.Background()), "ping receive", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithTimestamp(payload.sentAt()), spanAttributes(&client.pair, client.pair.subscriptionTopic, payload.Sequence))
+	span.End(trace.WithTimestamp(receivedAt))
+
+	latency := payload.latency(receivedAt)
+	client.log.Debug().Uint64("sequence", payload.Sequence).Str("latency", latency.String()).Msg("ping received")
+	client.observeLatency(latency)
+	client.state.succeeded(latency)
+	if client.check != nil {
+		client.check.received(payload.Stream, latency)
+	}
+
+	// The ping loop may already have stopped, which must not block the
+	// handling of the other messages.
+	select {
+	case client.subCh <- struct{}{}:
+	case <-client.stoppedCh:
+	}
 }
 
 func (client *PingClient) ready(ctx context.Context) {
@@ -135,13 +372,46 @@ func (client *PingClient) ready(ctx context.Context) {
 	}
 }
 
+func (client *PingClient) isReady() bool {
+	select {
+	case <-client.readyCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// stalled returns true if the ping loop has been started but hasn't run for
+// longer than a ping interval and a publish timeout would explain.
+func (client *PingClient) stalled(now time.Time) (time.Duration, bool) {
+	loopedAt := client.loopedAt.Load()
+	if loopedAt == 0 {
+		return 0, false
+	}
+
+	since := now.Sub(time.Unix(0, loopedAt))
+
+	return since, since > 2*client.pingInterval+requestTimeout
+}
+
+func (client *PingClient) status(reason string) pairStatus {
+	return pairStatus{
+		Source:      client.pair.source,
+		Destination: client.pair.destination,
+		QoS:         client.pair.qos,
+		Reason:      reason,
+	}
+}
+
 func (client *PingClient) disconnect(timeout time.Duration) {
 	disconnectTimeout := time.NewTimer(timeout)
 	disconnectCh := make(chan struct{})
 
 	go func() {
-		_ = client.mqttClient.Unsubscribe(client.pair.subscriptionTopic)
-		client.mqttClient.Disconnect(250)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_ = client.conn.unsubscribe(ctx, client.pair.subscriptionTopic)
+		client.conn.disconnect()
 		close(disconnectCh)
 	}()
 
@@ -165,20 +435,18 @@ func (client *PingClient) interrupt(err error) {
 	client.interruptMu.Unlock()
 }
 
-func (client *PingClient) onConnectHandler(c pahomqtt.Client) {
-	subToken := c.Subscribe(client.pair.subscriptionTopic, byte(0), client.messageHandler)
+func (client *PingClient) onConnectHandler() {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
 
-	<-subToken.Done()
-	if subToken.Error() != nil {
-		client.interrupt(subToken.Error())
+	err := client.conn.subscribe(ctx, client.pair.subscriptionTopic, client.pair.qos, client.messageHandler)
+	if err != nil {
+		client.state.failed(1, fmt.Sprintf("subscribe failed: %v", err))
+		client.interrupt(err)
 		return
 	}
 
-	allowed := subscriptionAllowed(subToken, client.pair.subscriptionTopic)
-	if !allowed {
-		client.interrupt(fmt.Errorf("subscription not allowed"))
-		return
-	}
+	client.state.connected()
 
 	select {
 	case <-client.readyCh:
@@ -187,21 +455,21 @@ func (client *PingClient) onConnectHandler(c pahomqtt.Client) {
 	}
 }
 
-func subscriptionAllowed(token pahomqtt.Token, topic string) bool {
-	subscriptionToken, ok := token.(*pahomqtt.SubscribeToken)
-	if !ok {
-		return false
-	}
+func (client *PingClient) labelValues(extra ...string) []string {
+	values := []string{client.pair.source, client.pair.destination, strconv.Itoa(int(client.pair.qos))}
+	return append(values, extra...)
+}
 
-	result := subscriptionToken.Result()
-	res, found := result[topic]
-	if !found {
-		return false
-	}
+func (client *PingClient) observeReasonCode(rc reasonCode) {
+	metricsTotalReasonCodes.inc(client.labelValues(rc.packet, rc.label())...)
 
-	if res >= 128 {
-		return false
+	if rc.failed {
+		client.log.logError(errors.New(rc.String()), "received failed reason code")
+		client.state.failed(0, fmt.Sprintf("received %s", rc))
 	}
+}
 
-	return true
+func (client *PingClient) connectionError(err error) {
+	client.log.logError(err, "connection error")
+	client.state.disconnected(err.Error())
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+
+	pahomqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// mqtt3Connection is a connection using mqtt 3.1 or 3.1.1.
+type mqtt3Connection struct {
+	client pahomqtt.Client
+	opts   connectionOptions
+
+	mu      sync.Mutex
+	netConn net.Conn
+}
+
+func newMQTT3Connection(opts connectionOptions) *mqtt3Connection {
+	conn := &mqtt3Connection{
+		opts: opts,
+	}
+
+	var version uint = 4
+	if opts.protocolVersion == protocolVersion31 {
+		version = 3
+	}
+
+	connOpts := pahomqtt.NewClientOptions().SetClientID(opts.clientID).SetCleanSession(opts.cleanSession).SetKeepAlive(0).SetConnectTimeout(opts.connectTimeout).AddBroker(opts.brokerURL)
+	connOpts.SetProtocolVersion(version)
+	if opts.tlsConfig != nil {
+		connOpts.SetTLSConfig(opts.tlsConfig)
+	}
+	if opts.credentials != nil {
+		connOpts.SetCredentialsProvider(conn.credentialsProvider)
+	}
+	if opts.will != nil {
+		connOpts.SetBinaryWill(opts.will.topic, opts.will.payload, opts.will.qos, opts.will.retain)
+	}
+	connOpts.SetCustomOpenConnectionFn(conn.openConnection)
+	connOpts.OnConnect = func(_ pahomqtt.Client) {
+		opts.onConnect()
+	}
+	connOpts.OnConnectionLost = func(_ pahomqtt.Client, err error) {
+		opts.onError(fmt.Errorf("connection lost: %w", err))
+	}
+
+	conn.client = pahomqtt.NewClient(connOpts)
+	for topic, handler := range opts.routes {
+		handler := handler
+		conn.client.AddRoute(topic, func(_ pahomqtt.Client, m pahomqtt.Message) {
+			handler(m.Payload())
+		})
+	}
+
+	return conn
+}
+
+func (conn *mqtt3Connection) credentialsProvider() (string, string) {
+	username, password, err := conn.opts.credentials.credentials()
+	if err != nil {
+		conn.opts.onError(err)
+	}
+
+	return username, password
+}
+
+// openConnection dials the broker the same way as the mqtt 5 connection and
+// keeps the network connection to be able to drop it.
+func (conn *mqtt3Connection) openConnection(uri *url.URL, options pahomqtt.ClientOptions) (net.Conn, error) {
+	ctx := context.Background()
+	if options.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.ConnectTimeout)
+		defer cancel()
+	}
+
+	netConn, err := dialBroker(ctx, uri.String(), options.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.mu.Lock()
+	conn.netConn = netConn
+	conn.mu.Unlock()
+
+	return netConn, nil
+}
+
+func (conn *mqtt3Connection) connect(_ context.Context) error {
+	token := conn.client.Connect()
+	<-token.Done()
+
+	connectToken, ok := token.(*pahomqtt.ConnectToken)
+	if ok && connectToken.ReturnCode() != packets.ErrNetworkError {
+		conn.opts.onReasonCode(newMQTT3ReasonCode(packetConnack, connectToken.ReturnCode()))
+	}
+
+	return token.Error()
+}
+
+func (conn *mqtt3Connection) subscribe(ctx context.Context, topic string, qos byte, handler messageHandler) error {
+	token := conn.client.Subscribe(topic, qos, func(_ pahomqtt.Client, m pahomqtt.Message) {
+		handler(m.Payload())
+	})
+
+	err := waitToken(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	subscribeToken, ok := token.(*pahomqtt.SubscribeToken)
+	if !ok {
+		return fmt.Errorf("subscription not allowed: unexpected token type")
+	}
+
+	code, found := subscribeToken.Result()[topic]
+	if !found {
+		return fmt.Errorf("subscription not allowed: no result for topic %q", topic)
+	}
+
+	rc := newMQTT3ReasonCode(packetSuback, code)
+	conn.opts.onReasonCode(rc)
+	if rc.failed {
+		return fmt.Errorf("subscription not allowed: %s", rc)
+	}
+
+	return nil
+}
+
+func (conn *mqtt3Connection) unsubscribe(ctx context.Context, topic string) error {
+	token := conn.client.Unsubscribe(topic)
+
+	return waitToken(ctx, token)
+}
+
+func (conn *mqtt3Connection) publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	token := conn.client.Publish(topic, qos, retain, payload)
+
+	return waitToken(ctx, token)
+}
+
+func (conn *mqtt3Connection) drop() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.netConn != nil {
+		_ = conn.netConn.Close()
+	}
+}
+
+func (conn *mqtt3Connection) disconnect() {
+	conn.client.Disconnect(250)
+}
+
+func waitToken(ctx context.Context, token pahomqtt.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
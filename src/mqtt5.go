@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+const (
+	mqtt5KeepAlive         = 30
+	mqtt5MinReconnectDelay = 1 * time.Second
+	mqtt5MaxReconnectDelay = 1 * time.Minute
+)
+
+var errConnectionDown = errors.New("connection to the broker is down")
+
+// mqtt5Connection is a connection using mqtt 5. Unlike the 3.1.1 client the
+// paho mqtt 5 client doesn't reconnect by itself, so the connection is
+// maintained here until disconnect is called.
+type mqtt5Connection struct {
+	opts   connectionOptions
+	router *paho.StandardRouter
+
+	mu      sync.Mutex
+	client  *paho.Client
+	netConn net.Conn
+
+	loopCtx    context.Context
+	loopCancel context.CancelFunc
+}
+
+func newMQTT5Connection(opts connectionOptions) *mqtt5Connection {
+	loopCtx, loopCancel := context.WithCancel(context.Background())
+
+	router := paho.NewStandardRouter()
+	for topic, handler := range opts.routes {
+		handler := handler
+		router.RegisterHandler(topic, func(p *paho.Publish) {
+			handler(p.Payload)
+		})
+	}
+
+	return &mqtt5Connection{
+		opts:       opts,
+		router:     router,
+		loopCtx:    loopCtx,
+		loopCancel: loopCancel,
+	}
+}
+
+func (conn *mqtt5Connection) connect(ctx context.Context) error {
+	client, errCh, err := conn.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	conn.setClient(client)
+	go conn.opts.onConnect()
+	go conn.maintain(errCh)
+
+	return nil
+}
+
+func (conn *mqtt5Connection) maintain(errCh <-chan error) {
+	for {
+		select {
+		case <-conn.loopCtx.Done():
+			return
+		case err := <-errCh:
+			conn.setClient(nil)
+			conn.opts.onError(fmt.Errorf("connection lost: %w", err))
+
+			var client *paho.Client
+			client, errCh = conn.reconnect()
+			if client == nil {
+				return
+			}
+
+			conn.setClient(client)
+			go conn.opts.onConnect()
+		}
+	}
+}
+
+func (conn *mqtt5Connection) reconnect() (*paho.Client, <-chan error) {
+	delay := mqtt5MinReconnectDelay
+	for {
+		select {
+		case <-conn.loopCtx.Done():
+			return nil, nil
+		case <-time.After(delay):
+		}
+
+		client, errCh, err := conn.dial(conn.loopCtx)
+		if err == nil {
+			return client, errCh
+		}
+
+		conn.opts.onError(fmt.Errorf("reconnect failed: %w", err))
+
+		delay *= 2
+		if delay > mqtt5MaxReconnectDelay {
+			delay = mqtt5MaxReconnectDelay
+		}
+	}
+}
+
+func (conn *mqtt5Connection) dial(ctx context.Context) (*paho.Client, <-chan error, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, conn.opts.connectTimeout)
+	defer cancel()
+
+	netConn, err := dialBroker(dialCtx, conn.opts.brokerURL, conn.opts.tlsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	errCh := make(chan error, 1)
+	onError := func(err error) {
+		select {
+		case errCh <- err:
+		default:
+		}
+	}
+
+	client := paho.NewClient(paho.ClientConfig{
+		ClientID:      conn.opts.clientID,
+		Conn:          packets.NewThreadSafeConn(netConn),
+		Router:        conn.router,
+		PingHandler:   newMQTT5Pinger(netConn),
+		OnClientError: onError,
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			onError(fmt.Errorf("server initiated disconnect: %s", newMQTT5ReasonCode("disconnect", d.ReasonCode)))
+		},
+	})
+
+	cp := &paho.Connect{
+		ClientID:   conn.opts.clientID,
+		KeepAlive:  mqtt5KeepAlive,
+		CleanStart: conn.opts.cleanSession,
+	}
+
+	if conn.opts.sessionExpiry > 0 {
+		sessionExpiry := uint32(conn.opts.sessionExpiry.Seconds())
+		cp.Properties = &paho.ConnectProperties{
+			SessionExpiryInterval: &sessionExpiry,
+		}
+	}
+
+	if conn.opts.will != nil {
+		cp.WillMessage = &paho.WillMessage{
+			Retain:  conn.opts.will.retain,
+			QoS:     conn.opts.will.qos,
+			Topic:   conn.opts.will.topic,
+			Payload: conn.opts.will.payload,
+		}
+	}
+
+	if conn.opts.credentials != nil {
+		username, password, err := conn.opts.credentials.credentials()
+		if err != nil {
+			_ = netConn.Close()
+			return nil, nil, err
+		}
+		cp.Username = username
+		cp.UsernameFlag = username != ""
+		cp.Password = []byte(password)
+		cp.PasswordFlag = password != ""
+	}
+
+	ca, err := client.Connect(dialCtx, cp)
+	if ca != nil {
+		conn.opts.onReasonCode(newMQTT5ReasonCode(packetConnack, ca.ReasonCode))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn.mu.Lock()
+	conn.netConn = netConn
+	conn.mu.Unlock()
+
+	return client, errCh, nil
+}
+
+func (conn *mqtt5Connection) setClient(client *paho.Client) {
+	conn.mu.Lock()
+	conn.client = client
+	conn.mu.Unlock()
+}
+
+func (conn *mqtt5Connection) getClient() (*paho.Client, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.client == nil {
+		return nil, errConnectionDown
+	}
+
+	return conn.client, nil
+}
+
+func (conn *mqtt5Connection) subscribe(ctx context.Context, topic string, qos byte, handler messageHandler) error {
+	client, err := conn.getClient()
+	if err != nil {
+		return err
+	}
+
+	// The router is shared between reconnects, so any previous handler is
+	// removed to not receive every message twice.
+	conn.router.UnregisterHandler(topic)
+	conn.router.RegisterHandler(topic, func(p *paho.Publish) {
+		handler(p.Payload)
+	})
+
+	sa, err := client.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{
+			topic: {QoS: qos},
+		},
+	})
+	if sa != nil {
+		for _, code := range sa.Reasons {
+			rc := newMQTT5ReasonCode(packetSuback, code)
+			conn.opts.onReasonCode(rc)
+			if rc.failed {
+				return fmt.Errorf("subscription not allowed: %s", rc)
+			}
+		}
+	}
+
+	return err
+}
+
+func (conn *mqtt5Connection) unsubscribe(ctx context.Context, topic string) error {
+	conn.router.UnregisterHandler(topic)
+
+	client, err := conn.getClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Unsubscribe(ctx, &paho.Unsubscribe{
+		Topics: []string{topic},
+	})
+
+	return err
+}
+
+func (conn *mqtt5Connection) publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	client, err := conn.getClient()
+	if err != nil {
+		return err
+	}
+
+	pr, err := client.Publish(ctx, &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retain,
+		Payload: payload,
+	})
+	if pr != nil {
+		packet := packetPuback
+		if qos == 2 {
+			// A failed qos 2 publish is answered with the reason code in
+			// the pubrec instead of the pubcomp.
+			packet = packetPubcomp
+			if pr.ReasonCode >= 0x80 {
+				packet = packetPubrec
+			}
+		}
+
+		rc := newMQTT5ReasonCode(packet, pr.ReasonCode)
+		conn.opts.onReasonCode(rc)
+		if rc.failed {
+			return fmt.Errorf("publish failed: %s", rc)
+		}
+	}
+
+	return err
+}
+
+func (conn *mqtt5Connection) drop() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.netConn != nil {
+		_ = conn.netConn.Close()
+	}
+}
+
+func (conn *mqtt5Connection) disconnect() {
+	conn.loopCancel()
+
+	client, err := conn.getClient()
+	if err != nil {
+		return
+	}
+
+	conn.setClient(nil)
+	_ = client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+}
+
+// mqtt5Pinger sends ping requests like the default paho pinger, which can't
+// be stopped before it has started and then keeps the client from closing
+// until its next check.
+type mqtt5Pinger struct {
+	netConn         net.Conn
+	stop            chan struct{}
+	stopOnce        sync.Once
+	pingOutstanding int32
+}
+
+func newMQTT5Pinger(netConn net.Conn) *mqtt5Pinger {
+	return &mqtt5Pinger{
+		netConn: netConn,
+		stop:    make(chan struct{}),
+	}
+}
+
+func (p *mqtt5Pinger) Start(c net.Conn, keepAlive time.Duration) {
+	ticker := time.NewTicker(keepAlive / 4)
+	defer ticker.Stop()
+
+	lastPing := time.Now()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if atomic.LoadInt32(&p.pingOutstanding) > 0 && time.Since(lastPing) > keepAlive+keepAlive/2 {
+				// Closing the connection makes the client report the
+				// error and reconnect.
+				_ = p.netConn.Close()
+				return
+			}
+
+			if time.Since(lastPing) >= keepAlive {
+				_, err := packets.NewControlPacket(packets.PINGREQ).WriteTo(c)
+				if err != nil {
+					_ = p.netConn.Close()
+					return
+				}
+				atomic.AddInt32(&p.pingOutstanding, 1)
+				lastPing = time.Now()
+			}
+		}
+	}
+}
+
+func (p *mqtt5Pinger) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+func (p *mqtt5Pinger) PingResp() {
+	atomic.StoreInt32(&p.pingOutstanding, 0)
+}
+
+func (p *mqtt5Pinger) SetDebug(paho.Logger) {}
+
+// dialBroker opens a network connection to the broker based on the scheme of
+// the broker url.
+func dialBroker(ctx context.Context, brokerURL string, tlsCfg *tls.Config) (net.Conn, error) {
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse broker url: %w", err)
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "tcp", "mqtt":
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", u.Host)
+	case "ssl", "tls", "mqtts", "tcps":
+		if tlsCfg == nil {
+			tlsCfg = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		dialer := tls.Dialer{Config: tlsCfg}
+		return dialer.DialContext(ctx, "tcp", u.Host)
+	case "ws":
+		return dialWebsocket(ctx, u, nil)
+	case "wss":
+		return dialWebsocket(ctx, u, tlsCfg)
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q in broker url", u.Scheme)
+	}
+}
@@ -11,6 +11,8 @@ import (
 
 	hmqBroker "github.com/fhmq/hmq/broker"
 	"github.com/phayes/freeport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 	"github.com/stretchr/testify/require"
@@ -24,7 +26,7 @@ func TestStart(t *testing.T) {
 	port, err := freeport.GetFreePort()
 	require.NoError(t, err)
 
-	metrics := NewMetricsServer("127.0.0.1", port)
+	metrics := NewMetricsServer("127.0.0.1", port, 1)
 	go func() {
 		err := metrics.Start()
 		if err != nil {
@@ -64,7 +66,7 @@ func TestStart(t *testing.T) {
 	}
 
 	g, gCtx := errgroup.WithContext(ctx)
-	pinger := NewPingClient(&p, time.Duration(10*time.Millisecond))
+	pinger := NewPingClient(&p, time.Duration(10*time.Millisecond), brokerOptions{})
 	g.Go(func() error {
 		return pinger.Run(gCtx)
 	})
@@ -76,8 +78,8 @@ func TestStart(t *testing.T) {
 	err = g.Wait()
 	require.NoError(t, err)
 
-	successMetrics := getMetrics(t, port, "mqtt_total_received_ping")
-	failedMetrics := getMetrics(t, port, "mqtt_total_failed_ping")
+	successMetrics := filterMetrics(getMetrics(t, port, "mqtt_total_received_ping"), "source", mockBroker)
+	failedMetrics := filterMetrics(getMetrics(t, port, "mqtt_total_failed_ping"), "source", mockBroker)
 
 	require.Len(t, successMetrics, 1)
 	require.Len(t, failedMetrics, 1)
@@ -88,6 +90,10 @@ func TestStart(t *testing.T) {
 	require.GreaterOrEqual(t, successMetrics[0].GetCounter().GetValue(), float64(5))
 	require.LessOrEqual(t, failedMetrics[0].GetCounter().GetValue(), float64(1))
 
+	latencyMetrics := filterMetrics(getMetrics(t, port, "mqtt_ping_latency_seconds"), "source", mockBroker)
+	require.Len(t, latencyMetrics, 1)
+	require.GreaterOrEqual(t, latencyMetrics[0].GetHistogram().GetSampleCount(), uint64(successMetrics[0].GetCounter().GetValue()))
+
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer shutdownCancel()
 	shutdownErrG, shutdownErrGCtx := errgroup.WithContext(shutdownCtx)
@@ -99,6 +105,114 @@ func TestStart(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestPingClientConnectFailed(t *testing.T) {
+	current := healthThresholds
+	defer func() {
+		healthThresholds = current
+	}()
+	healthThresholds = healthThresholdSettings{downAfter: 2, upAfter: 2, degradedRatio: 0.8}
+
+	p := brokerPair{source: "127.0.0.1:1", destination: "broker2:1883", clientID: "connect-failed"}
+	defer pingClients.removePair(&p)
+
+	// The restarted clients share the state of the pair.
+	state := newPingPairState(&p)
+	for i := 0; i < 2; i++ {
+		client := newPingClient(&p, time.Second, brokerOptions{}, state, nil)
+		require.Error(t, client.Run(context.Background()))
+
+		// The failed client is kept, so the pair is reported as not ready.
+		require.Equal(t, []*PingClient{client}, pingClients.list())
+	}
+
+	status := state.status(p)
+	require.Equal(t, connectionDisconnected, status.Connection)
+	require.Equal(t, uint64(2), status.Failed)
+	require.Equal(t, healthDown, state.health)
+	require.Contains(t, status.FailureReason, "connect failed: ")
+}
+
+func TestMessageHandlerAfterStop(t *testing.T) {
+	p := brokerPair{source: "broker1:1883", destination: "broker2:1883", clientID: "stopped"}
+	client := NewPingClient(&p, time.Second, brokerOptions{})
+	close(client.stoppedCh)
+
+	payload, err := newPingPayload("stream", 1)
+	require.NoError(t, err)
+	b, err := payload.encode()
+	require.NoError(t, err)
+
+	handled := make(chan struct{})
+	go func() {
+		client.messageHandler(b)
+		close(handled)
+	}()
+
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the message handler not to block after the client stopped")
+	}
+}
+
+func TestStartMQTT5(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := startTestBroker(t, nil)
+	p := brokerPair{
+		source:            fmt.Sprintf("ws://%s/mqtt", broker.ws),
+		destination:       "foobar",
+		base64Source:      "foo",
+		base64Destination: "bar",
+		clientID:          "foobar-mqtt5",
+		subscriptionTopic: "baz",
+		publishTopic:      "baz",
+		qos:               1,
+	}
+
+	g, gCtx := errgroup.WithContext(ctx)
+	pinger := NewPingClient(&p, time.Duration(10*time.Millisecond), brokerOptions{protocolVersion: protocolVersion5})
+	g.Go(func() error {
+		return pinger.Run(gCtx)
+	})
+
+	// The pings are awaited instead of sleeping, as connecting can be slow
+	// under load.
+	require.Eventually(t, func() bool {
+		status := pinger.state.status(p)
+		received := testutil.ToFloat64(metricsTotalReceivedPing.WithLabelValues(p.source, p.destination, "1"))
+		return status.Connection == connectionConnected && status.LatencySeconds != nil && received >= 5
+	}, 10*time.Second, 10*time.Millisecond)
+
+	cancel()
+
+	err := g.Wait()
+	require.NoError(t, err)
+
+	received := testutil.ToFloat64(metricsTotalReceivedPing.WithLabelValues(p.source, p.destination, "1"))
+	failed := testutil.ToFloat64(metricsTotalFailedPing.WithLabelValues(p.source, p.destination, "1"))
+	connack := testutil.ToFloat64(metricsTotalReasonCodes.WithLabelValues(p.source, p.destination, "1", packetConnack, "0x00"))
+	suback := testutil.ToFloat64(metricsTotalReasonCodes.WithLabelValues(p.source, p.destination, "1", packetSuback, "0x01"))
+	puback := testutil.ToFloat64(metricsTotalReasonCodes.WithLabelValues(p.source, p.destination, "1", packetPuback, "0x00"))
+
+	require.GreaterOrEqual(t, received, float64(5))
+	// A slow ping can be counted as failed with the short interval, but most
+	// of them have to be received.
+	require.Less(t, failed, received)
+	// A reconnect adds another connack and suback.
+	require.GreaterOrEqual(t, connack, float64(1))
+	require.GreaterOrEqual(t, suback, float64(1))
+	// The publish in progress when the client is stopped can be received
+	// and acknowledged without its puback and ack latency being observed.
+	require.GreaterOrEqual(t, puback, received-1)
+
+	ackLatency := &dto.Metric{}
+	observer := metricsPingAckLatency.WithLabelValues(p.source, p.destination, "1")
+	require.NoError(t, observer.(prometheus.Histogram).Write(ackLatency))
+	require.InDelta(t, puback, float64(ackLatency.GetHistogram().GetSampleCount()), 1)
+}
+
 func getMetrics(t *testing.T, port int, metricName string) []*dto.Metric {
 	t.Helper()
 
@@ -126,3 +240,16 @@ func getMetrics(t *testing.T, port int, metricName string) []*dto.Metric {
 
 	return metrics
 }
+
+func filterMetrics(metrics []*dto.Metric, labelName string, labelValue string) []*dto.Metric {
+	var filtered []*dto.Metric
+	for _, metric := range metrics {
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == labelName && label.GetValue() == labelValue {
+				filtered = append(filtered, metric)
+			}
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+type pingPayload struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"ts"`
+	Stream    string `json:"stream"`
+	Sequence  uint64 `json:"seq"`
+	// Trace contains the trace context of the publish span when tracing is
+	// enabled.
+	Trace map[string]string `json:"trace,omitempty"`
+}
+
+func newPingPayload(stream string, seq uint64) (pingPayload, error) {
+	id, err := generateRandomString(16)
+	if err != nil {
+		return pingPayload{}, err
+	}
+
+	return pingPayload{
+		ID:        id,
+		Timestamp: time.Now().UnixNano(),
+		Stream:    stream,
+		Sequence:  seq,
+	}, nil
+}
+
+func (p *pingPayload) encode() ([]byte, error) {
+	return json.Marshal(p)
+}
+
+func decodePingPayload(b []byte) (pingPayload, error) {
+	var p pingPayload
+	err := json.Unmarshal(b, &p)
+	if err != nil {
+		return pingPayload{}, fmt.Errorf("unable to decode ping payload: %w", err)
+	}
+
+	if p.ID == "" {
+		return pingPayload{}, fmt.Errorf("ping payload is missing id")
+	}
+
+	if p.Timestamp <= 0 {
+		return pingPayload{}, fmt.Errorf("ping payload is missing timestamp")
+	}
+
+	if p.Stream == "" || p.Sequence == 0 {
+		return pingPayload{}, fmt.Errorf("ping payload is missing sequence")
+	}
+
+	return p, nil
+}
+
+func (p *pingPayload) injectTrace(ctx context.Context) {
+	carrier := propagation.MapCarrier{}
+	tracePropagator.Inject(ctx, carrier)
+	if len(carrier) > 0 {
+		p.Trace = carrier
+	}
+}
+
+// extractTrace returns the context with the trace context of the publishing
+// side, if any.
+func (p *pingPayload) extractTrace(ctx context.Context) context.Context {
+	return tracePropagator.Extract(ctx, propagation.MapCarrier(p.Trace))
+}
+
+func (p *pingPayload) sentAt() time.Time {
+	return time.Unix(0, p.Timestamp)
+}
+
+func (p *pingPayload) latency(receivedAt time.Time) time.Duration {
+	latency := receivedAt.Sub(p.sentAt())
+	if latency < 0 {
+		return 0
+	}
+
+	return latency
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPingPayload(t *testing.T) {
+	p, err := newPingPayload("foo", 1)
+	require.NoError(t, err)
+	require.Len(t, p.ID, 16)
+
+	b, err := p.encode()
+	require.NoError(t, err)
+
+	decoded, err := decodePingPayload(b)
+	require.NoError(t, err)
+	require.Equal(t, p, decoded)
+
+	receivedAt := p.sentAt().Add(25 * time.Millisecond)
+	require.Equal(t, 25*time.Millisecond, decoded.latency(receivedAt))
+	require.Equal(t, time.Duration(0), decoded.latency(p.sentAt().Add(-1*time.Second)))
+}
+
+func TestDecodePingPayload(t *testing.T) {
+	cases := []struct {
+		testDescription string
+		input           string
+		expectedError   string
+	}{
+		{
+			testDescription: "legacy payload",
+			input:           "ping",
+			expectedError:   "unable to decode ping payload: invalid character 'p' looking for beginning of value",
+		},
+		{
+			testDescription: "missing id",
+			input:           `{"ts":1,"stream":"foo","seq":1}`,
+			expectedError:   "ping payload is missing id",
+		},
+		{
+			testDescription: "missing timestamp",
+			input:           `{"id":"foo","stream":"foo","seq":1}`,
+			expectedError:   "ping payload is missing timestamp",
+		},
+		{
+			testDescription: "missing sequence",
+			input:           `{"id":"foo","ts":1,"stream":"foo"}`,
+			expectedError:   "ping payload is missing sequence",
+		},
+		{
+			testDescription: "valid payload",
+			input:           `{"id":"foo","ts":1,"stream":"foo","seq":1}`,
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+		_, err := decodePingPayload([]byte(c.input))
+		testError(t, err, c.expectedError)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	metricsTotalPushFailed = newCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_total_push_failed",
+		Help: "Total number of failed pushes of the metrics, including retries",
+	}, []string{"target"})
+
+	metricsTotalPushDropped = newCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_total_push_dropped",
+		Help: "Total number of gathered metrics that were dropped without being pushed",
+	}, []string{"target"})
+)
+
+var (
+	// pushRetryBackoff is the time to wait before the first retry of a
+	// failed push, it is doubled for every retry.
+	pushRetryBackoff = time.Second
+	// pushShutdownTimeout bounds the last push when the pinger is stopped.
+	pushShutdownTimeout = 5 * time.Second
+)
+
+// metricsSnapshot is the metrics gathered at one point in time.
+type metricsSnapshot struct {
+	families   []*dto.MetricFamily
+	gatheredAt time.Time
+}
+
+// pushTarget sends the gathered metrics to an endpoint.
+type pushTarget interface {
+	name() string
+	// buffered reports whether metrics that couldn't be sent are kept and
+	// sent later, otherwise only the latest metrics are sent.
+	buffered() bool
+	push(ctx context.Context, s metricsSnapshot) error
+}
+
+// permanentError is returned by a push that would fail the same way when
+// retried, the metrics are dropped.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// pusher periodically gathers the metrics and pushes them to the target.
+type pusher struct {
+	target     pushTarget
+	gatherer   prometheus.Gatherer
+	interval   time.Duration
+	retries    int
+	bufferSize int
+	buffer     []metricsSnapshot
+	log        *dedupLogger
+}
+
+// newPushers returns the pushers for the configured pushgateway and remote
+// write endpoint.
+func newPushers(cfg *config) ([]*pusher, error) {
+	if cfg.PushgatewayURL == "" && cfg.RemoteWriteURL == "" {
+		return nil, nil
+	}
+
+	if cfg.PushInterval < 1 {
+		return nil, fmt.Errorf("received push interval %d but it has to be at least 1", cfg.PushInterval)
+	}
+
+	if cfg.PushRetries < 0 {
+		return nil, fmt.Errorf("received %d push retries but it can't be negative", cfg.PushRetries)
+	}
+
+	if cfg.PushBufferSize < 1 {
+		return nil, fmt.Errorf("received push buffer size %d but it has to be at least 1", cfg.PushBufferSize)
+	}
+
+	instance := cfg.PushInstance
+	if instance == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get hostname for the push instance: %w", err)
+		}
+		instance = hostname
+	}
+
+	client := &http.Client{Timeout: requestTimeout}
+	var targets []pushTarget
+	if cfg.PushgatewayURL != "" {
+		err := validateHTTPURL("push", cfg.PushgatewayURL)
+		if err != nil {
+			return nil, err
+		}
+
+		// The pushgateway rejects metrics that already contain the
+		// grouping labels.
+		for _, name := range []string{"job", "instance"} {
+			if _, ok := cfg.ExternalLabels[name]; ok {
+				return nil, fmt.Errorf("external label %q can't be used with the pushgateway, use the push job and instance instead", name)
+			}
+		}
+
+		targets = append(targets, &pushgatewayTarget{
+			url:      cfg.PushgatewayURL,
+			job:      cfg.PushJob,
+			instance: instance,
+			client:   client,
+		})
+	}
+
+	if cfg.RemoteWriteURL != "" {
+		err := validateHTTPURL("push", cfg.RemoteWriteURL)
+		if err != nil {
+			return nil, err
+		}
+
+		targets = append(targets, &remoteWriteTarget{
+			url:    cfg.RemoteWriteURL,
+			labels: map[string]string{"job": cfg.PushJob, "instance": instance},
+			client: client,
+		})
+	}
+
+	pushers := make([]*pusher, 0, len(targets))
+	for _, target := range targets {
+		pushers = append(pushers, &pusher{
+			target:     target,
+			gatherer:   metricsGatherer,
+			interval:   time.Duration(cfg.PushInterval) * time.Second,
+			retries:    cfg.PushRetries,
+			bufferSize: cfg.PushBufferSize,
+			log:        newDedupLogger(logger.With().Str("target", target.name()).Logger()),
+		})
+	}
+
+	return pushers, nil
+}
+
+// validateHTTPURL checks that the url of the endpoint is a http or https url.
+func validateHTTPURL(endpoint string, s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s url %q should be a url like http://host:port", endpoint, redact(s))
+	}
+
+	return nil
+}
+
+// run pushes the metrics every interval until the context is cancelled.
+func (p *pusher) run(ctx context.Context) {
+	p.log.Info().Dur("interval", p.interval).Msg("pushing metrics")
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		p.gather(time.Now())
+		p.flush(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// shutdown pushes the metrics one last time after run has returned, so the
+// counts since the last interval aren't lost.
+func (p *pusher) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), pushShutdownTimeout)
+	defer cancel()
+
+	p.gather(time.Now())
+	p.flush(ctx)
+}
+
+// gather adds the current metrics to the buffer, dropping the oldest metrics
+// when the buffer is full.
+func (p *pusher) gather(now time.Time) {
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		p.log.logError(err, "unable to gather metrics")
+		if len(families) == 0 {
+			return
+		}
+	}
+
+	s := metricsSnapshot{families: families, gatheredAt: now}
+	if !p.target.buffered() {
+		p.buffer = []metricsSnapshot{s}
+		return
+	}
+
+	p.buffer = append(p.buffer, s)
+	if dropped := len(p.buffer) - p.bufferSize; dropped > 0 {
+		p.buffer = append([]metricsSnapshot(nil), p.buffer[dropped:]...)
+		metricsTotalPushDropped.add(float64(dropped), p.target.name())
+	}
+}
+
+// flush pushes the buffered metrics oldest first, keeping the rest when a
+// push still fails after the retries.
+func (p *pusher) flush(ctx context.Context) {
+	for len(p.buffer) > 0 {
+		err := p.pushWithRetries(ctx, p.buffer[0])
+		var permanent permanentError
+		switch {
+		case err == nil:
+		case errors.As(err, &permanent):
+			p.log.logError(err, "metrics rejected by push target")
+			metricsTotalPushDropped.inc(p.target.name())
+		default:
+			p.log.logError(err, "unable to push metrics")
+			return
+		}
+
+		p.buffer = p.buffer[1:]
+	}
+}
+
+func (p *pusher) pushWithRetries(ctx context.Context, s metricsSnapshot) error {
+	backoff := pushRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := p.target.push(ctx, s)
+		if err == nil {
+			return nil
+		}
+		metricsTotalPushFailed.inc(p.target.name())
+
+		var permanent permanentError
+		if errors.As(err, &permanent) || attempt >= p.retries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// pushgatewayTarget replaces the metrics of the job and instance on a
+// pushgateway, so only the latest metrics are pushed.
+type pushgatewayTarget struct {
+	url      string
+	job      string
+	instance string
+	client   *http.Client
+}
+
+func (t *pushgatewayTarget) name() string {
+	return "pushgateway"
+}
+
+func (t *pushgatewayTarget) buffered() bool {
+	return false
+}
+
+func (t *pushgatewayTarget) push(ctx context.Context, s metricsSnapshot) error {
+	gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return s.families, nil
+	})
+
+	return push.New(t.url, t.job).
+		Gatherer(gatherer).
+		Grouping("instance", t.instance).
+		Client(t.client).
+		PushContext(ctx)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testReceiver stands in for a pushgateway or remote write endpoint,
+// responding with the queued status codes before accepting the requests.
+type testReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func startTestReceiver(t *testing.T, statuses ...int) (*testReceiver, string) {
+	t.Helper()
+
+	receiver := &testReceiver{statuses: statuses}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+
+		if len(receiver.statuses) > 0 {
+			status := receiver.statuses[0]
+			receiver.statuses = receiver.statuses[1:]
+			w.WriteHeader(status)
+			return
+		}
+
+		receiver.requests = append(receiver.requests, r)
+		receiver.bodies = append(receiver.bodies, body)
+	}))
+	t.Cleanup(server.Close)
+
+	return receiver, server.URL
+}
+
+func (r *testReceiver) received() ([]*http.Request, [][]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.requests, r.bodies
+}
+
+func newTestPusher(t *testing.T, target pushTarget, retries int, bufferSize int) *pusher {
+	t.Helper()
+
+	registry := prometheus.NewRegistry()
+	pings := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "test_total_ping",
+		Help: "Test ping counter",
+	}, pairLabels)
+	registry.MustRegister(pings)
+	pings.WithLabelValues("broker1:1883", "broker2:1883", "0").Add(3)
+
+	latency := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "test_latency_seconds",
+		Help:    "Test latency histogram",
+		Buckets: []float64{0.01, 0.1},
+	})
+	registry.MustRegister(latency)
+	latency.Observe(0.05)
+
+	return &pusher{
+		target:     target,
+		gatherer:   registry,
+		interval:   time.Second,
+		retries:    retries,
+		bufferSize: bufferSize,
+		log:        newDedupLogger(logger),
+	}
+}
+
+func TestPushgateway(t *testing.T) {
+	current := pushRetryBackoff
+	pushRetryBackoff = time.Millisecond
+	defer func() {
+		pushRetryBackoff = current
+	}()
+
+	receiver, url := startTestReceiver(t, http.StatusServiceUnavailable, http.StatusBadGateway)
+	target := &pushgatewayTarget{url: url, job: "mqtt-pinger", instance: "test", client: http.DefaultClient}
+	p := newTestPusher(t, target, 2, 1)
+
+	failed := testutil.ToFloat64(metricsTotalPushFailed.WithLabelValues("pushgateway"))
+	p.gather(time.Now())
+	p.flush(context.Background())
+	require.Empty(t, p.buffer)
+	require.Equal(t, failed+2, testutil.ToFloat64(metricsTotalPushFailed.WithLabelValues("pushgateway")))
+
+	requests, bodies := receiver.received()
+	require.Len(t, requests, 1)
+	require.Equal(t, http.MethodPut, requests[0].Method)
+	require.Equal(t, "/metrics/job/mqtt-pinger/instance/test", requests[0].URL.Path)
+	require.Contains(t, string(bodies[0]), "test_total_ping")
+}
+
+func TestPushgatewayLatestOnly(t *testing.T) {
+	receiver, url := startTestReceiver(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	target := &pushgatewayTarget{url: url, job: "mqtt-pinger", instance: "test", client: http.DefaultClient}
+	p := newTestPusher(t, target, 0, 10)
+
+	for i := 0; i < 3; i++ {
+		p.gather(time.Now())
+		p.flush(context.Background())
+	}
+
+	require.Empty(t, p.buffer)
+	requests, _ := receiver.received()
+	require.Len(t, requests, 1)
+}
+
+func TestRemoteWrite(t *testing.T) {
+	receiver, url := startTestReceiver(t)
+	target := &remoteWriteTarget{url: url, labels: map[string]string{"job": "mqtt-pinger", "instance": "test"}, client: http.DefaultClient}
+	p := newTestPusher(t, target, 0, 10)
+
+	gatheredAt := time.UnixMilli(1662026400000)
+	p.gather(gatheredAt)
+	p.flush(context.Background())
+	require.Empty(t, p.buffer)
+
+	requests, bodies := receiver.received()
+	require.Len(t, requests, 1)
+	require.Equal(t, http.MethodPost, requests[0].Method)
+	require.Equal(t, "snappy", requests[0].Header.Get("Content-Encoding"))
+	require.Equal(t, "application/x-protobuf", requests[0].Header.Get("Content-Type"))
+	require.Equal(t, "0.1.0", requests[0].Header.Get("X-Prometheus-Remote-Write-Version"))
+
+	expected := []string{
+		`{__name__="test_latency_seconds_bucket", instance="test", job="mqtt-pinger", le="+Inf"} 1 @1662026400000`,
+		`{__name__="test_latency_seconds_bucket", instance="test", job="mqtt-pinger", le="0.01"} 0 @1662026400000`,
+		`{__name__="test_latency_seconds_bucket", instance="test", job="mqtt-pinger", le="0.1"} 1 @1662026400000`,
+		`{__name__="test_latency_seconds_count", instance="test", job="mqtt-pinger"} 1 @1662026400000`,
+		`{__name__="test_latency_seconds_sum", instance="test", job="mqtt-pinger"} 0.05 @1662026400000`,
+		`{__name__="test_total_ping", destination="broker2:1883", instance="test", job="mqtt-pinger", qos="0", source="broker1:1883"} 3 @1662026400000`,
+	}
+	require.Equal(t, expected, decodeWriteRequest(t, bodies[0]))
+}
+
+func TestRemoteWriteBuffer(t *testing.T) {
+	receiver, url := startTestReceiver(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	target := &remoteWriteTarget{url: url, client: http.DefaultClient}
+	p := newTestPusher(t, target, 0, 3)
+
+	dropped := testutil.ToFloat64(metricsTotalPushDropped.WithLabelValues("remote_write"))
+	start := time.UnixMilli(1662026400000)
+	for i := 0; i < 4; i++ {
+		p.gather(start.Add(time.Duration(i) * time.Second))
+		p.flush(context.Background())
+	}
+
+	// The oldest metrics are dropped while the endpoint is unavailable.
+	require.Len(t, p.buffer, 3)
+	require.Equal(t, dropped+1, testutil.ToFloat64(metricsTotalPushDropped.WithLabelValues("remote_write")))
+
+	p.gather(start.Add(4 * time.Second))
+	p.flush(context.Background())
+	require.Empty(t, p.buffer)
+	require.Equal(t, dropped+2, testutil.ToFloat64(metricsTotalPushDropped.WithLabelValues("remote_write")))
+
+	_, bodies := receiver.received()
+	require.Len(t, bodies, 3)
+	for i, body := range bodies {
+		series := decodeWriteRequest(t, body)
+		require.NotEmpty(t, series)
+		require.True(t, strings.HasSuffix(series[0], fmt.Sprintf("@%d", start.Add(time.Duration(i+2)*time.Second).UnixMilli())), series[0])
+	}
+}
+
+func TestRemoteWriteRejected(t *testing.T) {
+	receiver, url := startTestReceiver(t, http.StatusBadRequest)
+	target := &remoteWriteTarget{url: url, client: http.DefaultClient}
+	p := newTestPusher(t, target, 3, 10)
+
+	failed := testutil.ToFloat64(metricsTotalPushFailed.WithLabelValues("remote_write"))
+	p.gather(time.Now())
+	p.flush(context.Background())
+
+	// Rejected metrics are dropped without retrying.
+	require.Empty(t, p.buffer)
+	require.Equal(t, failed+1, testutil.ToFloat64(metricsTotalPushFailed.WithLabelValues("remote_write")))
+	requests, _ := receiver.received()
+	require.Empty(t, requests)
+}
+
+func TestNewPushers(t *testing.T) {
+	cases := []struct {
+		testDescription string
+		cfg             config
+		expectedTargets []string
+		expectedErr     string
+	}{
+		{
+			testDescription: "disabled",
+			cfg:             config{},
+		},
+		{
+			testDescription: "both targets",
+			cfg:             config{PushgatewayURL: "http://pushgateway:9091", RemoteWriteURL: "https://prometheus/api/v1/write", PushInterval: 15, PushJob: "mqtt-pinger", PushBufferSize: 1},
+			expectedTargets: []string{"pushgateway", "remote_write"},
+		},
+		{
+			testDescription: "invalid url",
+			cfg:             config{RemoteWriteURL: "prometheus:9090", PushInterval: 15, PushBufferSize: 1},
+			expectedErr:     "push url \"prometheus:9090\" should be a url like http://host:port",
+		},
+		{
+			testDescription: "invalid interval",
+			cfg:             config{PushgatewayURL: "http://pushgateway:9091", PushBufferSize: 1},
+			expectedErr:     "received push interval 0 but it has to be at least 1",
+		},
+		{
+			testDescription: "negative retries",
+			cfg:             config{PushgatewayURL: "http://pushgateway:9091", PushInterval: 15, PushRetries: -1, PushBufferSize: 1},
+			expectedErr:     "received -1 push retries but it can't be negative",
+		},
+		{
+			testDescription: "invalid buffer size",
+			cfg:             config{RemoteWriteURL: "http://prometheus:9090/api/v1/write", PushInterval: 15},
+			expectedErr:     "received push buffer size 0 but it has to be at least 1",
+		},
+		{
+			testDescription: "job external label with pushgateway",
+			cfg:             config{PushgatewayURL: "http://pushgateway:9091", PushInterval: 15, PushBufferSize: 1, ExternalLabels: map[string]string{"job": "pinger"}},
+			expectedErr:     "external label \"job\" can't be used with the pushgateway, use the push job and instance instead",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+		pushers, err := newPushers(&c.cfg)
+		if c.expectedErr != "" {
+			require.EqualError(t, err, c.expectedErr)
+			continue
+		}
+		require.NoError(t, err)
+
+		var targets []string
+		for _, p := range pushers {
+			targets = append(targets, p.target.name())
+		}
+		require.Equal(t, c.expectedTargets, targets)
+	}
+}
+
+// decodeWriteRequest decodes a snappy compressed remote write request into
+// the series formatted like {name="value", ...} value @timestamp, sorted.
+func decodeWriteRequest(t *testing.T, body []byte) []string {
+	t.Helper()
+
+	b, err := snappy.Decode(nil, body)
+	require.NoError(t, err)
+
+	fields := func(b []byte, f func(num protowire.Number, typ protowire.Type, value []byte)) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			require.GreaterOrEqual(t, n, 0)
+			b = b[n:]
+
+			m := protowire.ConsumeFieldValue(num, typ, b)
+			require.GreaterOrEqual(t, m, 0)
+			f(num, typ, b[:m])
+			b = b[m:]
+		}
+	}
+
+	var series []string
+	fields(b, func(_ protowire.Number, _ protowire.Type, ts []byte) {
+		ts, _ = protowire.ConsumeBytes(ts)
+		var labels []string
+		var sample string
+		fields(ts, func(num protowire.Number, _ protowire.Type, value []byte) {
+			value, _ = protowire.ConsumeBytes(value)
+			switch num {
+			case 1:
+				var name, labelValue string
+				fields(value, func(num protowire.Number, _ protowire.Type, s []byte) {
+					v, _ := protowire.ConsumeString(s)
+					if num == 1 {
+						name = v
+					} else {
+						labelValue = v
+					}
+				})
+				labels = append(labels, fmt.Sprintf("%s=%q", name, labelValue))
+			case 2:
+				var v float64
+				var timestamp int64
+				fields(value, func(num protowire.Number, _ protowire.Type, s []byte) {
+					if num == 1 {
+						bits, _ := protowire.ConsumeFixed64(s)
+						v = math.Float64frombits(bits)
+					} else {
+						ts, _ := protowire.ConsumeVarint(s)
+						timestamp = int64(ts)
+					}
+				})
+				sample = fmt.Sprintf("%g @%d", v, timestamp)
+			}
+		})
+		series = append(series, fmt.Sprintf("{%s} %s", strings.Join(labels, ", "), sample))
+	})
+	sort.Strings(series)
+
+	return series
+}
+
+func TestPusherShutdown(t *testing.T) {
+	receiver, url := startTestReceiver(t)
+	target := &pushgatewayTarget{url: url, job: "mqtt-pinger", instance: "test", client: http.DefaultClient}
+	p := newTestPusher(t, target, 0, 1)
+	p.interval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.run(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		requests, _ := receiver.received()
+		return len(requests) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+	p.shutdown()
+
+	requests, _ := receiver.received()
+	require.Len(t, requests, 2)
+}
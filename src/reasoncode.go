@@ -0,0 +1,113 @@
+package main
+
+import "fmt"
+
+const (
+	packetConnack = "connack"
+	packetSuback  = "suback"
+	packetPuback  = "puback"
+	packetPubrec  = "pubrec"
+	packetPubcomp = "pubcomp"
+)
+
+// reasonCode is a reason code (mqtt 5) or return code (mqtt 3.1.1) received
+// from a broker.
+type reasonCode struct {
+	packet string
+	code   byte
+	name   string
+	failed bool
+}
+
+func (rc reasonCode) String() string {
+	return fmt.Sprintf("%s 0x%02x (%s)", rc.packet, rc.code, rc.name)
+}
+
+func (rc reasonCode) label() string {
+	return fmt.Sprintf("0x%02x", rc.code)
+}
+
+var mqtt3ConnackNames = map[byte]string{
+	0x00: "connection accepted",
+	0x01: "unacceptable protocol version",
+	0x02: "identifier rejected",
+	0x03: "server unavailable",
+	0x04: "bad user name or password",
+	0x05: "not authorized",
+}
+
+var mqtt5ReasonCodeNames = map[byte]string{
+	0x00: "success",
+	0x01: "granted qos 1",
+	0x02: "granted qos 2",
+	0x10: "no matching subscribers",
+	0x80: "unspecified error",
+	0x81: "malformed packet",
+	0x82: "protocol error",
+	0x83: "implementation specific error",
+	0x84: "unsupported protocol version",
+	0x85: "client identifier not valid",
+	0x86: "bad user name or password",
+	0x87: "not authorized",
+	0x88: "server unavailable",
+	0x89: "server busy",
+	0x8a: "banned",
+	0x8c: "bad authentication method",
+	0x8f: "topic filter invalid",
+	0x90: "topic name invalid",
+	0x91: "packet identifier in use",
+	0x92: "packet identifier not found",
+	0x95: "packet too large",
+	0x97: "quota exceeded",
+	0x99: "payload format invalid",
+	0x9a: "retain not supported",
+	0x9b: "qos not supported",
+	0x9c: "use another server",
+	0x9d: "server moved",
+	0x9e: "shared subscriptions not supported",
+	0x9f: "connection rate exceeded",
+	0xa1: "subscription identifiers not supported",
+	0xa2: "wildcard subscriptions not supported",
+}
+
+func newMQTT3ReasonCode(packet string, code byte) reasonCode {
+	var name string
+	var failed bool
+	switch packet {
+	case packetConnack:
+		name = mqtt3ConnackNames[code]
+		failed = code != 0x00
+	default:
+		if code < 0x80 {
+			name = fmt.Sprintf("granted qos %d", code)
+		} else {
+			name = "failure"
+		}
+		failed = code >= 0x80
+	}
+
+	if name == "" {
+		name = "unknown"
+	}
+
+	return reasonCode{
+		packet: packet,
+		code:   code,
+		name:   name,
+		failed: failed,
+	}
+}
+
+func newMQTT5ReasonCode(packet string, code byte) reasonCode {
+	name, ok := mqtt5ReasonCodeNames[code]
+	if !ok {
+		name = "unknown"
+	}
+
+	return reasonCode{
+		packet: packet,
+		code:   code,
+		name:   name,
+		failed: code >= 0x80,
+	}
+}
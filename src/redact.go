@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+var (
+	secretsMu sync.RWMutex
+	// secrets are keyed by where they are configured, so a rotated secret
+	// replaces the previous one.
+	secrets = make(map[string][]string)
+
+	urlUserInfoRegexp = regexp.MustCompile(`://[^/@\s]+@`)
+	// secretFieldRegexp matches the values of fields named like a secret, both
+	// in json and as key=value.
+	secretFieldRegexp = regexp.MustCompile(`(?i)([\w-]*(?:password|token|secret)"?\s*[:=]\s*)("(?:[^"\\]|\\.)*"|[^\s,&"]+)`)
+)
+
+// registerSecret makes sure the secret is removed from everything passed
+// through redact. A secret registered again with the same key replaces the
+// previous one.
+func registerSecret(key string, secret string) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	if secret == "" {
+		delete(secrets, key)
+		return
+	}
+
+	values := []string{secret}
+	// The log events are redacted as json, where the secret is escaped.
+	b, err := json.Marshal(secret)
+	if err == nil && string(b[1:len(b)-1]) != secret {
+		values = append(values, string(b[1:len(b)-1]))
+	}
+	secrets[key] = values
+}
+
+// redact removes the url credentials, the values of secret fields and the
+// registered secrets from s.
+func redact(s string) string {
+	s = urlUserInfoRegexp.ReplaceAllString(s, fmt.Sprintf("://%s@", redacted))
+	s = secretFieldRegexp.ReplaceAllStringFunc(s, func(field string) string {
+		m := secretFieldRegexp.FindStringSubmatch(field)
+		if strings.HasPrefix(m[2], `"`) {
+			return fmt.Sprintf(`%s"%s"`, m[1], redacted)
+		}
+		return m[1] + redacted
+	})
+
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+
+	for _, values := range secrets {
+		for _, secret := range values {
+			s = replaceSecret(s, secret)
+		}
+	}
+
+	return s
+}
+
+// replaceSecret replaces the secret where it isn't part of a longer word, so
+// that a short secret doesn't corrupt unrelated values like client ids.
+func replaceSecret(s string, secret string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, secret)
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+
+		end := i + len(secret)
+		if (i > 0 && isWordByte(s[i-1])) || (end < len(s) && isWordByte(s[end])) {
+			b.WriteString(s[:i+1])
+			s = s[i+1:]
+			continue
+		}
+
+		b.WriteString(s[:i])
+		b.WriteString(redacted)
+		s = s[end:]
+	}
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '-' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// redactf formats according to the format specifier and redacts the result.
+func redactf(format string, a ...interface{}) string {
+	return redact(fmt.Sprintf(format, a...))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const configReloadInterval = 5 * time.Second
+
+// restartSettings are the config fields that are only applied when the
+// pinger is started.
+var restartSettings = []string{
+	"MetricsAddress", "MetricsPort", "ReadyRatio",
+	"LogLevel", "LogFormat", "LogDedupInterval",
+	"OTLPEndpoint", "TraceSampleRatio",
+	"PushgatewayURL", "RemoteWriteURL", "PushInterval", "PushJob", "PushInstance", "PushRetries", "PushBufferSize",
+	"StatsDAddress", "StatsDPrefix", "InfluxDBURL", "InfluxDBToken", "InfluxDBFlushInterval",
+	"AlertWebhooks", "AlertDownAfter", "AlertUpAfter", "AlertDegradedRatio", "AlertCooldown", "AlertRetries",
+	"DNSDiscovery", "DNSDiscoveryInterval", "FileDiscovery", "FileDiscoveryInterval",
+}
+
+// taskUpdater keeps the running tasks in sync with the config and the
+// brokers found by discovery.
+type taskUpdater struct {
+	runner *taskRunner
+	cfg    config
+	// started is the config the pinger was started with, which the
+	// restart settings are compared to.
+	started    config
+	discovered map[string][]discoveredBroker
+}
+
+func newTaskUpdater(runner *taskRunner, cfg config) *taskUpdater {
+	return &taskUpdater{
+		runner:     runner,
+		cfg:        cfg,
+		started:    cfg,
+		discovered: make(map[string][]discoveredBroker),
+	}
+}
+
+// update starts the tasks for the current config and brokers.
+func (u *taskUpdater) update() error {
+	tasks, err := u.tasks(u.cfg)
+	if err != nil {
+		return err
+	}
+
+	u.runner.update(tasks)
+
+	return nil
+}
+
+func (u *taskUpdater) tasks(cfg config) (map[string]task, error) {
+	cfg.Brokers = mergeBrokers(cfg.Brokers, u.discovered)
+	cfg.brokerLabels = mergeBrokerLabels(cfg.brokerLabels, u.discovered)
+
+	labels, err := newMetricLabels(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Discovery can find less than two brokers, for example when scaling up
+	// from zero, which isn't an error.
+	tasks := map[string]task{}
+	if cfg.discoveryEnabled() && len(cfg.Brokers) < 2 {
+		logger.Info().Int("brokers", len(cfg.Brokers)).Msg("waiting for at least 2 brokers")
+	} else {
+		tasks, err = newTasks(&cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The labels are only replaced once the config is known to be valid, as
+	// the tasks are always applied after this.
+	currentMetricLabels.Store(labels)
+
+	return tasks, nil
+}
+
+// reload loads the config again and updates the running tasks, keeping the
+// current config if the new one is invalid.
+func (u *taskUpdater) reload(reload func() (config, error), reason string) {
+	cfg, err := reload()
+	if err != nil {
+		logger.Error().Err(err).Str("reason", reason).Msg("unable to reload config")
+		return
+	}
+
+	tasks, err := u.tasks(cfg)
+	if err != nil {
+		logger.Error().Err(err).Str("reason", reason).Msg("unable to reload config")
+		return
+	}
+
+	u.cfg = cfg
+	u.apply(logger.Info().Str("reason", reason), "config reloaded", tasks)
+
+	changed := changedRestartSettings(&u.started, &cfg)
+	if len(changed) > 0 {
+		logger.Warn().Str("reason", reason).Strs("settings", changed).Msg("changed settings are only applied after a restart")
+	}
+}
+
+// changedRestartSettings returns the flags of the restart settings that
+// differ between the configs.
+func changedRestartSettings(running *config, cfg *config) []string {
+	var changed []string
+	a, b := reflect.ValueOf(running).Elem(), reflect.ValueOf(cfg).Elem()
+	for _, field := range restartSettings {
+		if !reflect.DeepEqual(a.FieldByName(field).Interface(), b.FieldByName(field).Interface()) {
+			changed = append(changed, flagName(field))
+		}
+	}
+
+	return changed
+}
+
+// discover updates the running tasks with the brokers found by a discovery
+// source.
+func (u *taskUpdater) discover(update discoveryUpdate) {
+	u.discovered[update.source] = update.brokers
+
+	tasks, err := u.tasks(u.cfg)
+	if err != nil {
+		logger.Error().Err(err).Str("discovery", update.source).Msg("unable to update pairs with discovered brokers")
+		return
+	}
+
+	u.apply(logger.Info().Str("discovery", update.source), "brokers discovered", tasks)
+}
+
+func (u *taskUpdater) apply(event *zerolog.Event, msg string, tasks map[string]task) {
+	started, stopped := u.runner.update(tasks)
+	event.Int("started", started).Int("stopped", stopped).Int("unchanged", len(tasks)-started).Msg(msg)
+}
+
+// watchConfigFile returns a channel that receives when the modification time
+// or size of the file changes. Nothing is watched if path is empty.
+func watchConfigFile(ctx context.Context, path string, interval time.Duration) <-chan struct{} {
+	changedCh := make(chan struct{}, 1)
+	if path == "" {
+		return changedCh
+	}
+
+	stat := func() (time.Time, int64) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, 0
+		}
+		return info.ModTime(), info.Size()
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		modTime, size := stat()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			newModTime, newSize := stat()
+			if newModTime.Equal(modTime) && newSize == size {
+				continue
+			}
+			modTime, size = newModTime, newSize
+
+			select {
+			case changedCh <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return changedCh
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteTarget sends the metrics with the prometheus remote write
+// protocol, metrics that couldn't be sent are buffered and sent later with
+// their original timestamps.
+type remoteWriteTarget struct {
+	url string
+	// labels are added to all series, unless the metric already has them.
+	labels map[string]string
+	client *http.Client
+}
+
+type remoteWriteLabel struct {
+	name  string
+	value string
+}
+
+// remoteWriteSeries is a time series with a single sample.
+type remoteWriteSeries struct {
+	labels    []remoteWriteLabel
+	value     float64
+	timestamp int64
+}
+
+func (t *remoteWriteTarget) name() string {
+	return "remote_write"
+}
+
+func (t *remoteWriteTarget) buffered() bool {
+	return true
+}
+
+func (t *remoteWriteTarget) push(ctx context.Context, s metricsSnapshot) error {
+	body := snappy.Encode(nil, encodeWriteRequest(remoteWriteSeriesFrom(s, t.labels)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "mqtt-pinger")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 == 2 {
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	err = fmt.Errorf("remote write returned status %d: %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	// Client errors other than rate limiting won't succeed when retried.
+	if res.StatusCode/100 == 4 && res.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+
+	return err
+}
+
+// remoteWriteSeriesFrom converts the metric families into series the same
+// way as they would be stored when scraped.
+func remoteWriteSeriesFrom(s metricsSnapshot, labels map[string]string) []remoteWriteSeries {
+	var series []remoteWriteSeries
+	for _, family := range s.families {
+		name := family.GetName()
+		for _, metric := range family.Metric {
+			timestamp := s.gatheredAt.UnixMilli()
+			if metric.TimestampMs != nil {
+				timestamp = metric.GetTimestampMs()
+			}
+
+			add := func(suffix string, value float64, extra ...remoteWriteLabel) {
+				series = append(series, remoteWriteSeries{
+					labels:    remoteWriteLabels(name+suffix, metric.Label, extra, labels),
+					value:     value,
+					timestamp: timestamp,
+				})
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", metric.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, q := range summary.Quantile {
+					add("", q.GetValue(), remoteWriteLabel{model.QuantileLabel, formatFloat(q.GetQuantile())})
+				}
+				add("_sum", summary.GetSampleSum())
+				add("_count", float64(summary.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				infSeen := false
+				for _, b := range histogram.Bucket {
+					if math.IsInf(b.GetUpperBound(), 1) {
+						infSeen = true
+					}
+					add("_bucket", float64(b.GetCumulativeCount()), remoteWriteLabel{model.BucketLabel, formatFloat(b.GetUpperBound())})
+				}
+				if !infSeen {
+					add("_bucket", float64(histogram.GetSampleCount()), remoteWriteLabel{model.BucketLabel, "+Inf"})
+				}
+				add("_sum", histogram.GetSampleSum())
+				add("_count", float64(histogram.GetSampleCount()))
+			}
+		}
+	}
+
+	return series
+}
+
+// remoteWriteLabels returns the labels of a series sorted by name, the
+// metric labels take precedence over the extra labels.
+func remoteWriteLabels(name string, pairs []*dto.LabelPair, series []remoteWriteLabel, extra map[string]string) []remoteWriteLabel {
+	labels := []remoteWriteLabel{{model.MetricNameLabel, name}}
+	seen := map[string]bool{model.MetricNameLabel: true}
+	for _, pair := range pairs {
+		labels = append(labels, remoteWriteLabel{pair.GetName(), pair.GetValue()})
+		seen[pair.GetName()] = true
+	}
+
+	for _, l := range series {
+		labels = append(labels, l)
+		seen[l.name] = true
+	}
+
+	for name, value := range extra {
+		if !seen[name] && value != "" {
+			labels = append(labels, remoteWriteLabel{name, value})
+		}
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].name < labels[j].name
+	})
+
+	return labels
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+// encodeWriteRequest encodes the series as a remote write WriteRequest
+// protobuf message:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []remoteWriteSeries) []byte {
+	var b []byte
+	for _, s := range series {
+		var ts []byte
+		for _, l := range s.labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l.name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l.value)
+
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.timestamp))
+
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+
+	return b
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// writeCheckReports writes the configured reports of the check.
+func writeCheckReports(cfg *config, run *checkRun) error {
+	if cfg.CheckJUnitReport != "" {
+		b, err := junitReport(run)
+		if err != nil {
+			return fmt.Errorf("unable to generate junit report: %w", err)
+		}
+
+		err = os.WriteFile(cfg.CheckJUnitReport, b, 0o644)
+		if err != nil {
+			return fmt.Errorf("unable to write junit report: %w", err)
+		}
+	}
+
+	if cfg.CheckJSONReport != "" {
+		b, err := jsonReport(run)
+		if err != nil {
+			return fmt.Errorf("unable to generate json report: %w", err)
+		}
+
+		err = os.WriteFile(cfg.CheckJSONReport, b, 0o644)
+		if err != nil {
+			return fmt.Errorf("unable to write json report: %w", err)
+		}
+	}
+
+	return nil
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Errors     int             `xml:"errors,attr"`
+	Time       string          `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Properties []junitProperty `xml:"properties>property"`
+	TestCases  []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name       string          `xml:"name,attr"`
+	ClassName  string          `xml:"classname,attr"`
+	Time       string          `xml:"time,attr"`
+	Properties []junitProperty `xml:"properties>property"`
+	Failure    *junitFailure   `xml:"failure"`
+	SystemOut  string          `xml:"system-out"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitReport returns the check as a junit xml report, with every pair as a
+// test case of the source broker.
+func junitReport(run *checkRun) ([]byte, error) {
+	suite := junitTestSuite{
+		Name:      "mqtt-pinger check",
+		Tests:     len(run.results),
+		Time:      junitSeconds(run.duration),
+		Timestamp: run.startedAt.UTC().Format("2006-01-02T15:04:05"),
+		Properties: []junitProperty{
+			{"pings", strconv.Itoa(run.settings.pings)},
+			{"ping_interval_seconds", junitSeconds(run.settings.pingInterval)},
+			{"min_success_ratio", strconv.FormatFloat(run.settings.minSuccessRatio, 'f', -1, 64)},
+			{"max_latency_seconds", junitSeconds(run.settings.maxLatency)},
+			{"received_from", "destination"},
+		},
+	}
+
+	for i := range run.results {
+		r := &run.results[i]
+		min, avg, max := r.latency()
+		tc := junitTestCase{
+			Name:      r.name(),
+			ClassName: brokerName(r.pair.source, r.sourceAlias),
+			Time:      junitSeconds(r.duration),
+			Properties: []junitProperty{
+				{"sent", strconv.Itoa(r.sent)},
+				{"received", strconv.Itoa(r.received)},
+				{"lost", strconv.Itoa(r.lost())},
+				{"success_ratio", strconv.FormatFloat(r.successRatio(), 'f', -1, 64)},
+			},
+			SystemOut: fmt.Sprintf("sent %d pings to the destination, received %d and lost %d pings from the destination, latency min %s, avg %s and max %s", r.sent, r.received, r.lost(), formatLatency(min), formatLatency(avg), formatLatency(max)),
+		}
+		if len(r.latencies) > 0 {
+			tc.Properties = append(tc.Properties,
+				junitProperty{"latency_min_seconds", junitSeconds(min)},
+				junitProperty{"latency_avg_seconds", junitSeconds(avg)},
+				junitProperty{"latency_max_seconds", junitSeconds(max)},
+			)
+		}
+
+		if !r.passed() {
+			suite.Failures++
+			tc.Failure = &junitFailure{
+				Message: r.failures[0],
+				Type:    "CheckFailed",
+				Text:    strings.Join(r.failures, "\n"),
+			}
+		}
+
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+
+	b, err := xml.MarshalIndent(junitTestSuites{
+		Name:     "mqtt-pinger",
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Time:     suite.Time,
+		Suites:   []junitTestSuite{suite},
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), append(b, '\n')...), nil
+}
+
+func junitSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+type jsonCheckReport struct {
+	Passed            bool             `json:"passed"`
+	Timestamp         time.Time        `json:"timestamp"`
+	DurationSeconds   float64          `json:"duration_seconds"`
+	Pings             int              `json:"pings"`
+	MinSuccessRatio   float64          `json:"min_success_ratio"`
+	MaxLatencySeconds *float64         `json:"max_latency_seconds"`
+	ReceivedFrom      string           `json:"received_from"`
+	Pairs             []jsonCheckPair  `json:"pairs"`
+	Summary           jsonCheckSummary `json:"summary"`
+}
+
+type jsonCheckSummary struct {
+	Pairs  int `json:"pairs"`
+	Passed int `json:"passed"`
+	Failed int `json:"failed"`
+}
+
+type jsonCheckPair struct {
+	Source           string       `json:"source"`
+	SourceAlias      string       `json:"source_alias,omitempty"`
+	Destination      string       `json:"destination"`
+	DestinationAlias string       `json:"destination_alias,omitempty"`
+	QoS              byte         `json:"qos"`
+	Passed           bool         `json:"passed"`
+	Sent             int          `json:"sent"`
+	Received         int          `json:"received"`
+	Lost             int          `json:"lost"`
+	SuccessRatio     float64      `json:"success_ratio"`
+	Latency          *jsonLatency `json:"latency_seconds"`
+	DurationSeconds  float64      `json:"duration_seconds"`
+	Failures         []string     `json:"failures"`
+}
+
+type jsonLatency struct {
+	Min float64 `json:"min"`
+	Avg float64 `json:"avg"`
+	Max float64 `json:"max"`
+}
+
+// jsonReport returns the check with the same data as the junit report.
+func jsonReport(run *checkRun) ([]byte, error) {
+	report := jsonCheckReport{
+		Passed:          run.passed(),
+		Timestamp:       run.startedAt.UTC(),
+		DurationSeconds: run.duration.Seconds(),
+		Pings:           run.settings.pings,
+		MinSuccessRatio: run.settings.minSuccessRatio,
+		ReceivedFrom:    "destination",
+		Pairs:           []jsonCheckPair{},
+		Summary:         jsonCheckSummary{Pairs: len(run.results)},
+	}
+	if run.settings.maxLatency > 0 {
+		maxLatency := run.settings.maxLatency.Seconds()
+		report.MaxLatencySeconds = &maxLatency
+	}
+
+	for i := range run.results {
+		r := &run.results[i]
+		pair := jsonCheckPair{
+			Source:           r.pair.source,
+			SourceAlias:      r.sourceAlias,
+			Destination:      r.pair.destination,
+			DestinationAlias: r.destinationAlias,
+			QoS:              r.pair.qos,
+			Passed:           r.passed(),
+			Sent:             r.sent,
+			Received:         r.received,
+			Lost:             r.lost(),
+			SuccessRatio:     r.successRatio(),
+			DurationSeconds:  r.duration.Seconds(),
+			Failures:         append([]string{}, r.failures...),
+		}
+		if len(r.latencies) > 0 {
+			min, avg, max := r.latency()
+			pair.Latency = &jsonLatency{Min: min.Seconds(), Avg: avg.Seconds(), Max: max.Seconds()}
+		}
+
+		if pair.Passed {
+			report.Summary.Passed++
+		} else {
+			report.Summary.Failed++
+		}
+		report.Pairs = append(report.Pairs, pair)
+	}
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, '\n'), nil
+}
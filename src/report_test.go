@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testCheckRun() *checkRun {
+	return &checkRun{
+		settings:  checkSettings{pings: 2, pingInterval: time.Second, minSuccessRatio: 1, maxLatency: 500 * time.Millisecond},
+		startedAt: time.Date(2022, 9, 1, 10, 0, 0, 0, time.UTC),
+		duration:  3500 * time.Millisecond,
+		results: []checkResult{
+			{
+				pair:        brokerPair{source: "broker1:1883", destination: "broker2:1883", qos: 1},
+				sourceAlias: "node-1",
+				pings:       2,
+				sent:        2,
+				received:    2,
+				latencies:   []time.Duration{time.Millisecond, 3 * time.Millisecond},
+				duration:    2500 * time.Millisecond,
+			},
+			{
+				pair:             brokerPair{source: "broker2:1883", destination: "broker1:1883", qos: 1},
+				destinationAlias: "node-1",
+				pings:            2,
+				sent:             2,
+				duration:         3500 * time.Millisecond,
+				failures:         []string{"received 0 of 2 pings, below the min success ratio 1", "ping client failed: <eof>"},
+			},
+		},
+	}
+}
+
+func TestJUnitReport(t *testing.T) {
+	b, err := junitReport(testCheckRun())
+	require.NoError(t, err)
+
+	expected := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites name="mqtt-pinger" tests="2" failures="1" time="3.5">
+  <testsuite name="mqtt-pinger check" tests="2" failures="1" errors="0" time="3.5" timestamp="2022-09-01T10:00:00">
+    <properties>
+      <property name="pings" value="2"></property>
+      <property name="ping_interval_seconds" value="1"></property>
+      <property name="min_success_ratio" value="1"></property>
+      <property name="max_latency_seconds" value="0.5"></property>
+      <property name="received_from" value="destination"></property>
+    </properties>
+    <testcase name="node-1 (broker1:1883) -&gt; broker2:1883 (qos 1)" classname="node-1 (broker1:1883)" time="2.5">
+      <properties>
+        <property name="sent" value="2"></property>
+        <property name="received" value="2"></property>
+        <property name="lost" value="0"></property>
+        <property name="success_ratio" value="1"></property>
+        <property name="latency_min_seconds" value="0.001"></property>
+        <property name="latency_avg_seconds" value="0.002"></property>
+        <property name="latency_max_seconds" value="0.003"></property>
+      </properties>
+      <system-out>sent 2 pings to the destination, received 2 and lost 0 pings from the destination, latency min 1ms, avg 2ms and max 3ms</system-out>
+    </testcase>
+    <testcase name="broker2:1883 -&gt; node-1 (broker1:1883) (qos 1)" classname="broker2:1883" time="3.5">
+      <properties>
+        <property name="sent" value="2"></property>
+        <property name="received" value="0"></property>
+        <property name="lost" value="2"></property>
+        <property name="success_ratio" value="0"></property>
+      </properties>
+      <failure message="received 0 of 2 pings, below the min success ratio 1" type="CheckFailed">received 0 of 2 pings, below the min success ratio 1&#xA;ping client failed: &lt;eof&gt;</failure>
+      <system-out>sent 2 pings to the destination, received 0 and lost 2 pings from the destination, latency min -, avg - and max -</system-out>
+    </testcase>
+  </testsuite>
+</testsuites>
+`
+	require.Equal(t, expected, string(b))
+}
+
+func TestJSONReport(t *testing.T) {
+	b, err := jsonReport(testCheckRun())
+	require.NoError(t, err)
+
+	var report map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &report))
+
+	require.Equal(t, false, report["passed"])
+	require.Equal(t, "2022-09-01T10:00:00Z", report["timestamp"])
+	require.Equal(t, 3.5, report["duration_seconds"])
+	require.Equal(t, 0.5, report["max_latency_seconds"])
+	require.Equal(t, "destination", report["received_from"])
+	require.Equal(t, map[string]interface{}{"pairs": float64(2), "passed": float64(1), "failed": float64(1)}, report["summary"])
+
+	pairs := report["pairs"].([]interface{})
+	require.Len(t, pairs, 2)
+	require.Equal(t, map[string]interface{}{
+		"source":           "broker1:1883",
+		"source_alias":     "node-1",
+		"destination":      "broker2:1883",
+		"qos":              float64(1),
+		"passed":           true,
+		"sent":             float64(2),
+		"received":         float64(2),
+		"lost":             float64(0),
+		"success_ratio":    float64(1),
+		"latency_seconds":  map[string]interface{}{"min": 0.001, "avg": 0.002, "max": 0.003},
+		"duration_seconds": 2.5,
+		"failures":         []interface{}{},
+	}, pairs[0])
+	require.Nil(t, pairs[1].(map[string]interface{})["latency_seconds"])
+	require.Equal(t, []interface{}{"received 0 of 2 pings, below the min success ratio 1", "ping client failed: <eof>"}, pairs[1].(map[string]interface{})["failures"])
+}
+
+func TestWriteCheckReports(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config{
+		CheckJUnitReport: filepath.Join(dir, "junit.xml"),
+		CheckJSONReport:  filepath.Join(dir, "report.json"),
+	}
+	require.NoError(t, writeCheckReports(&cfg, testCheckRun()))
+
+	for _, file := range []string{cfg.CheckJUnitReport, cfg.CheckJSONReport} {
+		info, err := os.Stat(file)
+		require.NoError(t, err)
+		require.NotZero(t, info.Size())
+	}
+
+	cfg.CheckJSONReport = filepath.Join(dir, "missing", "report.json")
+	require.ErrorContains(t, writeCheckReports(&cfg, testCheckRun()), "unable to write json report")
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	retainedQoS          = byte(1)
+	retainedFetchTimeout = 2 * time.Second
+	retainedRetryDelay   = 500 * time.Millisecond
+)
+
+var errNoRetainedMessage = errors.New("no retained message received")
+
+var probeLabels = []string{"source", "destination"}
+
+var (
+	metricsTotalRetainedSuccess = newCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_total_retained_success",
+		Help: "Total number of retained messages received on the destination",
+	}, probeLabels)
+
+	metricsTotalRetainedFailed = newCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_total_retained_failed",
+		Help: "Total number of retained messages not received on the destination before the timeout",
+	}, probeLabels)
+
+	metricsRetainedPropagation = newHistogramVec(prometheus.HistogramOpts{
+		Name:    "mqtt_retained_propagation_seconds",
+		Help:    "Time from publishing a retained message until a new subscriber on the destination received it",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, probeLabels)
+
+	metricsRetainedStaleness = newGaugeVec(prometheus.GaugeOpts{
+		Name: "mqtt_retained_staleness_seconds",
+		Help: "How much older the retained message on the destination is compared to the last published",
+	}, probeLabels)
+)
+
+// RetainedProbe publishes retained messages on the source broker and verifies
+// that new subscribers on the destination broker receive the latest one.
+type RetainedProbe struct {
+	pair        brokerPair
+	publisher   mqttConnection
+	sourceOpts  brokerOptions
+	destOpts    brokerOptions
+	topic       string
+	interval    time.Duration
+	timeout     time.Duration
+	stream      string
+	sequence    uint64
+	fetchNumber uint64
+	log         *dedupLogger
+}
+
+func NewRetainedProbe(p *brokerPair, interval time.Duration, timeout time.Duration, sourceOpts brokerOptions, destOpts brokerOptions) *RetainedProbe {
+	probe := &RetainedProbe{
+		pair:       *p,
+		sourceOpts: sourceOpts,
+		destOpts:   destOpts,
+		topic:      fmt.Sprintf("mqtt_ping_retained/%s/%s", p.base64Source, p.base64Destination),
+		interval:   interval,
+		timeout:    timeout,
+		stream:     fmt.Sprintf("%s-%d", p.clientID, time.Now().UnixNano()),
+		log:        newPairLogger(p),
+	}
+
+	connOpts := sourceOpts.connectionOptions(p.source, p.clientID)
+	connOpts.cleanSession = true
+	connOpts.onError = probe.connectionError
+	probe.publisher = newConnection(connOpts)
+
+	metricsTotalRetainedSuccess.WithLabelValues(probe.labelValues()...).Add(0)
+	metricsTotalRetainedFailed.WithLabelValues(probe.labelValues()...).Add(0)
+	metricsRetainedPropagation.WithLabelValues(probe.labelValues()...)
+
+	return probe
+}
+
+func (probe *RetainedProbe) Run(ctx context.Context) error {
+	err := probe.publisher.connect(ctx)
+	if err != nil {
+		probe.publisher.disconnect()
+		return err
+	}
+
+	defer probe.stop(5 * time.Second)
+
+	probe.log.Info().Str("interval", probe.interval.String()).Msg("retained probe started")
+
+	ticker := time.NewTicker(probe.interval)
+	defer ticker.Stop()
+
+	for {
+		probe.probe(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (probe *RetainedProbe) probe(ctx context.Context) {
+	probe.sequence++
+	payload, err := newPingPayload(probe.stream, probe.sequence)
+	if err != nil {
+		probe.log.logError(err, "unable to generate retained message")
+		return
+	}
+
+	b, err := payload.encode()
+	if err != nil {
+		probe.log.logError(err, "unable to encode retained message")
+		return
+	}
+
+	err = probe.publisher.publish(ctx, probe.topic, retainedQoS, true, b)
+	if err != nil {
+		probe.log.logError(err, "retained message failed")
+		metricsTotalRetainedFailed.inc(probe.labelValues()...)
+		return
+	}
+
+	deadline := time.Now().Add(probe.timeout)
+	staleness := time.Duration(0)
+	for {
+		observed, err := probe.fetch(ctx)
+		switch {
+		case err == nil && observed.ID == payload.ID:
+			metricsRetainedPropagation.observe(time.Since(payload.sentAt()).Seconds(), probe.labelValues()...)
+			metricsRetainedStaleness.set(0, probe.labelValues()...)
+			metricsTotalRetainedSuccess.inc(probe.labelValues()...)
+			return
+		case err == nil:
+			staleness = payload.sentAt().Sub(observed.sentAt())
+		default:
+			// Without any retained message the staleness is how long the
+			// destination has been missing the latest one.
+			staleness = time.Since(payload.sentAt())
+			if !errors.Is(err, errNoRetainedMessage) && ctx.Err() == nil {
+				probe.log.logError(err, "retained probe unable to fetch from destination")
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Now().Add(retainedRetryDelay).After(deadline) {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retainedRetryDelay):
+		}
+	}
+
+	probe.log.logError(nil, fmt.Sprintf("retained message not received within %s", probe.timeout))
+	metricsRetainedStaleness.set(staleness.Seconds(), probe.labelValues()...)
+	metricsTotalRetainedFailed.inc(probe.labelValues()...)
+}
+
+// fetch connects a new subscriber to the destination and returns the retained
+// message it receives.
+func (probe *RetainedProbe) fetch(ctx context.Context) (pingPayload, error) {
+	probe.fetchNumber++
+	clientID := fmt.Sprintf("%s-r%d", probe.pair.clientID, probe.fetchNumber)
+
+	connOpts := probe.destOpts.connectionOptions(probe.pair.destination, clientID)
+	connOpts.cleanSession = true
+	conn := newConnection(connOpts)
+
+	err := conn.connect(ctx)
+	defer conn.disconnect()
+	if err != nil {
+		return pingPayload{}, err
+	}
+
+	msgCh := make(chan []byte, 1)
+	err = conn.subscribe(ctx, probe.topic, retainedQoS, func(payload []byte) {
+		select {
+		case msgCh <- payload:
+		default:
+		}
+	})
+	if err != nil {
+		return pingPayload{}, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return pingPayload{}, ctx.Err()
+	case <-time.After(retainedFetchTimeout):
+		return pingPayload{}, errNoRetainedMessage
+	case b := <-msgCh:
+		return decodePingPayload(b)
+	}
+}
+
+// stop clears the retained message and disconnects the publisher.
+func (probe *RetainedProbe) stop(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := probe.publisher.publish(ctx, probe.topic, retainedQoS, true, []byte{})
+	if err != nil {
+		probe.log.logError(err, "unable to clear retained message")
+	}
+
+	probe.publisher.disconnect()
+}
+
+func (probe *RetainedProbe) labelValues() []string {
+	return []string{probe.pair.source, probe.pair.destination}
+}
+
+func (probe *RetainedProbe) connectionError(err error) {
+	probe.log.logError(err, "retained probe connection error")
+}
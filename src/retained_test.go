@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestRetainedProbe(t *testing.T) {
+	cases := []struct {
+		testDescription string
+		protocolVersion string
+	}{
+		{
+			testDescription: "mqtt 3.1.1",
+			protocolVersion: protocolVersion311,
+		},
+		{
+			testDescription: "mqtt 5",
+			protocolVersion: protocolVersion5,
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+
+		broker := startTestBroker(t, nil)
+		pairs, err := generateBrokerPairs([]string{broker.tcp, fmt.Sprintf("ws://%s/mqtt", broker.ws)}, fmt.Sprintf("retained-%d", i), []byte{retainedQoS})
+		require.NoError(t, err)
+
+		p := pairs[0]
+		opts := brokerOptions{protocolVersion: c.protocolVersion}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		g, gCtx := errgroup.WithContext(ctx)
+		probe := NewRetainedProbe(&p, 100*time.Millisecond, 2*time.Second, opts, opts)
+		g.Go(func() error {
+			return probe.Run(gCtx)
+		})
+
+		success := func() float64 {
+			return testutil.ToFloat64(metricsTotalRetainedSuccess.WithLabelValues(p.source, p.destination))
+		}
+		for start := time.Now(); time.Since(start) < 5*time.Second && success() < 2; {
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		cancel()
+		require.NoError(t, g.Wait())
+
+		require.GreaterOrEqual(t, success(), float64(2))
+		require.Equal(t, float64(0), testutil.ToFloat64(metricsTotalRetainedFailed.WithLabelValues(p.source, p.destination)))
+		require.Equal(t, float64(0), testutil.ToFloat64(metricsRetainedStaleness.WithLabelValues(p.source, p.destination)))
+
+		// The retained message is cleared when the probe stops.
+		_, err = probe.fetch(context.Background())
+		require.ErrorIs(t, err, errNoRetainedMessage)
+	}
+}
+
+func TestRetainedProbeFetchError(t *testing.T) {
+	broker := startTestBroker(t, nil)
+	pairs, err := generateBrokerPairs([]string{broker.tcp, "127.0.0.1:1"}, "retained-error", []byte{retainedQoS})
+	require.NoError(t, err)
+
+	p := pairs[0]
+	require.Equal(t, "127.0.0.1:1", p.destination)
+	probe := NewRetainedProbe(&p, time.Second, 600*time.Millisecond, brokerOptions{}, brokerOptions{})
+
+	var buf bytes.Buffer
+	probe.log = newDedupLogger(zerolog.New(&buf))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, probe.publisher.connect(ctx))
+	defer probe.publisher.disconnect()
+
+	probe.probe(ctx)
+	require.Contains(t, buf.String(), "retained probe unable to fetch from destination")
+	require.Contains(t, buf.String(), "retained message not received within 600ms")
+	require.Equal(t, float64(1), testutil.ToFloat64(metricsTotalRetainedFailed.WithLabelValues(p.source, p.destination)))
+}
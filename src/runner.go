@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// taskRestartBackoff is the time to wait before restarting a failed task,
+	// it is doubled for every failure in a row up to taskMaxRestartBackoff.
+	taskRestartBackoff    = time.Second
+	taskMaxRestartBackoff = time.Minute
+)
+
+// task is a ping client or probe started by the taskRunner.
+type task struct {
+	run func(ctx context.Context) error
+	// log is used to log the failures of the task.
+	log *dedupLogger
+	// cleanup is called when the task has been stopped after being removed,
+	// but not when the runner is shut down.
+	cleanup func()
+}
+
+type runningTask struct {
+	cancel  context.CancelFunc
+	doneCh  chan struct{}
+	cleanup func()
+}
+
+// taskRunner runs tasks until they are removed with update or the context is
+// cancelled. A task that returns is restarted with a backoff, without
+// affecting the other tasks.
+type taskRunner struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[string]*runningTask
+}
+
+func newTaskRunner(ctx context.Context) *taskRunner {
+	runnerCtx, cancel := context.WithCancel(ctx)
+
+	return &taskRunner{
+		ctx:     runnerCtx,
+		cancel:  cancel,
+		running: make(map[string]*runningTask),
+	}
+}
+
+// update stops the running tasks that aren't part of tasks and starts the
+// tasks that aren't running yet. Tasks with the same key keep running.
+func (r *taskRunner) update(tasks map[string]task) (int, int) {
+	stopped := r.remove(tasks)
+
+	// The removed tasks are stopped before starting new ones, as a task can
+	// be replaced by one using the same metrics. The lock isn't held while
+	// waiting, as stopping a task can take a while.
+	for _, rt := range stopped {
+		<-rt.doneCh
+		if rt.cleanup != nil {
+			rt.cleanup()
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	started := 0
+	for key, t := range tasks {
+		if _, ok := r.running[key]; ok {
+			continue
+		}
+		r.running[key] = r.start(t)
+		started++
+	}
+
+	return started, len(stopped)
+}
+
+// remove cancels the running tasks that aren't part of tasks and returns
+// them.
+func (r *taskRunner) remove(tasks map[string]task) []*runningTask {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var stopped []*runningTask
+	for key, rt := range r.running {
+		if _, ok := tasks[key]; ok {
+			continue
+		}
+		rt.cancel()
+		stopped = append(stopped, rt)
+		delete(r.running, key)
+	}
+
+	return stopped
+}
+
+func (r *taskRunner) start(t task) *runningTask {
+	ctx, cancel := context.WithCancel(r.ctx)
+	rt := &runningTask{
+		cancel:  cancel,
+		doneCh:  make(chan struct{}),
+		cleanup: t.cleanup,
+	}
+
+	log := t.log
+	if log == nil {
+		log = newDedupLogger(logger)
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer close(rt.doneCh)
+
+		backoff := taskRestartBackoff
+		for {
+			startedAt := time.Now()
+			err := t.run(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if err == nil {
+				err = errors.New("stopped without an error")
+			}
+			log.logError(err, "task failed and is restarted")
+
+			// A task that ran longer than the max backoff is restarted
+			// quickly again.
+			if time.Since(startedAt) > taskMaxRestartBackoff {
+				backoff = taskRestartBackoff
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+
+			backoff *= 2
+			if backoff > taskMaxRestartBackoff {
+				backoff = taskMaxRestartBackoff
+			}
+		}
+	}()
+
+	return rt
+}
+
+// Done is closed when the context is cancelled.
+func (r *taskRunner) Done() <-chan struct{} {
+	return r.ctx.Done()
+}
+
+// Wait stops all tasks and waits for them to return.
+func (r *taskRunner) Wait() {
+	r.cancel()
+	r.wg.Wait()
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testTaskLog struct {
+	mu      sync.Mutex
+	started []string
+	stopped []string
+	cleaned []string
+}
+
+func (l *testTaskLog) task(name string, err error) task {
+	return task{
+		run: func(ctx context.Context) error {
+			l.mu.Lock()
+			l.started = append(l.started, name)
+			l.mu.Unlock()
+
+			if err != nil {
+				return err
+			}
+
+			<-ctx.Done()
+
+			l.mu.Lock()
+			l.stopped = append(l.stopped, name)
+			l.mu.Unlock()
+
+			return nil
+		},
+		cleanup: func() {
+			l.mu.Lock()
+			l.cleaned = append(l.cleaned, name)
+			l.mu.Unlock()
+		},
+	}
+}
+
+func (l *testTaskLog) get() ([]string, []string, []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]string{}, l.started...), append([]string{}, l.stopped...), append([]string{}, l.cleaned...)
+}
+
+func TestTaskRunner(t *testing.T) {
+	log := &testTaskLog{}
+	runner := newTaskRunner(context.Background())
+
+	started, stopped := runner.update(map[string]task{
+		"a": log.task("a", nil),
+		"b": log.task("b", nil),
+	})
+	require.Equal(t, 2, started)
+	require.Equal(t, 0, stopped)
+
+	started, stopped = runner.update(map[string]task{
+		"b": log.task("b2", nil),
+		"c": log.task("c", nil),
+	})
+	require.Equal(t, 1, started)
+	require.Equal(t, 1, stopped)
+
+	require.Eventually(t, func() bool {
+		s, _, _ := log.get()
+		return len(s) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	s, st, c := log.get()
+	require.ElementsMatch(t, []string{"a", "b", "c"}, s)
+	require.Equal(t, []string{"a"}, st)
+	require.Equal(t, []string{"a"}, c)
+
+	runner.Wait()
+
+	_, st, c = log.get()
+	require.ElementsMatch(t, []string{"a", "b", "c"}, st)
+	require.Equal(t, []string{"a"}, c)
+}
+
+func TestTaskRunnerError(t *testing.T) {
+	current := taskRestartBackoff
+	taskRestartBackoff = 10 * time.Millisecond
+	defer func() {
+		taskRestartBackoff = current
+	}()
+
+	log := &testTaskLog{}
+	runner := newTaskRunner(context.Background())
+
+	runner.update(map[string]task{
+		"a": log.task("a", nil),
+		"b": log.task("b", fmt.Errorf("subscription not allowed")),
+	})
+
+	// The failed task is restarted while the other task keeps running.
+	require.Eventually(t, func() bool {
+		s, _, _ := log.get()
+		restarts := 0
+		for _, name := range s {
+			if name == "b" {
+				restarts++
+			}
+		}
+		return restarts >= 3
+	}, time.Second, 10*time.Millisecond)
+
+	select {
+	case <-runner.Done():
+		t.Fatalf("expected the runner to keep running after a task failed")
+	default:
+	}
+
+	s, st, _ := log.get()
+	require.Contains(t, s, "a")
+	require.Empty(t, st)
+
+	runner.Wait()
+
+	_, st, _ = log.get()
+	require.Equal(t, []string{"a"}, st)
+}
+
+func TestNewTasks(t *testing.T) {
+	cfg := config{
+		Brokers:               []string{"broker1:1883", "broker2:1883", "broker3:1883"},
+		ClientIDPrefix:        "mqtt-pinger",
+		PingInterval:          10,
+		ProtocolVersion:       "3.1.1",
+		QoS:                   []byte{0, 1},
+		RetainedProbe:         true,
+		RetainedProbeInterval: 60,
+		RetainedProbeTimeout:  10,
+		WillProbe:             true,
+		WillProbeInterval:     60,
+		WillProbeTimeout:      10,
+	}
+
+	tasks, err := newTasks(&cfg)
+	require.NoError(t, err)
+	// 6 pairs with 2 qos levels, 6 retained probes and 3 will probes
+	require.Len(t, tasks, 12+6+3)
+
+	same, err := newTasks(&cfg)
+	require.NoError(t, err)
+	require.ElementsMatch(t, taskKeys(tasks), taskKeys(same))
+
+	cfg.BrokerUsername = map[string]string{"broker3:1883": "other"}
+	changed, err := newTasks(&cfg)
+	require.NoError(t, err)
+
+	// Everything connecting to broker3 is restarted: the 4 ping pairs with
+	// broker3 as source, the 4 retained probes and all will probes.
+	require.Len(t, commonKeys(tasks, changed), 8+2)
+
+	cfg.SessionProbe = true
+	cfg.SessionProbeMessages = 0
+	_, err = newTasks(&cfg)
+	require.EqualError(t, err, "received 0 session probe messages but at least 1 is required")
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("ping_interval: 10"), 0o600))
+
+	changedCh := watchConfigFile(ctx, file, 10*time.Millisecond)
+
+	select {
+	case <-changedCh:
+		t.Fatalf("expected no change before the file is written")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, os.WriteFile(file, []byte("ping_interval: 5"), 0o600))
+
+	select {
+	case <-changedCh:
+	case <-time.After(time.Second):
+		t.Fatalf("expected a change after the file was written")
+	}
+}
+
+func TestTaskUpdater(t *testing.T) {
+	broker := startTestBroker(t, nil)
+	brokers := []string{broker.tcp, fmt.Sprintf("ws://%s/mqtt", broker.ws), fmt.Sprintf("mqtt://%s", broker.tcp)}
+
+	cfg := config{
+		Brokers:         brokers[:2],
+		ClientIDPrefix:  "reload",
+		PingInterval:    1,
+		ProtocolVersion: "3.1.1",
+	}
+
+	runner := newTaskRunner(context.Background())
+	updater := newTaskUpdater(runner, cfg)
+	require.NoError(t, updater.update())
+	require.Len(t, runner.running, 2)
+
+	initial := make(map[string]bool)
+	for key := range runner.running {
+		initial[key] = true
+	}
+
+	reload := func() (config, error) {
+		return cfg, nil
+	}
+
+	cfg.Brokers = brokers
+	updater.reload(reload, "test")
+	require.Len(t, runner.running, 6)
+	for key := range initial {
+		require.Contains(t, runner.running, key)
+	}
+
+	cfg.Brokers = []string{"invalid"}
+	updater.reload(reload, "test")
+	require.Len(t, runner.running, 6)
+
+	runner.Wait()
+}
+
+func TestChangedRestartSettings(t *testing.T) {
+	running := config{LogLevel: "info", PushRetries: 3, AlertWebhooks: []string{"https://alerts.example.com"}, PingInterval: 10}
+
+	cfg := running
+	require.Empty(t, changedRestartSettings(&running, &cfg))
+
+	cfg.PingInterval = 5
+	cfg.LogLevel = "debug"
+	cfg.PushRetries = 0
+	cfg.AlertWebhooks = nil
+	require.Equal(t, []string{"log-level", "push-retries", "alert-webhooks"}, changedRestartSettings(&running, &cfg))
+}
+
+func TestTaskUpdaterDiscovery(t *testing.T) {
+	cfg := config{
+		ClientIDPrefix:  "discovery",
+		PingInterval:    10,
+		ProtocolVersion: "3.1.1",
+		DNSDiscovery:    []string{"dns+broker:1883"},
+	}
+
+	// The tasks are never started as the context is already cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	runner := newTaskRunner(ctx)
+	updater := newTaskUpdater(runner, cfg)
+	require.NoError(t, updater.update())
+	require.Len(t, runner.running, 0)
+
+	updater.discover(discoveryUpdate{source: "dns+broker:1883", brokers: discovered("10.0.0.1:1883", "10.0.0.2:1883")})
+	require.Len(t, runner.running, 2)
+
+	updater.discover(discoveryUpdate{source: "dns+broker:1883", brokers: discovered("10.0.0.1:1883", "10.0.0.2:1883", "10.0.0.3:1883")})
+	require.Len(t, runner.running, 6)
+
+	updater.discover(discoveryUpdate{source: "dns+broker:1883", brokers: discovered("10.0.0.3:1883")})
+	require.Len(t, runner.running, 0)
+
+	runner.Wait()
+}
+
+func taskKeys(tasks map[string]task) []string {
+	keys := make([]string, 0, len(tasks))
+	for key := range tasks {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+func commonKeys(a map[string]task, b map[string]task) []string {
+	var keys []string
+	for key := range a {
+		if _, ok := b[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
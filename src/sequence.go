@@ -0,0 +1,194 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const sequenceWindow = 1024
+
+type sequenceResult int
+
+const (
+	sequenceInOrder sequenceResult = iota
+	sequenceOutOfOrder
+	sequenceDuplicate
+	sequenceLate
+)
+
+// sequenceTracker keeps track of the sequence numbers received from a single
+// sender and classifies every message as in order, out of order, duplicated
+// or late. A sequence number that has been missing for longer than
+// lossTimeout is considered lost, and if it is received after that it is
+// considered late. The sender is expected to send a message every interval,
+// so the messages after the last received one are also lost once they are
+// overdue by the loss timeout.
+type sequenceTracker struct {
+	mu             sync.Mutex
+	interval       time.Duration
+	lossTimeout    time.Duration
+	stream         string
+	highest        uint64
+	lastReceivedAt time.Time
+	// lostUpTo is the highest sequence number that is overdue and has been
+	// counted as lost.
+	lostUpTo uint64
+	received map[uint64]struct{}
+	missing  map[uint64]time.Time
+	lost     map[uint64]struct{}
+	// pendingLost are the sequence numbers that were dropped when the tracking
+	// started over or the window moved, returned by the next expire.
+	pendingLost int
+}
+
+func newSequenceTracker(interval time.Duration, lossTimeout time.Duration) *sequenceTracker {
+	return &sequenceTracker{
+		interval:    interval,
+		lossTimeout: lossTimeout,
+		received:    make(map[uint64]struct{}),
+		missing:     make(map[uint64]time.Time),
+		lost:        make(map[uint64]struct{}),
+	}
+}
+
+func (t *sequenceTracker) observe(stream string, seq uint64, now time.Time) sequenceResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// A new stream means the sender has restarted, and a gap larger than the
+	// window can't be tracked, so both start the tracking over. The missing
+	// sequence numbers, and those in the gap that weren't overdue yet, are
+	// lost.
+	if stream != t.stream || seq > t.highest+sequenceWindow {
+		t.pendingLost += len(t.missing)
+		if stream == t.stream && seq-1 > t.lostUpTo {
+			t.pendingLost += int(seq - 1 - t.lostUpTo)
+		}
+
+		t.reset(stream)
+		t.highest = seq
+		t.lostUpTo = seq
+		t.lastReceivedAt = now
+		t.received[seq] = struct{}{}
+		return sequenceInOrder
+	}
+
+	if _, ok := t.received[seq]; ok {
+		return sequenceDuplicate
+	}
+
+	if seq > t.highest {
+		for missing := t.highest + 1; missing < seq; missing++ {
+			if missing > t.lostUpTo {
+				t.missing[missing] = now
+			}
+		}
+
+		result := sequenceInOrder
+		if seq <= t.lostUpTo {
+			delete(t.lost, seq)
+			result = sequenceLate
+		} else {
+			t.lostUpTo = seq
+		}
+
+		t.highest = seq
+		t.lastReceivedAt = now
+		t.received[seq] = struct{}{}
+		t.prune()
+		return result
+	}
+
+	if _, ok := t.missing[seq]; ok {
+		delete(t.missing, seq)
+		t.received[seq] = struct{}{}
+		return sequenceOutOfOrder
+	}
+
+	if _, ok := t.lost[seq]; ok {
+		delete(t.lost, seq)
+		t.received[seq] = struct{}{}
+		return sequenceLate
+	}
+
+	// The sequence number is older than the window, which only happens if the
+	// message has already been received.
+	return sequenceDuplicate
+}
+
+// expire marks all sequence numbers that have been missing for longer than
+// the loss timeout, or that are overdue after the last received one, as lost
+// and returns how many were marked.
+func (t *sequenceTracker) expire(now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	count := t.pendingLost
+	t.pendingLost = 0
+	for seq, missingSince := range t.missing {
+		if now.Sub(missingSince) < t.lossTimeout {
+			continue
+		}
+
+		delete(t.missing, seq)
+		t.lost[seq] = struct{}{}
+		count++
+	}
+
+	if t.lastReceivedAt.IsZero() || t.interval <= 0 {
+		return count
+	}
+
+	// The message k intervals after the last received one is overdue once
+	// the loss timeout has passed since it was expected.
+	overdue := now.Sub(t.lastReceivedAt) - t.lossTimeout
+	if overdue < 0 {
+		return count
+	}
+	lostUpTo := t.highest + uint64(overdue/t.interval)
+	for seq := t.lostUpTo + 1; seq <= lostUpTo; seq++ {
+		// Only the window is kept, older ones are late when received.
+		if seq+sequenceWindow > lostUpTo {
+			t.lost[seq] = struct{}{}
+		}
+		count++
+	}
+	if lostUpTo > t.lostUpTo {
+		t.lostUpTo = lostUpTo
+	}
+
+	return count
+}
+
+func (t *sequenceTracker) reset(stream string) {
+	t.stream = stream
+	t.highest = 0
+	t.lostUpTo = 0
+	t.received = make(map[uint64]struct{})
+	t.missing = make(map[uint64]time.Time)
+	t.lost = make(map[uint64]struct{})
+}
+
+func (t *sequenceTracker) prune() {
+	if t.highest <= sequenceWindow {
+		return
+	}
+
+	oldest := t.highest - sequenceWindow
+	for seq := range t.received {
+		if seq < oldest {
+			delete(t.received, seq)
+		}
+	}
+	for seq := range t.missing {
+		if seq < oldest {
+			delete(t.missing, seq)
+			t.pendingLost++
+		}
+	}
+	for seq := range t.lost {
+		if seq < oldest {
+			delete(t.lost, seq)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSequenceTracker(t *testing.T) {
+	now := time.Now()
+	tracker := newSequenceTracker(time.Minute, 10*time.Second)
+
+	require.Equal(t, sequenceInOrder, tracker.observe("a", 1, now))
+	require.Equal(t, sequenceInOrder, tracker.observe("a", 2, now))
+	require.Equal(t, sequenceDuplicate, tracker.observe("a", 2, now))
+
+	// 3 and 4 are missing
+	require.Equal(t, sequenceInOrder, tracker.observe("a", 5, now))
+	require.Equal(t, 0, tracker.expire(now.Add(5*time.Second)))
+	require.Equal(t, sequenceOutOfOrder, tracker.observe("a", 3, now.Add(5*time.Second)))
+	require.Equal(t, sequenceDuplicate, tracker.observe("a", 3, now.Add(5*time.Second)))
+
+	// 4 is lost and then arrives late
+	require.Equal(t, 1, tracker.expire(now.Add(10*time.Second)))
+	require.Equal(t, 0, tracker.expire(now.Add(20*time.Second)))
+	require.Equal(t, sequenceLate, tracker.observe("a", 4, now.Add(20*time.Second)))
+	require.Equal(t, sequenceDuplicate, tracker.observe("a", 4, now.Add(20*time.Second)))
+
+	// a new stream starts over
+	require.Equal(t, sequenceInOrder, tracker.observe("b", 1, now))
+	require.Equal(t, sequenceInOrder, tracker.observe("b", 2, now))
+	require.Equal(t, sequenceDuplicate, tracker.observe("b", 1, now))
+}
+
+func TestSequenceTrackerWindow(t *testing.T) {
+	now := time.Now()
+	tracker := newSequenceTracker(time.Minute, 10*time.Second)
+
+	require.Equal(t, sequenceInOrder, tracker.observe("a", 1, now))
+	require.Equal(t, sequenceInOrder, tracker.observe("a", 3, now))
+	for seq := uint64(4); seq <= 2*sequenceWindow; seq++ {
+		require.Equal(t, sequenceInOrder, tracker.observe("a", seq, now))
+	}
+
+	require.Len(t, tracker.received, sequenceWindow+1)
+	require.Empty(t, tracker.missing)
+	require.Equal(t, sequenceDuplicate, tracker.observe("a", 1, now))
+
+	// a gap larger than the window starts over, counting 2 that was pruned
+	// from the window and the gap as lost
+	require.Equal(t, sequenceInOrder, tracker.observe("a", 4*sequenceWindow, now))
+	require.Empty(t, tracker.missing)
+	require.Equal(t, 1+2*sequenceWindow-1, tracker.expire(now.Add(time.Minute)))
+	require.Equal(t, 0, tracker.expire(now.Add(time.Minute)))
+}
+
+func TestSequenceTrackerOverdue(t *testing.T) {
+	now := time.Now()
+	tracker := newSequenceTracker(time.Second, 2*time.Second)
+
+	require.Equal(t, sequenceInOrder, tracker.observe("a", 1, now))
+	require.Equal(t, sequenceInOrder, tracker.observe("a", 2, now.Add(time.Second)))
+	require.Equal(t, 0, tracker.expire(now.Add(2*time.Second)))
+
+	// 3 is overdue, and 4 and 5 after that
+	require.Equal(t, 1, tracker.expire(now.Add(4*time.Second)))
+	require.Equal(t, 0, tracker.expire(now.Add(4*time.Second)))
+	require.Equal(t, 2, tracker.expire(now.Add(6*time.Second)))
+
+	// the overdue pings are late when they are received
+	require.Equal(t, sequenceLate, tracker.observe("a", 3, now.Add(6*time.Second)))
+	require.Equal(t, sequenceInOrder, tracker.observe("a", 6, now.Add(6*time.Second)))
+	require.Empty(t, tracker.missing)
+	require.Equal(t, sequenceLate, tracker.observe("a", 4, now.Add(6*time.Second)))
+	require.Equal(t, 0, tracker.expire(now.Add(6*time.Second)))
+
+	// the missing pings of a restarted sender are lost
+	require.Equal(t, sequenceInOrder, tracker.observe("a", 8, now.Add(7*time.Second)))
+	require.Equal(t, sequenceInOrder, tracker.observe("b", 1, now.Add(7*time.Second)))
+	require.Equal(t, 1, tracker.expire(now.Add(7*time.Second)))
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const sessionQoS = byte(1)
+
+var (
+	metricsTotalSessionDelivered = newCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_total_session_delivered",
+		Help: "Total number of messages queued in a persistent session that were delivered after reconnecting",
+	}, probeLabels)
+
+	metricsTotalSessionLost = newCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_total_session_lost",
+		Help: "Total number of messages queued in a persistent session that were not delivered before the timeout",
+	}, probeLabels)
+
+	metricsTotalSessionDuplicated = newCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_total_session_duplicated",
+		Help: "Total number of messages queued in a persistent session that were delivered more than once",
+	}, probeLabels)
+)
+
+// SessionProbe verifies that messages published on the source broker while a
+// client with a persistent session is offline are delivered exactly once when
+// it reconnects to the destination broker.
+type SessionProbe struct {
+	pair          brokerPair
+	sourceOpts    brokerOptions
+	destOpts      brokerOptions
+	topic         string
+	interval      time.Duration
+	timeout       time.Duration
+	messages      int
+	switchBroker  bool
+	sessionExpiry time.Duration
+	stream        string
+	round         uint64
+	log           *dedupLogger
+
+	mu       sync.Mutex
+	received map[uint64]int
+	doneCh   chan struct{}
+}
+
+func NewSessionProbe(p *brokerPair, interval time.Duration, timeout time.Duration, messages int, switchBroker bool, sourceOpts brokerOptions, destOpts brokerOptions) *SessionProbe {
+	probe := &SessionProbe{
+		pair:          *p,
+		sourceOpts:    sourceOpts,
+		destOpts:      destOpts,
+		topic:         fmt.Sprintf("mqtt_ping_session/%s/%s", p.base64Source, p.base64Destination),
+		interval:      interval,
+		timeout:       timeout,
+		messages:      messages,
+		switchBroker:  switchBroker,
+		sessionExpiry: 2*interval + timeout,
+		log:           newPairLogger(p),
+	}
+
+	metricsTotalSessionDelivered.WithLabelValues(probe.labelValues()...).Add(0)
+	metricsTotalSessionLost.WithLabelValues(probe.labelValues()...).Add(0)
+	metricsTotalSessionDuplicated.WithLabelValues(probe.labelValues()...).Add(0)
+
+	return probe
+}
+
+func (probe *SessionProbe) Run(ctx context.Context) error {
+	defer probe.clearSession(5 * time.Second)
+
+	probe.log.Info().Str("interval", probe.interval.String()).Int("messages", probe.messages).Msg("session probe started")
+
+	ticker := time.NewTicker(probe.interval)
+	defer ticker.Stop()
+
+	for {
+		err := probe.probe(ctx)
+		if err != nil && ctx.Err() == nil {
+			probe.log.logError(err, "session probe failed")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (probe *SessionProbe) probe(ctx context.Context) error {
+	probe.round++
+	probe.reset(fmt.Sprintf("%s-%d", probe.pair.clientID, time.Now().UnixNano()))
+
+	// The session is created on the source broker when switching brokers,
+	// to verify that it is taken over by the destination broker.
+	sessionBroker, sessionOpts := probe.pair.destination, probe.destOpts
+	if probe.switchBroker {
+		sessionBroker, sessionOpts = probe.pair.source, probe.sourceOpts
+	}
+
+	err := probe.subscribe(ctx, sessionBroker, sessionOpts)
+	if err != nil {
+		return fmt.Errorf("unable to create session: %w", err)
+	}
+
+	err = probe.publish(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to publish while offline: %w", err)
+	}
+
+	conn := newConnection(probe.sessionConnectionOptions(probe.pair.destination, probe.destOpts, probe.messageHandler))
+	defer conn.disconnect()
+
+	err = conn.connect(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to resume session: %w", err)
+	}
+
+	timer := time.NewTimer(probe.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-timer.C:
+	case <-probe.doneCh:
+	}
+
+	probe.observe()
+
+	return nil
+}
+
+// subscribe creates the persistent session with a subscription and
+// disconnects, leaving the session on the broker.
+func (probe *SessionProbe) subscribe(ctx context.Context, broker string, opts brokerOptions) error {
+	conn := newConnection(probe.sessionConnectionOptions(broker, opts, nil))
+	defer conn.disconnect()
+
+	err := conn.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	subscribeCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	return conn.subscribe(subscribeCtx, probe.topic, sessionQoS, func([]byte) {})
+}
+
+func (probe *SessionProbe) publish(ctx context.Context) error {
+	connOpts := probe.sourceOpts.connectionOptions(probe.pair.source, fmt.Sprintf("%s-p%d", probe.pair.clientID, probe.round))
+	connOpts.cleanSession = true
+	conn := newConnection(connOpts)
+	defer conn.disconnect()
+
+	err := conn.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	for seq := 1; seq <= probe.messages; seq++ {
+		payload, err := newPingPayload(probe.stream, uint64(seq))
+		if err != nil {
+			return err
+		}
+
+		b, err := payload.encode()
+		if err != nil {
+			return err
+		}
+
+		publishCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+		err = conn.publish(publishCtx, probe.topic, sessionQoS, false, b)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (probe *SessionProbe) sessionConnectionOptions(broker string, opts brokerOptions, handler messageHandler) connectionOptions {
+	connOpts := opts.connectionOptions(broker, probe.pair.clientID)
+	connOpts.cleanSession = false
+	connOpts.sessionExpiry = probe.sessionExpiry
+	connOpts.onError = probe.connectionError
+	if handler != nil {
+		connOpts.routes = map[string]messageHandler{probe.topic: handler}
+	}
+
+	return connOpts
+}
+
+func (probe *SessionProbe) reset(stream string) {
+	probe.mu.Lock()
+	defer probe.mu.Unlock()
+
+	probe.stream = stream
+	probe.received = make(map[uint64]int)
+	probe.doneCh = make(chan struct{})
+}
+
+func (probe *SessionProbe) messageHandler(b []byte) {
+	payload, err := decodePingPayload(b)
+	if err != nil {
+		probe.log.Warn().Err(err).Str("payload", string(b)).Msg("expected to receive a session payload")
+		return
+	}
+
+	probe.mu.Lock()
+	defer probe.mu.Unlock()
+
+	// Messages queued by earlier rounds are ignored.
+	if payload.Stream != probe.stream {
+		return
+	}
+
+	probe.received[payload.Sequence]++
+	if len(probe.received) == probe.messages && probe.received[payload.Sequence] == 1 {
+		close(probe.doneCh)
+	}
+}
+
+func (probe *SessionProbe) observe() {
+	probe.mu.Lock()
+	defer probe.mu.Unlock()
+
+	var delivered, duplicated int
+	for seq := 1; seq <= probe.messages; seq++ {
+		count := probe.received[uint64(seq)]
+		if count > 0 {
+			delivered++
+		}
+		if count > 1 {
+			duplicated += count - 1
+		}
+	}
+	lost := probe.messages - delivered
+
+	metricsTotalSessionDelivered.add(float64(delivered), probe.labelValues()...)
+	metricsTotalSessionLost.add(float64(lost), probe.labelValues()...)
+	metricsTotalSessionDuplicated.add(float64(duplicated), probe.labelValues()...)
+
+	if lost > 0 {
+		probe.log.logError(nil, fmt.Sprintf("%d of %d queued messages not delivered", lost, probe.messages))
+	}
+}
+
+// clearSession removes the persistent session from the destination broker.
+func (probe *SessionProbe) clearSession(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	connOpts := probe.destOpts.connectionOptions(probe.pair.destination, probe.pair.clientID)
+	connOpts.cleanSession = true
+	conn := newConnection(connOpts)
+
+	err := conn.connect(ctx)
+	if err != nil {
+		probe.log.logError(err, "unable to clear session")
+	}
+
+	conn.disconnect()
+}
+
+func (probe *SessionProbe) labelValues() []string {
+	return []string{probe.pair.source, probe.pair.destination}
+}
+
+func (probe *SessionProbe) connectionError(err error) {
+	probe.log.logError(err, "session probe connection error")
+}
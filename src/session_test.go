@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionProbe(t *testing.T) {
+	cases := []struct {
+		testDescription string
+		protocolVersion string
+		switchBroker    bool
+		separateBrokers bool
+		expectedLost    float64
+	}{
+		{
+			testDescription: "mqtt 3.1.1",
+			protocolVersion: protocolVersion311,
+		},
+		{
+			testDescription: "mqtt 5",
+			protocolVersion: protocolVersion5,
+		},
+		{
+			testDescription: "mqtt 5 switching broker",
+			protocolVersion: protocolVersion5,
+			switchBroker:    true,
+		},
+		{
+			testDescription: "mqtt 3.1.1 switching to a broker without the session",
+			protocolVersion: protocolVersion311,
+			switchBroker:    true,
+			separateBrokers: true,
+			expectedLost:    5,
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+
+		source := startTestBroker(t, nil)
+		destination := source
+		if c.separateBrokers {
+			destination = startTestBroker(t, nil)
+		}
+
+		p, err := newBrokerPair(source.tcp, fmt.Sprintf("ws://%s/mqtt", destination.ws), fmt.Sprintf("session-%d", i), sessionQoS)
+		require.NoError(t, err)
+
+		opts := brokerOptions{protocolVersion: c.protocolVersion}
+		probe := NewSessionProbe(&p, time.Minute, time.Second, 5, c.switchBroker, opts, opts)
+		require.NoError(t, probe.probe(context.Background()))
+		probe.clearSession(time.Second)
+
+		require.Equal(t, 5-c.expectedLost, testutil.ToFloat64(metricsTotalSessionDelivered.WithLabelValues(p.source, p.destination)))
+		require.Equal(t, c.expectedLost, testutil.ToFloat64(metricsTotalSessionLost.WithLabelValues(p.source, p.destination)))
+		require.Equal(t, float64(0), testutil.ToFloat64(metricsTotalSessionDuplicated.WithLabelValues(p.source, p.destination)))
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type sinkKind int
+
+const (
+	sinkCount sinkKind = iota
+	sinkTiming
+	sinkGauge
+)
+
+// sinkMeasurement is a single counter increment, observed duration or gauge
+// value. Timings are in seconds.
+type sinkMeasurement struct {
+	name  string
+	kind  sinkKind
+	value float64
+	tags  []sinkTag
+	at    time.Time
+}
+
+type sinkTag struct {
+	name  string
+	value string
+}
+
+// metricSink receives the measurements besides the prometheus metrics.
+type metricSink interface {
+	name() string
+	record(m sinkMeasurement)
+	// run sends the measurements until the context is cancelled.
+	run(ctx context.Context)
+}
+
+// sinks are the metric sinks all measurements are recorded to.
+var sinks = &sinkSet{}
+
+type sinkSet struct {
+	mu    sync.RWMutex
+	sinks []metricSink
+}
+
+func (s *sinkSet) set(sinks []metricSink) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sinks = sinks
+}
+
+func (s *sinkSet) record(name string, kind sinkKind, value float64, labels []string, values []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.sinks) == 0 {
+		return
+	}
+
+	m := sinkMeasurement{
+		name:  name,
+		kind:  kind,
+		value: value,
+		tags:  sinkTags(labels, values),
+		at:    time.Now(),
+	}
+	for _, sink := range s.sinks {
+		sink.record(m)
+	}
+}
+
+// sinkTags returns the labels of the measurement with the same broker and
+// external labels as the prometheus metrics, sorted by name.
+func sinkTags(labels []string, values []string) []sinkTag {
+	metric := &dto.Metric{}
+	for i := range labels {
+		metric.Label = append(metric.Label, &dto.LabelPair{Name: &labels[i], Value: &values[i]})
+	}
+	currentMetricLabels.Load().apply([]*dto.MetricFamily{{Metric: []*dto.Metric{metric}}})
+
+	tags := make([]sinkTag, 0, len(metric.Label))
+	for _, pair := range metric.Label {
+		tags = append(tags, sinkTag{pair.GetName(), pair.GetValue()})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].name < tags[j].name
+	})
+
+	return tags
+}
+
+// newSinks returns the configured metric sinks.
+func newSinks(cfg *config) ([]metricSink, error) {
+	var result []metricSink
+	if cfg.StatsDAddress != "" {
+		sink, err := newStatsdSink(cfg.StatsDAddress, cfg.StatsDPrefix)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, sink)
+	}
+
+	if cfg.InfluxDBURL != "" {
+		if cfg.InfluxDBFlushInterval < 1 {
+			return nil, fmt.Errorf("received influxdb flush interval %d but it has to be at least 1", cfg.InfluxDBFlushInterval)
+		}
+
+		sink, err := newInfluxDBSink(cfg.InfluxDBURL, cfg.InfluxDBToken, time.Duration(cfg.InfluxDBFlushInterval)*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, sink)
+	}
+
+	return result, nil
+}
+
+// counterVec is a prometheus counter that is also recorded to the sinks.
+type counterVec struct {
+	*prometheus.CounterVec
+	name   string
+	labels []string
+}
+
+func newCounterVec(opts prometheus.CounterOpts, labels []string) *counterVec {
+	return &counterVec{
+		CounterVec: promauto.NewCounterVec(opts, labels),
+		name:       opts.Name,
+		labels:     labels,
+	}
+}
+
+func (v *counterVec) inc(values ...string) {
+	v.add(1, values...)
+}
+
+func (v *counterVec) add(delta float64, values ...string) {
+	v.WithLabelValues(values...).Add(delta)
+	sinks.record(v.name, sinkCount, delta, v.labels, values)
+}
+
+// histogramVec is a prometheus histogram of durations in seconds that are
+// also recorded to the sinks as timings.
+type histogramVec struct {
+	*prometheus.HistogramVec
+	name   string
+	labels []string
+}
+
+func newHistogramVec(opts prometheus.HistogramOpts, labels []string) *histogramVec {
+	return &histogramVec{
+		HistogramVec: promauto.NewHistogramVec(opts, labels),
+		name:         opts.Name,
+		labels:       labels,
+	}
+}
+
+func (v *histogramVec) observe(seconds float64, values ...string) {
+	v.WithLabelValues(values...).Observe(seconds)
+	sinks.record(v.name, sinkTiming, seconds, v.labels, values)
+}
+
+// gaugeVec is a prometheus gauge that is also recorded to the sinks.
+type gaugeVec struct {
+	*prometheus.GaugeVec
+	name   string
+	labels []string
+}
+
+func newGaugeVec(opts prometheus.GaugeOpts, labels []string) *gaugeVec {
+	return &gaugeVec{
+		GaugeVec: promauto.NewGaugeVec(opts, labels),
+		name:     opts.Name,
+		labels:   labels,
+	}
+}
+
+func (v *gaugeVec) set(value float64, values ...string) {
+	v.WithLabelValues(values...).Set(value)
+	sinks.record(v.name, sinkGauge, value, v.labels, values)
+}
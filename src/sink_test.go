@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsdLine(t *testing.T) {
+	tags := []sinkTag{{"destination", "broker2:1883"}, {"qos", "0"}, {"source", "tcp://broker1:1883"}, {"zone", "a,b"}}
+	cases := []struct {
+		testDescription string
+		prefix          string
+		measurement     sinkMeasurement
+		expectedLine    string
+	}{
+		{
+			testDescription: "count",
+			measurement:     sinkMeasurement{name: "mqtt_total_received_ping", kind: sinkCount, value: 1, tags: tags},
+			expectedLine:    "mqtt_total_received_ping:1|c|#destination:broker2:1883,qos:0,source:tcp://broker1:1883,zone:a_b",
+		},
+		{
+			testDescription: "timing in milliseconds",
+			prefix:          "pinger.",
+			measurement:     sinkMeasurement{name: "mqtt_ping_latency_seconds", kind: sinkTiming, value: 0.0025},
+			expectedLine:    "pinger.mqtt_ping_latency_seconds:2.5|ms",
+		},
+		{
+			testDescription: "gauge",
+			measurement:     sinkMeasurement{name: "mqtt_ping_last_latency_seconds", kind: sinkGauge, value: 0.5, tags: tags[1:2]},
+			expectedLine:    "mqtt_ping_last_latency_seconds:0.5|g|#qos:0",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+		require.Equal(t, c.expectedLine, statsdLine(c.prefix, c.measurement))
+	}
+}
+
+func TestInfluxDBLine(t *testing.T) {
+	at := time.Unix(1662026400, 5)
+	cases := []struct {
+		testDescription string
+		measurement     sinkMeasurement
+		expectedLine    string
+	}{
+		{
+			testDescription: "count",
+			measurement:     sinkMeasurement{name: "mqtt_total_received_ping", kind: sinkCount, value: 1, tags: []sinkTag{{"destination", "broker2:1883"}, {"qos", "0"}}, at: at},
+			expectedLine:    "mqtt_total_received_ping,destination=broker2:1883,qos=0 value=1 1662026400000000005",
+		},
+		{
+			testDescription: "escaped backslashes",
+			measurement:     sinkMeasurement{name: "mqtt_total_received_ping", kind: sinkCount, value: 1, tags: []sinkTag{{"path", `C:\`}, {"qos", "0"}}, at: at},
+			expectedLine:    `mqtt_total_received_ping,path=C:\\,qos=0 value=1 1662026400000000005`,
+		},
+		{
+			testDescription: "escaped tags",
+			measurement:     sinkMeasurement{name: "mqtt_ping_latency_seconds", kind: sinkTiming, value: 0.0025, tags: []sinkTag{{"empty", ""}, {"zone", "a b,c=d"}}, at: at},
+			expectedLine:    `mqtt_ping_latency_seconds,zone=a\ b\,c\=d value=0.0025 1662026400000000005`,
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+		require.Equal(t, c.expectedLine, influxDBLine(c.measurement))
+	}
+}
+
+func TestSinks(t *testing.T) {
+	current := currentMetricLabels.Load()
+	defer currentMetricLabels.Store(current)
+	defer sinks.set(nil)
+
+	labels, err := newMetricLabels(&config{
+		ExternalLabels: map[string]string{"cluster": "prod"},
+		brokerAliases:  map[string]string{"sink1:1883": "node-1"},
+	})
+	require.NoError(t, err)
+	currentMetricLabels.Store(labels)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	statsd, err := newStatsdSink(conn.LocalAddr().String(), "")
+	require.NoError(t, err)
+
+	receiver, url := startTestReceiver(t, http.StatusServiceUnavailable)
+	influxDB, err := newInfluxDBSink(url+"/api/v2/write?org=org&bucket=mqtt", "influx-token", time.Minute)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go statsd.run(ctx)
+
+	sinks.set([]metricSink{statsd, influxDB})
+	metricsTotalReceivedPing.inc("sink1:1883", "sink2:1883", "0")
+	metricsPingLatency.observe(0.002, "sink1:1883", "sink2:1883", "0")
+
+	expectedStatsd := []string{
+		"mqtt_total_received_ping:1|c|#cluster:prod,destination:sink2:1883,qos:0,source:node-1",
+		"mqtt_ping_latency_seconds:2|ms|#cluster:prod,destination:sink2:1883,qos:0,source:node-1",
+	}
+	buf := make([]byte, 1024)
+	for _, expected := range expectedStatsd {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, expected, string(buf[:n]))
+	}
+
+	// The lines are kept when influxdb is unavailable.
+	influxDB.flush(ctx)
+	require.Len(t, influxDB.lines, 2)
+
+	influxDB.flush(ctx)
+	require.Empty(t, influxDB.lines)
+
+	requests, bodies := receiver.received()
+	require.Len(t, requests, 1)
+	require.Equal(t, "Token influx-token", requests[0].Header.Get("Authorization"))
+	require.Equal(t, "bucket=mqtt&org=org", requests[0].URL.Query().Encode())
+
+	lines := strings.Split(strings.TrimSpace(string(bodies[0])), "\n")
+	require.Len(t, lines, 2)
+	require.True(t, strings.HasPrefix(lines[0], "mqtt_total_received_ping,cluster=prod,destination=sink2:1883,qos=0,source=node-1 value=1 "), lines[0])
+	require.True(t, strings.HasPrefix(lines[1], "mqtt_ping_latency_seconds,cluster=prod,destination=sink2:1883,qos=0,source=node-1 value=0.002 "), lines[1])
+}
+
+func TestNewSinksErrors(t *testing.T) {
+	cases := []struct {
+		testDescription string
+		cfg             config
+		expectedErr     string
+	}{
+		{
+			testDescription: "invalid statsd address",
+			cfg:             config{StatsDAddress: "statsd"},
+			expectedErr:     "statsd address \"statsd\" should be like host:port: address statsd: missing port in address",
+		},
+		{
+			testDescription: "invalid influxdb url",
+			cfg:             config{InfluxDBURL: "influxdb:8086", InfluxDBFlushInterval: 10},
+			expectedErr:     "influxdb url \"influxdb:8086\" should be a url like http://host:port",
+		},
+		{
+			testDescription: "invalid influxdb flush interval",
+			cfg:             config{InfluxDBURL: "http://influxdb:8086/api/v2/write"},
+			expectedErr:     "received influxdb flush interval 0 but it has to be at least 1",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+		_, err := newSinks(&c.cfg)
+		require.EqualError(t, err, c.expectedErr)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// statsdSink sends every measurement as a statsd line over udp, with the
+// labels as dogstatsd tags. Timings are sent in milliseconds.
+type statsdSink struct {
+	conn   net.Conn
+	prefix string
+	log    *dedupLogger
+}
+
+func newStatsdSink(address string, prefix string) (*statsdSink, error) {
+	_, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("statsd address %q should be like host:port: %w", address, err)
+	}
+
+	// Dialing udp doesn't send anything, so an unavailable server doesn't
+	// prevent starting.
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create statsd connection: %w", err)
+	}
+
+	return &statsdSink{
+		conn:   conn,
+		prefix: prefix,
+		log:    newDedupLogger(logger.With().Str("sink", "statsd").Logger()),
+	}, nil
+}
+
+func (s *statsdSink) name() string {
+	return "statsd"
+}
+
+func (s *statsdSink) record(m sinkMeasurement) {
+	_, err := s.conn.Write([]byte(statsdLine(s.prefix, m)))
+	if err != nil {
+		s.log.logError(err, "unable to send metric to statsd")
+	}
+}
+
+func (s *statsdSink) run(ctx context.Context) {
+	<-ctx.Done()
+	s.conn.Close()
+}
+
+func statsdLine(prefix string, m sinkMeasurement) string {
+	value := m.value
+	var kind string
+	switch m.kind {
+	case sinkCount:
+		kind = "c"
+	case sinkTiming:
+		value *= 1000
+		kind = "ms"
+	case sinkGauge:
+		kind = "g"
+	}
+
+	var b strings.Builder
+	b.WriteString(prefix)
+	b.WriteString(m.name)
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	b.WriteByte('|')
+	b.WriteString(kind)
+
+	for i, tag := range m.tags {
+		if i == 0 {
+			b.WriteString("|#")
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(tag.name)
+		b.WriteByte(':')
+		b.WriteString(statsdTagValue(tag.value))
+	}
+
+	return b.String()
+}
+
+// statsdTagValue replaces the characters separating the tags and fields of
+// a dogstatsd line.
+func statsdTagValue(s string) string {
+	return strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_").Replace(s)
+}
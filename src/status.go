@@ -0,0 +1,290 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// recentPingResults is the number of ping results the recent success ratio
+// is calculated from.
+const recentPingResults = 20
+
+const (
+	connectionConnecting   = "connecting"
+	connectionConnected    = "connected"
+	connectionDisconnected = "disconnected"
+)
+
+// pairState is the current state of a ping client, reported by the status
+// endpoint.
+type pairState struct {
+	mu                sync.Mutex
+	connection        string
+	lastSuccess       time.Time
+	lastFailure       time.Time
+	lastFailureReason string
+	results           []bool
+	latency           time.Duration
+	receivedPings     uint64
+	failedPings       uint64
+
+	health               pairHealth
+	consecutiveSuccesses int
+	consecutiveFailures  int
+	// onHealthChange is called with the lock held when the health changes,
+	// so it must not block.
+	onHealthChange func(c healthChange)
+}
+
+func newPairState() *pairState {
+	return &pairState{
+		connection: connectionConnecting,
+		health:     healthUnknown,
+	}
+}
+
+func (s *pairState) connected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.connection = connectionConnected
+}
+
+func (s *pairState) disconnected(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.connection = connectionDisconnected
+	s.failure(reason)
+}
+
+// succeeded records a received ping.
+func (s *pairState) succeeded(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastSuccess = time.Now()
+	s.latency = latency
+	s.receivedPings++
+	s.observe(true)
+	s.updateHealth()
+}
+
+// failed records pings that were not received, the reason is kept even
+// without any pings, like for failed publishes that will later be counted as
+// lost.
+func (s *pairState) failed(pings int, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failure(reason)
+	for i := 0; i < pings; i++ {
+		s.failedPings++
+		s.observe(false)
+	}
+	if pings > 0 {
+		s.updateHealth()
+	}
+}
+
+func (s *pairState) failure(reason string) {
+	s.lastFailure = time.Now()
+	s.lastFailureReason = reason
+}
+
+func (s *pairState) observe(success bool) {
+	s.results = append(s.results, success)
+	if len(s.results) > recentPingResults {
+		s.results = s.results[len(s.results)-recentPingResults:]
+	}
+
+	if success {
+		s.consecutiveSuccesses++
+		s.consecutiveFailures = 0
+	} else {
+		s.consecutiveFailures++
+		s.consecutiveSuccesses = 0
+	}
+}
+
+// updateHealth moves the pair between up, degraded and down based on the
+// recent pings, a down pair only recovers after enough pings succeeded in a
+// row.
+func (s *pairState) updateHealth() {
+	successes := 0
+	for _, success := range s.results {
+		if success {
+			successes++
+		}
+	}
+	successRatio := float64(successes) / float64(len(s.results))
+
+	t := healthThresholds
+	health := healthUp
+	switch {
+	case s.consecutiveFailures >= t.downAfter:
+		health = healthDown
+	case s.health == healthDown && s.consecutiveSuccesses < t.upAfter:
+		health = healthDown
+	case len(s.results) >= minHealthResults && successRatio < t.degradedRatio:
+		health = healthDegraded
+	}
+
+	if health == s.health {
+		return
+	}
+
+	change := healthChange{
+		from:         s.health,
+		to:           health,
+		successRatio: successRatio,
+		at:           time.Now(),
+	}
+	if health != healthUp {
+		change.reason = s.lastFailureReason
+	}
+	s.health = health
+
+	if s.onHealthChange != nil {
+		s.onHealthChange(change)
+	}
+}
+
+type statusResponse struct {
+	Pairs   []statusPair   `json:"pairs"`
+	Brokers []statusBroker `json:"brokers"`
+}
+
+type statusPair struct {
+	Source         string     `json:"source"`
+	Destination    string     `json:"destination"`
+	QoS            byte       `json:"qos"`
+	Connection     string     `json:"connection"`
+	LastSuccess    *time.Time `json:"last_success"`
+	LastFailure    *time.Time `json:"last_failure"`
+	FailureReason  string     `json:"last_failure_reason,omitempty"`
+	SuccessRatio   *float64   `json:"success_ratio"`
+	LatencySeconds *float64   `json:"latency_seconds"`
+	Received       uint64     `json:"received"`
+	Failed         uint64     `json:"failed"`
+	Health         pairHealth `json:"health"`
+
+	successes int
+	results   int
+}
+
+// statusBroker aggregates the pairs a broker is either the source or the
+// destination of.
+type statusBroker struct {
+	Broker       string     `json:"broker"`
+	Pairs        int        `json:"pairs"`
+	Connected    int        `json:"connected"`
+	Connections  int        `json:"connections"`
+	LastSuccess  *time.Time `json:"last_success"`
+	SuccessRatio *float64   `json:"success_ratio"`
+
+	successes int
+	results   int
+}
+
+func (s *pairState) status(pair brokerPair) statusPair {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := statusPair{
+		Source:        pair.source,
+		Destination:   pair.destination,
+		QoS:           pair.qos,
+		Connection:    s.connection,
+		FailureReason: redact(s.lastFailureReason),
+		Received:      s.receivedPings,
+		Failed:        s.failedPings,
+		Health:        s.health,
+		results:       len(s.results),
+	}
+
+	if !s.lastSuccess.IsZero() {
+		lastSuccess := s.lastSuccess
+		status.LastSuccess = &lastSuccess
+		latency := s.latency.Seconds()
+		status.LatencySeconds = &latency
+	}
+
+	if !s.lastFailure.IsZero() {
+		lastFailure := s.lastFailure
+		status.LastFailure = &lastFailure
+	}
+
+	for _, success := range s.results {
+		if success {
+			status.successes++
+		}
+	}
+	status.SuccessRatio = ratio(status.successes, status.results)
+
+	return status
+}
+
+func (r *pingClientRegistry) status() statusResponse {
+	res := statusResponse{
+		Pairs:   []statusPair{},
+		Brokers: []statusBroker{},
+	}
+
+	brokers := make(map[string]*statusBroker)
+	broker := func(name string) *statusBroker {
+		b, ok := brokers[name]
+		if !ok {
+			b = &statusBroker{Broker: name}
+			brokers[name] = b
+		}
+		return b
+	}
+
+	for _, client := range r.list() {
+		pair := client.state.status(client.pair)
+		res.Pairs = append(res.Pairs, pair)
+
+		// The ping client is only connected to the source.
+		source := broker(pair.Source)
+		source.Connections++
+		if pair.Connection == connectionConnected {
+			source.Connected++
+		}
+
+		for _, b := range []*statusBroker{source, broker(pair.Destination)} {
+			b.Pairs++
+			b.successes += pair.successes
+			b.results += pair.results
+			if pair.LastSuccess != nil && (b.LastSuccess == nil || pair.LastSuccess.After(*b.LastSuccess)) {
+				b.LastSuccess = pair.LastSuccess
+			}
+		}
+	}
+
+	for _, b := range brokers {
+		b.SuccessRatio = ratio(b.successes, b.results)
+		res.Brokers = append(res.Brokers, *b)
+	}
+	sort.Slice(res.Brokers, func(i, j int) bool {
+		return res.Brokers[i].Broker < res.Brokers[j].Broker
+	})
+
+	return res
+}
+
+func (r *pingClientRegistry) statusHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, r.status())
+}
+
+func ratio(successes int, results int) *float64 {
+	if results == 0 {
+		return nil
+	}
+
+	ratio := float64(successes) / float64(results)
+
+	return &ratio
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPairState(t *testing.T) {
+	state := newPairState()
+	pair := brokerPair{source: "broker1:1883", destination: "broker2:1883", qos: 1}
+
+	status := state.status(pair)
+	require.Equal(t, connectionConnecting, status.Connection)
+	require.Nil(t, status.LastSuccess)
+	require.Nil(t, status.LastFailure)
+	require.Nil(t, status.SuccessRatio)
+	require.Nil(t, status.LatencySeconds)
+
+	state.connected()
+	for i := 0; i < recentPingResults; i++ {
+		state.failed(1, "no ping received within 20s")
+	}
+	state.succeeded(20 * time.Millisecond)
+	state.succeeded(10 * time.Millisecond)
+	state.failed(0, "publish failed: not connected")
+	state.disconnected("connection lost: EOF")
+
+	status = state.status(pair)
+	require.Equal(t, connectionDisconnected, status.Connection)
+	require.NotNil(t, status.LastSuccess)
+	require.NotNil(t, status.LastFailure)
+	require.Equal(t, "connection lost: EOF", status.FailureReason)
+	require.Equal(t, 0.01, *status.LatencySeconds)
+	// Only the recent results are used for the ratio.
+	require.Equal(t, 0.1, *status.SuccessRatio)
+	require.Equal(t, uint64(2), status.Received)
+	require.Equal(t, uint64(recentPingResults), status.Failed)
+}
+
+func TestStatusHandler(t *testing.T) {
+	registry := newPingClientRegistry()
+	newClient := func(source string, destination string) *PingClient {
+		p := brokerPair{source: source, destination: destination, clientID: "status"}
+		client := NewPingClient(&p, time.Second, brokerOptions{})
+		registry.add(client)
+		return client
+	}
+
+	a := newClient("broker1:1883", "broker2:1883")
+	a.state.connected()
+	a.state.succeeded(5 * time.Millisecond)
+	a.state.succeeded(5 * time.Millisecond)
+	a.state.succeeded(5 * time.Millisecond)
+
+	b := newClient("broker2:1883", "broker1:1883")
+	b.state.disconnected("connection lost: EOF")
+	b.state.failed(1, "no ping received within 2s")
+
+	rec := httptest.NewRecorder()
+	registry.statusHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/status", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var res statusResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+
+	require.Len(t, res.Pairs, 2)
+	require.Equal(t, "broker1:1883", res.Pairs[0].Source)
+	require.Equal(t, connectionConnected, res.Pairs[0].Connection)
+	require.Equal(t, 1.0, *res.Pairs[0].SuccessRatio)
+	require.Equal(t, "broker2:1883", res.Pairs[1].Source)
+	require.Equal(t, connectionDisconnected, res.Pairs[1].Connection)
+	require.Equal(t, "no ping received within 2s", res.Pairs[1].FailureReason)
+	require.Equal(t, 0.0, *res.Pairs[1].SuccessRatio)
+	require.Nil(t, res.Pairs[1].LastSuccess)
+
+	require.Len(t, res.Brokers, 2)
+	for _, broker := range res.Brokers {
+		require.Equal(t, 2, broker.Pairs)
+		require.Equal(t, 1, broker.Connections)
+		require.Equal(t, 0.75, *broker.SuccessRatio)
+		require.NotNil(t, broker.LastSuccess)
+	}
+	require.Equal(t, 1, res.Brokers[0].Connected)
+	require.Equal(t, 0, res.Brokers[1].Connected)
+
+	rec = httptest.NewRecorder()
+	newPingClientRegistry().statusHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/status", nil))
+	require.JSONEq(t, `{"pairs":[],"brokers":[]}`, rec.Body.String())
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// newTasks returns the ping clients and probes to run for the config. The
+// tasks are keyed by everything they are created from, so that a task is only
+// restarted when its brokers or settings change.
+func newTasks(cfg *config) (map[string]task, error) {
+	if cfg.SessionProbe && cfg.SessionProbeMessages < 1 {
+		return nil, fmt.Errorf("received %d session probe messages but at least 1 is required", cfg.SessionProbeMessages)
+	}
+
+	pairs, err := generateBrokerPairs(cfg.Brokers, cfg.ClientIDPrefix, cfg.qosLevels())
+	if err != nil {
+		return nil, err
+	}
+
+	brokerOpts, err := newBrokerOptionsMap(cfg, cfg.Brokers)
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := make(map[string]task)
+	pingInterval := time.Duration(cfg.PingInterval) * time.Second
+	for i := range pairs {
+		p := &pairs[i]
+		opts := brokerOpts[p.source]
+		key := taskKey("ping", p.source, p.destination, p.qos, pingInterval, opts.settings)
+		state := newPingPairState(p)
+		tasks[key] = task{
+			run: func(ctx context.Context) error {
+				return newPingClient(p, pingInterval, opts, state, nil).Run(ctx)
+			},
+			log: newPairLogger(p),
+			cleanup: func() {
+				deletePingMetrics(p)
+				alerts.remove(p)
+				pingClients.removePair(p)
+			},
+		}
+	}
+
+	if cfg.RetainedProbe {
+		retainedPairs, err := generateBrokerPairs(cfg.Brokers, cfg.ClientIDPrefix+"-retained", []byte{retainedQoS})
+		if err != nil {
+			return nil, err
+		}
+
+		interval := time.Duration(cfg.RetainedProbeInterval) * time.Second
+		timeout := time.Duration(cfg.RetainedProbeTimeout) * time.Second
+		for i := range retainedPairs {
+			p := &retainedPairs[i]
+			sourceOpts, destOpts := brokerOpts[p.source], brokerOpts[p.destination]
+			key := taskKey("retained", p.source, p.destination, interval, timeout, sourceOpts.settings, destOpts.settings)
+			tasks[key] = task{
+				run: func(ctx context.Context) error {
+					return NewRetainedProbe(p, interval, timeout, sourceOpts, destOpts).Run(ctx)
+				},
+				log: newPairLogger(p),
+				cleanup: func() {
+					deleteProbeMetrics(p, metricsTotalRetainedSuccess, metricsTotalRetainedFailed, metricsRetainedPropagation, metricsRetainedStaleness)
+				},
+			}
+		}
+	}
+
+	if cfg.WillProbe {
+		willPairs, err := generateBrokerPairs(cfg.Brokers, cfg.ClientIDPrefix+"-will", []byte{willQoS})
+		if err != nil {
+			return nil, err
+		}
+
+		var sources []string
+		pairsBySource := make(map[string][]brokerPair)
+		for _, p := range willPairs {
+			if _, ok := pairsBySource[p.source]; !ok {
+				sources = append(sources, p.source)
+			}
+			pairsBySource[p.source] = append(pairsBySource[p.source], p)
+		}
+
+		interval := time.Duration(cfg.WillProbeInterval) * time.Second
+		timeout := time.Duration(cfg.WillProbeTimeout) * time.Second
+		for _, source := range sources {
+			sourcePairs := pairsBySource[source]
+			settings := []interface{}{"will", source, interval, timeout, brokerOpts[source].settings}
+			for _, p := range sourcePairs {
+				settings = append(settings, p.destination, brokerOpts[p.destination].settings)
+			}
+			tasks[taskKey(settings...)] = task{
+				run: func(ctx context.Context) error {
+					return NewWillProbe(sourcePairs, interval, timeout, brokerOpts).Run(ctx)
+				},
+				log: newSourceLogger(source, sourcePairs[0].clientID),
+				cleanup: func() {
+					for i := range sourcePairs {
+						deleteProbeMetrics(&sourcePairs[i], metricsTotalWillSuccess, metricsTotalWillFailed, metricsWillDelivery)
+					}
+				},
+			}
+		}
+	}
+
+	if cfg.SessionProbe {
+		sessionPairs, err := generateBrokerPairs(cfg.Brokers, cfg.ClientIDPrefix+"-session", []byte{sessionQoS})
+		if err != nil {
+			return nil, err
+		}
+
+		interval := time.Duration(cfg.SessionProbeInterval) * time.Second
+		timeout := time.Duration(cfg.SessionProbeTimeout) * time.Second
+		for i := range sessionPairs {
+			p := &sessionPairs[i]
+			sourceOpts, destOpts := brokerOpts[p.source], brokerOpts[p.destination]
+			key := taskKey("session", p.source, p.destination, interval, timeout, cfg.SessionProbeMessages, cfg.SessionProbeSwitchBroker, sourceOpts.settings, destOpts.settings)
+			messages, switchBroker := cfg.SessionProbeMessages, cfg.SessionProbeSwitchBroker
+			tasks[key] = task{
+				run: func(ctx context.Context) error {
+					return NewSessionProbe(p, interval, timeout, messages, switchBroker, sourceOpts, destOpts).Run(ctx)
+				},
+				log: newPairLogger(p),
+				cleanup: func() {
+					deleteProbeMetrics(p, metricsTotalSessionDelivered, metricsTotalSessionLost, metricsTotalSessionDuplicated)
+				},
+			}
+		}
+	}
+
+	return tasks, nil
+}
+
+func taskKey(values ...interface{}) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		parts = append(parts, fmt.Sprint(v))
+	}
+
+	return strings.Join(parts, "\x00")
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+type tlsOptions struct {
+	caFile     string
+	certFile   string
+	keyFile    string
+	serverName string
+	minVersion string
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported tls version %q", version)
+	}
+}
+
+// newTLSConfig returns a tls config where the ca and client certificate are
+// read from disk again whenever the files are modified. The certificate of
+// the broker is verified against the server name, or else against the host
+// of the broker.
+func newTLSConfig(opts tlsOptions, host string) (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(opts.minVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if (opts.certFile == "") != (opts.keyFile == "") {
+		return nil, fmt.Errorf("both tls cert file and key file are required when using client certificates")
+	}
+
+	verifyName := opts.serverName
+	if verifyName == "" {
+		verifyName = host
+	}
+
+	reloader := &certificateReloader{
+		caFile:     opts.caFile,
+		certFile:   opts.certFile,
+		keyFile:    opts.keyFile,
+		verifyName: verifyName,
+	}
+
+	//nolint:gosec // the minimum version is configurable and defaults to 1.2
+	tlsCfg := &tls.Config{
+		ServerName: opts.serverName,
+		MinVersion: minVersion,
+	}
+
+	if opts.certFile != "" {
+		_, err := reloader.certificate()
+		if err != nil {
+			return nil, err
+		}
+
+		tlsCfg.GetClientCertificate = func(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return reloader.certificate()
+		}
+	}
+
+	if opts.caFile != "" {
+		if verifyName == "" {
+			return nil, fmt.Errorf("a server name is required to verify the broker with the tls ca file")
+		}
+
+		_, err := reloader.certPool()
+		if err != nil {
+			return nil, err
+		}
+
+		// The verification is done in VerifyConnection instead so that the
+		// ca can be reloaded without recreating the mqtt client.
+		tlsCfg.InsecureSkipVerify = true
+		tlsCfg.VerifyConnection = reloader.verifyConnection
+	}
+
+	return tlsCfg, nil
+}
+
+type certificateReloader struct {
+	mu       sync.Mutex
+	caFile   string
+	certFile string
+	keyFile  string
+	// verifyName is the name the certificate of the broker is verified
+	// against. The server name of the connection can't be used, as it is
+	// empty when connecting to an ip address.
+	verifyName  string
+	caModTime   time.Time
+	certModTime time.Time
+	keyModTime  time.Time
+	pool        *x509.CertPool
+	cert        *tls.Certificate
+}
+
+func (r *certificateReloader) certificate() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certModTime, err := modTime(r.certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keyModTime, err := modTime(r.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.cert != nil && certModTime.Equal(r.certModTime) && keyModTime.Equal(r.keyModTime) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load tls client certificate: %w", err)
+	}
+
+	r.cert = &cert
+	r.certModTime = certModTime
+	r.keyModTime = keyModTime
+
+	return r.cert, nil
+}
+
+func (r *certificateReloader) certPool() (*x509.CertPool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	caModTime, err := modTime(r.caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.pool != nil && caModTime.Equal(r.caModTime) {
+		return r.pool, nil
+	}
+
+	b, err := os.ReadFile(r.caFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read tls ca file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in tls ca file %q", r.caFile)
+	}
+
+	r.pool = pool
+	r.caModTime = caModTime
+
+	return r.pool, nil
+}
+
+func (r *certificateReloader) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("no certificates received from broker")
+	}
+
+	// An empty name would skip the hostname verification.
+	if r.verifyName == "" {
+		return fmt.Errorf("no server name to verify the broker certificate against")
+	}
+
+	pool, err := r.certPool()
+	if err != nil {
+		return err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err = cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       r.verifyName,
+		Roots:         pool,
+		Intermediates: intermediates,
+	})
+
+	return err
+}
+
+func modTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to stat %q: %w", path, err)
+	}
+
+	return info.ModTime(), nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, caKey := newTestCA(t, "ca")
+	serverCert := newTestCertificate(t, ca, caKey, "localhost")
+	clientCert := newTestCertificate(t, ca, caKey, "client")
+
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeTestCertificate(t, caFile, "", &tls.Certificate{Certificate: [][]byte{ca.Raw}})
+	writeTestCertificate(t, certFile, keyFile, clientCert)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	addr := startTestTLSServer(t, serverCert, pool)
+
+	opts := tlsOptions{
+		caFile:     caFile,
+		certFile:   certFile,
+		keyFile:    keyFile,
+		serverName: "localhost",
+		minVersion: "1.2",
+	}
+	tlsCfg, err := newTLSConfig(opts, "127.0.0.1")
+	require.NoError(t, err)
+
+	conn, err := tls.Dial("tcp", addr, tlsCfg)
+	require.NoError(t, err)
+	require.NoError(t, conn.Handshake())
+	conn.Close()
+
+	opts.serverName = "foobar"
+	wrongNameCfg, err := newTLSConfig(opts, "127.0.0.1")
+	require.NoError(t, err)
+	_, err = tls.Dial("tcp", addr, wrongNameCfg)
+	require.Error(t, err)
+
+	// rotate the ca and client certificate on disk
+	otherCA, otherCAKey := newTestCA(t, "other-ca")
+	rotatedCert := newTestCertificate(t, otherCA, otherCAKey, "client")
+	writeTestCertificate(t, certFile, keyFile, rotatedCert)
+	writeTestCertificate(t, caFile, "", &tls.Certificate{Certificate: [][]byte{otherCA.Raw}})
+	touch(t, certFile, keyFile, caFile)
+
+	cert, err := tlsCfg.GetClientCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, rotatedCert.Certificate[0], cert.Certificate[0])
+
+	_, err = tls.Dial("tcp", addr, tlsCfg)
+	require.Error(t, err)
+}
+
+func TestNewTLSConfigVerifiesHost(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, caKey := newTestCA(t, "ca")
+	caFile := filepath.Join(dir, "ca.pem")
+	writeTestCertificate(t, caFile, "", &tls.Certificate{Certificate: [][]byte{ca.Raw}})
+
+	cases := []struct {
+		testDescription string
+		certName        string
+		serverName      string
+		expectedError   string
+	}{
+		{
+			testDescription: "ip address in the certificate",
+			certName:        "localhost",
+		},
+		{
+			testDescription: "certificate for another host",
+			certName:        "broker.example.com",
+			expectedError:   "x509: cannot validate certificate for 127.0.0.1 because it doesn't contain any IP SANs",
+		},
+		{
+			testDescription: "server name instead of the host",
+			certName:        "broker.example.com",
+			serverName:      "broker.example.com",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+		addr := startTestTLSServer(t, newTestCertificate(t, ca, caKey, c.certName), nil)
+
+		// The broker is reached by ip address, so no server name is sent.
+		tlsCfg, err := newTLSConfig(tlsOptions{caFile: caFile, serverName: c.serverName}, "127.0.0.1")
+		require.NoError(t, err)
+
+		conn, err := tls.Dial("tcp", addr, tlsCfg)
+		if err == nil {
+			conn.Close()
+		}
+		testError(t, err, c.expectedError)
+	}
+
+	_, err := newTLSConfig(tlsOptions{caFile: caFile}, "")
+	require.EqualError(t, err, "a server name is required to verify the broker with the tls ca file")
+}
+
+// startTestTLSServer accepts tls connections on 127.0.0.1 and returns the
+// address, client certificates are required when clientCAs is set.
+func startTestTLSServer(t *testing.T, cert *tls.Certificate, clientCAs *x509.CertPool) string {
+	t.Helper()
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAs != nil {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = clientCAs
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestNewTLSConfigErrors(t *testing.T) {
+	cases := []struct {
+		testDescription string
+		input           tlsOptions
+		expectedError   string
+	}{
+		{
+			testDescription: "unsupported version",
+			input:           tlsOptions{minVersion: "2.0"},
+			expectedError:   "unsupported tls version \"2.0\"",
+		},
+		{
+			testDescription: "cert without key",
+			input:           tlsOptions{certFile: "foo"},
+			expectedError:   "both tls cert file and key file are required when using client certificates",
+		},
+		{
+			testDescription: "missing ca file",
+			input:           tlsOptions{caFile: "/does/not/exist"},
+			expectedError:   "unable to stat \"/does/not/exist\": stat /does/not/exist: no such file or directory",
+		},
+		{
+			testDescription: "system roots",
+			input:           tlsOptions{minVersion: "1.3"},
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+		_, err := newTLSConfig(c.input, "broker")
+		testError(t, err, c.expectedError)
+	}
+}
+
+func newTestCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(1 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert, key
+}
+
+func newTestCertificate(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, name string) *tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(1 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	if name == "localhost" {
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+func writeTestCertificate(t *testing.T, certFile string, keyFile string, cert *tls.Certificate) {
+	t.Helper()
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+
+	if keyFile == "" {
+		return
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+}
+
+func touch(t *testing.T, files ...string) {
+	t.Helper()
+
+	future := time.Now().Add(1 * time.Minute)
+	for _, file := range files {
+		require.NoError(t, os.Chtimes(file, future, future))
+	}
+}
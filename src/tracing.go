@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/xenitab/mqtt-pinger"
+
+// tracePropagator carries the trace context in the ping payload, it is used
+// directly instead of the global propagator so that the payload format
+// doesn't depend on the environment.
+var tracePropagator = propagation.TraceContext{}
+
+// setupTracing configures the global tracer provider to export the spans to
+// the otlp endpoint, the spans are dropped if no endpoint is configured. The
+// returned function flushes and stops the exporter.
+func setupTracing(cfg *config) (func(context.Context) error, error) {
+	if cfg.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	if cfg.TraceSampleRatio < 0 || cfg.TraceSampleRatio > 1 {
+		return nil, fmt.Errorf("received trace sample ratio %g but it has to be between 0 and 1", cfg.TraceSampleRatio)
+	}
+
+	opts, err := otlpOptions(cfg.OTLPEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// The exporter connects lazily, so an unavailable collector doesn't
+	// prevent starting.
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := newTracerProvider(exporter, cfg.TraceSampleRatio)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+func newTracerProvider(exporter sdktrace.SpanExporter, sampleRatio float64) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "mqtt-pinger"))),
+	)
+}
+
+// otlpOptions returns the exporter options for an endpoint like
+// http://collector:4318, a path replaces the default /v1/traces.
+func otlpOptions(endpoint string) ([]otlptracehttp.Option, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("otlp endpoint %q should be a url like http://collector:4318", redact(endpoint))
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		opts = append(opts, otlptracehttp.WithInsecure())
+	case "https":
+	default:
+		return nil, fmt.Errorf("otlp endpoint %q has unsupported scheme %q", redact(endpoint), u.Scheme)
+	}
+
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+
+	return opts, nil
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// spanAttributes returns the attributes of the spans of a pair.
+func spanAttributes(p *brokerPair, topic string, sequence uint64) trace.SpanStartEventOption {
+	return trace.WithAttributes(
+		attribute.String("source", p.source),
+		attribute.String("destination", p.destination),
+		attribute.Int("qos", int(p.qos)),
+		attribute.String("messaging.system", "mqtt"),
+		attribute.String("messaging.destination", topic),
+		attribute.Int64("ping.sequence", int64(sequence)),
+	)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/protobuf/proto"
+)
+
+// testCollector stands in for an otlp collector, receiving the spans over
+// http.
+type testCollector struct {
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func startTestCollector(t *testing.T) (*testCollector, string) {
+	t.Helper()
+
+	collector := &testCollector{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var req coltracepb.ExportTraceServiceRequest
+		err = proto.Unmarshal(body, &req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		collector.mu.Lock()
+		for _, resourceSpans := range req.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				collector.spans = append(collector.spans, scopeSpans.Spans...)
+			}
+		}
+		collector.mu.Unlock()
+
+		res, err := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		_, _ = w.Write(res)
+	}))
+	t.Cleanup(server.Close)
+
+	return collector, server.URL
+}
+
+func (c *testCollector) spansByName(name string) []*tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var spans []*tracepb.Span
+	for _, span := range c.spans {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	collector, endpoint := startTestCollector(t)
+	shutdown, err := setupTracing(&config{OTLPEndpoint: endpoint, TraceSampleRatio: 1})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := startTestBroker(t, nil)
+	p := brokerPair{
+		source:            broker.tcp,
+		destination:       broker.tcp,
+		base64Source:      "foo",
+		base64Destination: "foo",
+		clientID:          "foobar-tracing",
+		subscriptionTopic: "tracing",
+		publishTopic:      "tracing",
+		qos:               1,
+	}
+
+	g, gCtx := errgroup.WithContext(ctx)
+	pinger := NewPingClient(&p, 10*time.Millisecond, brokerOptions{})
+	g.Go(func() error {
+		return pinger.Run(gCtx)
+	})
+
+	time.Sleep(400 * time.Millisecond)
+	cancel()
+	require.NoError(t, g.Wait())
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	require.NoError(t, shutdown(shutdownCtx))
+
+	published := collector.spansByName("ping publish")
+	received := collector.spansByName("ping receive")
+	require.NotEmpty(t, published)
+	require.NotEmpty(t, received)
+
+	publishSpans := make(map[string]*tracepb.Span)
+	for _, span := range published {
+		require.Equal(t, tracepb.Span_SPAN_KIND_PRODUCER, span.Kind)
+		publishSpans[string(span.SpanId)] = span
+	}
+
+	for _, span := range received {
+		require.Equal(t, tracepb.Span_SPAN_KIND_CONSUMER, span.Kind)
+		parent, ok := publishSpans[string(span.ParentSpanId)]
+		require.True(t, ok, "receive span without publish span")
+		require.Equal(t, parent.TraceId, span.TraceId)
+		require.Equal(t, parent.StartTimeUnixNano, span.StartTimeUnixNano)
+	}
+}
+
+func TestSetupTracing(t *testing.T) {
+	cases := []struct {
+		testDescription string
+		cfg             config
+		expectedErr     string
+	}{
+		{
+			testDescription: "disabled",
+			cfg:             config{},
+		},
+		{
+			testDescription: "invalid sample ratio",
+			cfg:             config{OTLPEndpoint: "http://collector:4318", TraceSampleRatio: 2},
+			expectedErr:     "received trace sample ratio 2 but it has to be between 0 and 1",
+		},
+		{
+			testDescription: "missing scheme",
+			cfg:             config{OTLPEndpoint: "collector:4318", TraceSampleRatio: 1},
+			expectedErr:     "otlp endpoint \"collector:4318\" should be a url like http://collector:4318",
+		},
+		{
+			testDescription: "unsupported scheme",
+			cfg:             config{OTLPEndpoint: "grpc://collector:4317", TraceSampleRatio: 1},
+			expectedErr:     "otlp endpoint \"grpc://collector:4317\" has unsupported scheme \"grpc\"",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+		shutdown, err := setupTracing(&c.cfg)
+		if c.expectedErr != "" {
+			require.EqualError(t, err, c.expectedErr)
+			continue
+		}
+		require.NoError(t, err)
+		require.NoError(t, shutdown(context.Background()))
+	}
+}
+
+func TestPayloadTrace(t *testing.T) {
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+
+	payload, err := newPingPayload("foo", 1)
+	require.NoError(t, err)
+
+	payload.injectTrace(context.Background())
+	require.Nil(t, payload.Trace)
+
+	ctx, span := tracer().Start(context.Background(), "ping publish")
+	defer span.End()
+	payload.injectTrace(ctx)
+	require.Contains(t, payload.Trace, "traceparent")
+
+	b, err := payload.encode()
+	require.NoError(t, err)
+	decoded, err := decodePingPayload(b)
+	require.NoError(t, err)
+
+	extracted := trace.SpanContextFromContext(decoded.extractTrace(context.Background()))
+	require.True(t, extracted.IsRemote())
+	require.Equal(t, span.SpanContext().TraceID(), extracted.TraceID())
+	require.Equal(t, span.SpanContext().SpanID(), extracted.SpanID())
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	webhookFormatJSON  = "json"
+	webhookFormatSlack = "slack"
+	webhookFormatTeams = "teams"
+)
+
+// webhookQueueSize is the number of notifications waiting to be delivered
+// to a webhook, newer notifications are dropped when it is full.
+const webhookQueueSize = 100
+
+// webhookRetryBackoff is the time to wait before the first retry of a failed
+// delivery, it is doubled for every retry.
+var webhookRetryBackoff = time.Second
+
+var healthColors = map[pairHealth]string{
+	healthUp:       "2eb67d",
+	healthDegraded: "ecb22e",
+	healthDown:     "e01e5a",
+}
+
+var healthEmojis = map[pairHealth]string{
+	healthUp:       ":large_green_circle:",
+	healthDegraded: ":large_yellow_circle:",
+	healthDown:     ":red_circle:",
+}
+
+// webhook delivers the notifications to a url in one of the payload formats.
+type webhook struct {
+	format  string
+	url     string
+	retries int
+	client  *http.Client
+	queue   chan alert
+	log     *dedupLogger
+}
+
+// newWebhook returns the webhook for a target like slack+https://..., the
+// json format is used when the target doesn't start with a format.
+func newWebhook(target string, retries int) (*webhook, error) {
+	format := webhookFormatJSON
+	url := target
+	if prefix, rest, ok := strings.Cut(target, "+"); ok && !strings.Contains(prefix, "://") {
+		format = strings.ToLower(prefix)
+		url = rest
+	}
+
+	switch format {
+	case webhookFormatJSON, webhookFormatSlack, webhookFormatTeams:
+	default:
+		return nil, fmt.Errorf("webhook %q has unsupported format %q, only slack, teams and json are supported", redact(target), format)
+	}
+
+	// The urls of slack and teams webhooks contain the credentials.
+	registerSecret("webhook "+target, url)
+	err := validateHTTPURL("webhook", url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webhook{
+		format:  format,
+		url:     url,
+		retries: retries,
+		client:  &http.Client{Timeout: requestTimeout},
+		queue:   make(chan alert, webhookQueueSize),
+		log:     newDedupLogger(logger.With().Str("webhook", format).Logger()),
+	}, nil
+}
+
+func (w *webhook) enqueue(al alert) {
+	select {
+	case w.queue <- al:
+	default:
+		w.log.logError(errors.New("queue is full"), "dropped notification")
+	}
+}
+
+func (w *webhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case al := <-w.queue:
+			err := w.deliver(ctx, al)
+			if err != nil {
+				w.log.Error().Err(err).Str("pair", al.Pair).Str("state", string(al.State)).Msg("unable to deliver notification")
+				continue
+			}
+			w.log.Info().Str("pair", al.Pair).Str("state", string(al.State)).Msg("notification delivered")
+		}
+	}
+}
+
+// deliver sends the notification, retrying failures other than client
+// errors.
+func (w *webhook) deliver(ctx context.Context, al alert) error {
+	body, err := w.payload(al)
+	if err != nil {
+		return err
+	}
+
+	backoff := webhookRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err = w.post(ctx, body)
+		var permanent permanentError
+		if err == nil || errors.As(err, &permanent) || attempt >= w.retries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (w *webhook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mqtt-pinger")
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return errors.New(redact(err.Error()))
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 == 2 {
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	err = fmt.Errorf("webhook returned status %d: %s", res.StatusCode, bytes.TrimSpace(msg))
+	// Client errors other than rate limiting won't succeed when retried.
+	if res.StatusCode/100 == 4 && res.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+
+	return err
+}
+
+func (w *webhook) payload(al alert) ([]byte, error) {
+	switch w.format {
+	case webhookFormatSlack:
+		return json.Marshal(slackPayload(al))
+	case webhookFormatTeams:
+		return json.Marshal(teamsPayload(al))
+	default:
+		return json.Marshal(al)
+	}
+}
+
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+type slackAttachment struct {
+	Color string `json:"color"`
+	Text  string `json:"text"`
+	Ts    int64  `json:"ts"`
+}
+
+func slackPayload(al alert) slackMessage {
+	return slackMessage{
+		Text: fmt.Sprintf("%s %s", healthEmojis[al.State], al.title()),
+		Attachments: []slackAttachment{{
+			Color: "#" + healthColors[al.State],
+			Text:  al.text(),
+			Ts:    al.Timestamp.Unix(),
+		}},
+	}
+}
+
+// teamsMessage is a connector message card.
+type teamsMessage struct {
+	Type       string         `json:"@type"`
+	Context    string         `json:"@context"`
+	ThemeColor string         `json:"themeColor"`
+	Summary    string         `json:"summary"`
+	Title      string         `json:"title"`
+	Text       string         `json:"text"`
+	Sections   []teamsSection `json:"sections"`
+}
+
+type teamsSection struct {
+	Facts []teamsFact `json:"facts"`
+}
+
+type teamsFact struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func teamsPayload(al alert) teamsMessage {
+	facts := []teamsFact{
+		{"Source", al.Source},
+		{"Destination", al.Destination},
+		{"QoS", fmt.Sprintf("%d", al.QoS)},
+		{"State", string(al.State)},
+		{"Previous state", string(al.PreviousState)},
+		{"Success ratio", fmt.Sprintf("%.0f%%", al.SuccessRatio*100)},
+		{"Time", al.Timestamp.UTC().Format(time.RFC3339)},
+	}
+	if al.Reason != "" {
+		facts = append(facts, teamsFact{"Last failure", al.Reason})
+	}
+
+	return teamsMessage{
+		Type:       "MessageCard",
+		Context:    "https://schema.org/extensions",
+		ThemeColor: healthColors[al.State],
+		Summary:    al.title(),
+		Title:      al.title(),
+		Text:       al.text(),
+		Sections:   []teamsSection{{Facts: facts}},
+	}
+}
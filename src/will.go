@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const willQoS = byte(1)
+
+var (
+	metricsTotalWillSuccess = newCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_total_will_success",
+		Help: "Total number of will messages received on the destination",
+	}, probeLabels)
+
+	metricsTotalWillFailed = newCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_total_will_failed",
+		Help: "Total number of will messages not received on the destination before the timeout",
+	}, probeLabels)
+
+	metricsWillDelivery = newHistogramVec(prometheus.HistogramOpts{
+		Name:    "mqtt_will_delivery_seconds",
+		Help:    "Time from dropping the connection on the source until the will message was received on the destination",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, probeLabels)
+)
+
+// WillProbe connects a client with a will message to the source broker, drops
+// the connection without disconnecting and verifies that the will message is
+// delivered to subscribers on all the destination brokers.
+type WillProbe struct {
+	source     string
+	pairs      []brokerPair
+	opts       map[string]brokerOptions
+	clientID   string
+	topic      string
+	interval   time.Duration
+	timeout    time.Duration
+	stream     string
+	sequence   uint64
+	probeCount uint64
+	log        *dedupLogger
+	pairLogs   []*dedupLogger
+}
+
+// NewWillProbe creates a probe for the pairs, which are all expected to have
+// the same source.
+func NewWillProbe(pairs []brokerPair, interval time.Duration, timeout time.Duration, opts map[string]brokerOptions) *WillProbe {
+	p := pairs[0]
+	probe := &WillProbe{
+		source:   p.source,
+		pairs:    pairs,
+		opts:     opts,
+		clientID: p.clientID,
+		topic:    fmt.Sprintf("mqtt_ping_will/%s", p.base64Source),
+		interval: interval,
+		timeout:  timeout,
+		stream:   fmt.Sprintf("%s-%d", p.clientID, time.Now().UnixNano()),
+		log:      newSourceLogger(p.source, p.clientID),
+	}
+
+	for i := range pairs {
+		probe.pairLogs = append(probe.pairLogs, newPairLogger(&pairs[i]))
+		metricsTotalWillSuccess.WithLabelValues(pairs[i].source, pairs[i].destination).Add(0)
+		metricsTotalWillFailed.WithLabelValues(pairs[i].source, pairs[i].destination).Add(0)
+		metricsWillDelivery.WithLabelValues(pairs[i].source, pairs[i].destination)
+	}
+
+	return probe
+}
+
+func (probe *WillProbe) Run(ctx context.Context) error {
+	probe.log.Info().Str("interval", probe.interval.String()).Int("destinations", len(probe.pairs)).Msg("will probe started")
+
+	ticker := time.NewTicker(probe.interval)
+	defer ticker.Stop()
+
+	for {
+		probe.probe(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (probe *WillProbe) probe(ctx context.Context) {
+	probe.probeCount++
+	probe.sequence++
+	payload, err := newPingPayload(probe.stream, probe.sequence)
+	if err != nil {
+		probe.log.logError(err, "unable to generate will message")
+		return
+	}
+
+	b, err := payload.encode()
+	if err != nil {
+		probe.log.logError(err, "unable to encode will message")
+		return
+	}
+
+	receivers := make([]*willReceiver, len(probe.pairs))
+	for i := range probe.pairs {
+		receivers[i] = probe.subscribe(ctx, &probe.pairs[i], probe.pairLogs[i], payload.ID)
+		defer receivers[i].conn.disconnect()
+	}
+
+	droppedAt, err := probe.dropWithWill(ctx, b)
+	if err != nil {
+		probe.log.logError(err, "will probe unable to connect to source")
+		for _, receiver := range receivers {
+			receiver.fail()
+		}
+		return
+	}
+
+	deadline := droppedAt.Add(probe.timeout)
+	var wg sync.WaitGroup
+	for _, receiver := range receivers {
+		wg.Add(1)
+		go func(receiver *willReceiver) {
+			defer wg.Done()
+			receiver.wait(ctx, deadline, droppedAt)
+		}(receiver)
+	}
+	wg.Wait()
+}
+
+// dropWithWill connects a new client with the will message to the source and
+// drops the connection, returning when the connection was dropped.
+func (probe *WillProbe) dropWithWill(ctx context.Context, will []byte) (time.Time, error) {
+	opts := probe.opts[probe.source]
+	connOpts := opts.connectionOptions(probe.source, fmt.Sprintf("%s-w%d", probe.clientID, probe.probeCount))
+	connOpts.cleanSession = true
+	connOpts.will = &willMessage{
+		topic:   probe.topic,
+		qos:     willQoS,
+		payload: will,
+	}
+	conn := newConnection(connOpts)
+
+	err := conn.connect(ctx)
+	if err != nil {
+		conn.disconnect()
+		return time.Time{}, err
+	}
+
+	conn.drop()
+	droppedAt := time.Now()
+	conn.disconnect()
+
+	return droppedAt, nil
+}
+
+// subscribe connects a new subscriber to the destination of the pair, waiting
+// for the will message with the id.
+func (probe *WillProbe) subscribe(ctx context.Context, p *brokerPair, log *dedupLogger, id string) *willReceiver {
+	receiver := &willReceiver{
+		pair:  p,
+		id:    id,
+		msgCh: make(chan time.Time, 1),
+		log:   log,
+	}
+
+	opts := probe.opts[p.destination]
+	connOpts := opts.connectionOptions(p.destination, fmt.Sprintf("%s-s%d", p.clientID, probe.probeCount))
+	connOpts.cleanSession = true
+	receiver.conn = newConnection(connOpts)
+
+	receiver.err = receiver.conn.connect(ctx)
+	if receiver.err != nil {
+		return receiver
+	}
+
+	subscribeCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	receiver.err = receiver.conn.subscribe(subscribeCtx, probe.topic, willQoS, receiver.messageHandler)
+
+	return receiver
+}
+
+type willReceiver struct {
+	pair  *brokerPair
+	id    string
+	conn  mqttConnection
+	err   error
+	msgCh chan time.Time
+	log   *dedupLogger
+}
+
+func (receiver *willReceiver) messageHandler(b []byte) {
+	receivedAt := time.Now()
+
+	payload, err := decodePingPayload(b)
+	if err != nil {
+		receiver.log.Warn().Err(err).Str("payload", string(b)).Msg("expected to receive a will payload")
+		return
+	}
+
+	if payload.ID != receiver.id {
+		return
+	}
+
+	select {
+	case receiver.msgCh <- receivedAt:
+	default:
+	}
+}
+
+func (receiver *willReceiver) wait(ctx context.Context, deadline time.Time, droppedAt time.Time) {
+	if receiver.err != nil {
+		receiver.log.logError(receiver.err, "will probe unable to subscribe on destination")
+		receiver.fail()
+		return
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+		receiver.log.logError(nil, "will message not received")
+		receiver.fail()
+	case receivedAt := <-receiver.msgCh:
+		delay := receivedAt.Sub(droppedAt)
+		if delay < 0 {
+			delay = 0
+		}
+		metricsWillDelivery.observe(delay.Seconds(), receiver.pair.source, receiver.pair.destination)
+		metricsTotalWillSuccess.inc(receiver.pair.source, receiver.pair.destination)
+	}
+}
+
+func (receiver *willReceiver) fail() {
+	metricsTotalWillFailed.inc(receiver.pair.source, receiver.pair.destination)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWillProbe(t *testing.T) {
+	cases := []struct {
+		testDescription string
+		protocolVersion string
+	}{
+		{
+			testDescription: "mqtt 3.1.1",
+			protocolVersion: protocolVersion311,
+		},
+		{
+			testDescription: "mqtt 5",
+			protocolVersion: protocolVersion5,
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test #%d: %s", i, c.testDescription)
+
+		broker := startTestBroker(t, nil)
+		brokers := []string{broker.tcp, fmt.Sprintf("ws://%s/mqtt", broker.ws), fmt.Sprintf("mqtt://%s", broker.tcp)}
+		pairs, err := generateBrokerPairs(brokers, fmt.Sprintf("will-%d", i), []byte{willQoS})
+		require.NoError(t, err)
+
+		opts := map[string]brokerOptions{}
+		for _, b := range brokers {
+			opts[b] = brokerOptions{protocolVersion: c.protocolVersion}
+		}
+
+		probe := NewWillProbe(pairs[:2], time.Minute, 5*time.Second, opts)
+		probe.probe(context.Background())
+		probe.probe(context.Background())
+
+		for _, p := range pairs[:2] {
+			require.Equal(t, float64(2), testutil.ToFloat64(metricsTotalWillSuccess.WithLabelValues(p.source, p.destination)))
+			require.Equal(t, float64(0), testutil.ToFloat64(metricsTotalWillFailed.WithLabelValues(p.source, p.destination)))
+
+			delivery := &dto.Metric{}
+			observer := metricsWillDelivery.WithLabelValues(p.source, p.destination)
+			require.NoError(t, observer.(prometheus.Histogram).Write(delivery))
+			require.Equal(t, uint64(2), delivery.GetHistogram().GetSampleCount())
+		}
+	}
+}
+
+func TestWillProbeUnreachableDestination(t *testing.T) {
+	broker := startTestBroker(t, nil)
+	pairs, err := generateBrokerPairs([]string{broker.tcp, "127.0.0.1:1"}, "will-unreachable", []byte{willQoS})
+	require.NoError(t, err)
+
+	opts := map[string]brokerOptions{}
+	probe := NewWillProbe(pairs[:1], time.Minute, time.Second, opts)
+	probe.probe(context.Background())
+
+	require.Equal(t, float64(0), testutil.ToFloat64(metricsTotalWillSuccess.WithLabelValues(pairs[0].source, pairs[0].destination)))
+	require.Equal(t, float64(1), testutil.ToFloat64(metricsTotalWillFailed.WithLabelValues(pairs[0].source, pairs[0].destination)))
+}